@@ -2,12 +2,17 @@
 package elf
 
 import (
+	"bufio"
 	"bytes"
 	"debug/elf"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"moria.us/elf2dos/module"
 )
@@ -58,6 +63,221 @@ func wrapErrorSegment(e error, i int) error {
 // information.
 const ptGNUEHFrame elf.ProgType = 0x6474e551
 
+// ptGNUProperty is an ELF segment type containing the GNU property note, which
+// describes features the program uses, like shadow stacks.
+const ptGNUProperty elf.ProgType = 0x6474e553
+
+// GNU note types.
+const (
+	ntGNUBuildID       = 3
+	ntGNUPropertyType0 = 5
+)
+
+// A note is an entry in an ELF note section or segment.
+type note struct {
+	name  string
+	ntype uint32
+	desc  []byte
+}
+
+// parseNotes parses the notes in the contents of a note section or segment.
+// The name and descriptor of each note are padded to the given alignment,
+// which is 4 for ELF32 and usually 8 for ELF64.
+func parseNotes(data []byte, align uint64) ([]note, error) {
+	var notes []note
+	for len(data) != 0 {
+		if len(data) < 12 {
+			return nil, errors.New("truncated note header")
+		}
+		namesz := binary.LittleEndian.Uint32(data)
+		descsz := binary.LittleEndian.Uint32(data[4:])
+		ntype := binary.LittleEndian.Uint32(data[8:])
+		// The padding is relative to the start of the note, so a 4-byte
+		// name after the 12-byte header ends on an 8-byte boundary.
+		nameEnd := (12 + uint64(namesz) + align - 1) &^ (align - 1)
+		descEnd := (nameEnd + uint64(descsz) + align - 1) &^ (align - 1)
+		if uint64(len(data)) < descEnd {
+			return nil, errors.New("truncated note")
+		}
+		notes = append(notes, note{
+			name:  string(bytes.TrimRight(data[12:12+uint64(namesz)], "\x00")),
+			ntype: ntype,
+			desc:  data[nameEnd : nameEnd+uint64(descsz)],
+		})
+		data = data[descEnd:]
+	}
+	return notes, nil
+}
+
+// readBuildID returns the contents of the GNU build ID note in an ELF file, or
+// nil if there is no build ID.
+func readBuildID(f *elf.File) ([]byte, error) {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		// Build ID notes are 4-byte aligned in both ELF classes.
+		notes, err := parseNotes(data, 4)
+		if err != nil {
+			return nil, fmt.Errorf("section %q: %v", s.Name, err)
+		}
+		for _, n := range notes {
+			if n.name == "GNU" && n.ntype == ntGNUBuildID {
+				return n.desc, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// buildIDVersion returns the module version derived from a build ID, which is
+// its first four bytes, so that the version in hexadecimal matches the start
+// of the build ID as printed by readelf.
+func buildIDVersion(id []byte) uint32 {
+	var b [4]byte
+	copy(b[:], id)
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// GNU property types.
+const (
+	gnuPropertyStackSize     = 1
+	gnuPropertyX86ISA1Needed = 0xc0008002
+	gnuPropertyX86Feature1   = 0xc0000002
+	// Binutils 2.31 through 2.34 used a different property for the required
+	// ISA, with one bit for each processor generation.
+	gnuPropertyX86ISA1NeededOld = 0xc0000001
+)
+
+// A gnuProperty is a single property in a GNU property note.
+type gnuProperty struct {
+	ptype uint32
+	data  []byte
+}
+
+// describeGNUProperty returns a description of a GNU property.
+func describeGNUProperty(ptype uint32, data []byte) string {
+	var val uint32
+	if len(data) >= 4 {
+		val = binary.LittleEndian.Uint32(data)
+	}
+	var names []string
+	bits := func(b []string) {
+		for i, n := range b {
+			if val&(1<<uint(i)) != 0 {
+				names = append(names, n)
+			}
+		}
+		if len(names) == 0 {
+			names = append(names, "none")
+		}
+	}
+	switch ptype {
+	case gnuPropertyStackSize:
+		return fmt.Sprintf("stack size 0x%x", val)
+	case gnuPropertyX86ISA1NeededOld:
+		bits([]string{"486", "586", "686", "SSE", "SSE2", "SSE3", "SSSE3", "SSE4.1", "SSE4.2"})
+		return "x86 ISA needed: " + strings.Join(names, ", ")
+	case gnuPropertyX86ISA1Needed:
+		bits([]string{"baseline", "v2", "v3", "v4"})
+		return "x86 ISA needed: " + strings.Join(names, ", ")
+	case gnuPropertyX86Feature1:
+		bits([]string{"IBT", "SHSTK"})
+		return "x86 features: " + strings.Join(names, ", ")
+	default:
+		return fmt.Sprintf("property type 0x%08x", ptype)
+	}
+}
+
+// noteAlign returns the alignment of GNU property notes in an ELF file.
+func noteAlign(f *elf.File) uint64 {
+	if f.Class == elf.ELFCLASS64 {
+		return 8
+	}
+	return 4
+}
+
+// readGNUProperties reads the GNU property note in a segment and returns the
+// properties. The notes and each property in them are padded to the given
+// alignment.
+func readGNUProperties(p *elf.Prog, align uint64) ([]gnuProperty, error) {
+	data := make([]byte, p.Filesz)
+	if _, err := p.ReadAt(data, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	notes, err := parseNotes(data, align)
+	if err != nil {
+		return nil, err
+	}
+	var props []gnuProperty
+	for _, n := range notes {
+		if n.name != "GNU" || n.ntype != ntGNUPropertyType0 {
+			continue
+		}
+		desc := n.desc
+		for len(desc) != 0 {
+			if len(desc) < 8 {
+				return nil, errors.New("truncated GNU property")
+			}
+			ptype := binary.LittleEndian.Uint32(desc)
+			size := uint64(binary.LittleEndian.Uint32(desc[4:]))
+			desc = desc[8:]
+			if uint64(len(desc)) < size {
+				return nil, errors.New("truncated GNU property")
+			}
+			props = append(props, gnuProperty{ptype, desc[:size]})
+			end := (size + align - 1) &^ (align - 1)
+			if end > uint64(len(desc)) {
+				end = uint64(len(desc))
+			}
+			desc = desc[end:]
+		}
+	}
+	return props, nil
+}
+
+// minCPUType returns the minimum CPU type required by the ELF file. The i386
+// ELF header has no flags describing the required processor, so this uses the
+// ISA needed by the GNU property note, if present, and defaults to the 80386.
+func minCPUType(f *elf.File) (uint16, error) {
+	cpu := module.CPU80386
+	if f.Class == elf.ELFCLASS64 {
+		// The x86-64 properties describe 64-bit ISA levels.
+		return cpu, nil
+	}
+	for i, p := range f.Progs {
+		if p.Type != ptGNUProperty {
+			continue
+		}
+		props, err := readGNUProperties(p, noteAlign(f))
+		if err != nil {
+			return 0, wrapErrorSegment(fmt.Errorf("invalid GNU property note: %v", err), i)
+		}
+		for _, prop := range props {
+			if len(prop.data) < 4 {
+				continue
+			}
+			val := binary.LittleEndian.Uint32(prop.data)
+			switch prop.ptype {
+			case gnuPropertyX86ISA1NeededOld, gnuPropertyX86ISA1Needed:
+				// Every ISA level named by either property includes the
+				// 80486 instructions. Later processors have no CPU type.
+				if val != 0 {
+					cpu = module.CPU80486
+				}
+			}
+		}
+	}
+	return cpu, nil
+}
+
 // An addrRange is a range of addresses in the ELF file.
 type addrRange struct {
 	addr uint32
@@ -70,6 +290,12 @@ func (x addrRange) hasAddr(addr uint32) bool {
 	return x.addr <= addr && addr <= x.addr+x.size
 }
 
+// containsAddr returns true if the range contains the given address. Unlike
+// hasAddr, the address one past the end is not included.
+func (x addrRange) containsAddr(addr uint32) bool {
+	return x.addr <= addr && addr-x.addr < x.size
+}
+
 // overlaps returns true if the ranges contain any bytes in common.
 func (x addrRange) overlaps(y addrRange) bool {
 	return x.addr+x.size > y.addr && y.addr+y.size > x.addr
@@ -86,12 +312,37 @@ type segment struct {
 	index  int
 	prog   *elf.Prog
 	object *module.Object
+	merged []int // indexes of segments merged into this one
+}
+
+// resolveAddr resolves an ELF address as an LE/LX object reference. Objects
+// may be adjacent, so an object containing the address is preferred over an
+// object which ends at the address.
+func resolveAddr(segs []segment, addr uint32) module.Ref {
+	if r := findAddr(segs, addr, addrRange.containsAddr); r.Obj != 0 {
+		return r
+	}
+	return findAddr(segs, addr, addrRange.hasAddr)
 }
 
-// resolveAddr resolves an ELF address as an LE/LX object reference.
-func resolveAddr(segs []segment, addr uint32) (r module.Ref) {
+// resolveTop resolves the address of the top of a range, such as a stack, as
+// an LE/LX object reference. Unlike resolveAddr, an object which ends at the
+// address is preferred over an object which starts there.
+func resolveTop(segs []segment, addr uint32) module.Ref {
+	r := findAddr(segs, addr, func(x addrRange, addr uint32) bool {
+		return x.addr < addr && addr <= x.addr+x.size
+	})
+	if r.Obj != 0 {
+		return r
+	}
+	return resolveAddr(segs, addr)
+}
+
+// findAddr returns a reference to the address in the first segment for which
+// the function returns true.
+func findAddr(segs []segment, addr uint32, in func(addrRange, uint32) bool) (r module.Ref) {
 	for i, s := range segs {
-		if s.hasAddr(addr) {
+		if in(s.addrRange, addr) {
 			r.Obj = int32(i + 1)
 			r.Off = int32(addr - s.addr)
 			break
@@ -126,6 +377,10 @@ func readLoadSegment(i int, p *elf.Prog) (seg segment, err error) {
 	if unknownFlags := p.Flags &^ knownFlags; unknownFlags != 0 {
 		return segment{}, fmt.Errorf("segment has unknown flags 0x%08x", uint32(unknownFlags))
 	}
+	if p.Filesz > p.Memsz {
+		return segment{}, fmt.Errorf("segment file size 0x%x exceeds memory size 0x%x",
+			p.Filesz, p.Memsz)
+	}
 	addr := uint32(p.Vaddr)
 	size := uint32(p.Memsz)
 	var data []byte
@@ -156,48 +411,444 @@ func readLoadSegment(i int, p *elf.Prog) (seg segment, err error) {
 	}, nil
 }
 
+// A WXPolicy is what to do with a segment which is both writable and
+// executable. Many DOS extenders do not allow objects which are both.
+type WXPolicy int
+
+const (
+	// WXWarn keeps the object writable and executable, and emits a warning.
+	WXWarn WXPolicy = iota
+	// WXError fails the conversion.
+	WXError
+	// WXDropWrite makes the object read-only.
+	WXDropWrite
+	// WXDropExec makes the object non-executable.
+	WXDropExec
+	// WXSplit splits the segment into an executable object followed by a
+	// writable object, at the start of the first writable section. The
+	// executable sections must all come before the writable sections.
+	WXSplit
+)
+
+var wxPolicyNames = [...]string{
+	WXWarn:      "warn",
+	WXError:     "error",
+	WXDropWrite: "drop-w",
+	WXDropExec:  "drop-x",
+	WXSplit:     "split",
+}
+
+func (p WXPolicy) String() string {
+	if 0 <= p && int(p) < len(wxPolicyNames) {
+		return wxPolicyNames[p]
+	}
+	return fmt.Sprintf("WXPolicy(%d)", int(p))
+}
+
+// ParseWXPolicy returns the policy with the given name: "warn", "error",
+// "drop-w", "drop-x", or "split".
+func ParseWXPolicy(name string) (WXPolicy, error) {
+	for i, n := range wxPolicyNames {
+		if n == name {
+			return WXPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown W^X policy %q", name)
+}
+
+// checkWX applies the W^X policy to a segment, returning the resulting
+// segments.
+func checkWX(f *elf.File, seg segment, opts *ConvertOptions) ([]segment, error) {
+	const wx = module.ObjW | module.ObjX
+	if seg.object.Flags&wx != wx {
+		return []segment{seg}, nil
+	}
+	switch opts.WX {
+	case WXError:
+		return nil, errors.New("segment is both writable and executable")
+	case WXDropWrite:
+		seg.object.Flags &^= module.ObjW
+		return []segment{seg}, nil
+	case WXDropExec:
+		seg.object.Flags &^= module.ObjX
+		return []segment{seg}, nil
+	case WXSplit:
+		return splitWX(f, seg)
+	default:
+		opts.warnf("segment %d is both writable and executable, which many DOS extenders do not allow",
+			seg.index)
+		return []segment{seg}, nil
+	}
+}
+
+// splitWX splits a writable and executable segment into an executable segment
+// and a writable segment. If the segment has no writable sections or no
+// executable sections, the unneeded permission is dropped instead.
+func splitWX(f *elf.File, seg segment) ([]segment, error) {
+	end := seg.addr + seg.size
+	split := end
+	var hasExec bool
+	for _, s := range f.Sections {
+		addr := uint32(s.Addr)
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 || addr < seg.addr || addr >= end {
+			continue
+		}
+		if s.Flags&elf.SHF_WRITE != 0 && addr < split {
+			split = addr
+		}
+		if s.Flags&elf.SHF_EXECINSTR != 0 {
+			hasExec = true
+		}
+	}
+	for _, s := range f.Sections {
+		addr := uint32(s.Addr)
+		if s.Flags&(elf.SHF_ALLOC|elf.SHF_EXECINSTR) != elf.SHF_ALLOC|elf.SHF_EXECINSTR ||
+			s.Size == 0 || addr < seg.addr || addr >= end {
+			continue
+		}
+		if uint64(addr)+s.Size > uint64(split) {
+			return nil, fmt.Errorf(
+				"cannot split segment, executable section %q is not before writable data at 0x%x",
+				s.Name, split)
+		}
+	}
+	if split == end {
+		seg.object.Flags &^= module.ObjW
+		return []segment{seg}, nil
+	}
+	if !hasExec {
+		seg.object.Flags &^= module.ObjX
+		return []segment{seg}, nil
+	}
+	codeSize := split - seg.addr
+	data := seg.object.Data
+	var codeData, dataData []byte
+	if uint32(len(data)) > codeSize {
+		codeData, dataData = data[:codeSize], data[codeSize:]
+	} else {
+		codeData = data
+	}
+	code := seg
+	code.size = codeSize
+	code.object = &module.Object{
+		ObjectHeader: seg.object.ObjectHeader,
+		Data:         codeData,
+	}
+	code.object.VirtualSize = codeSize
+	code.object.Flags &^= module.ObjW
+	rw := seg
+	rw.addr = split
+	rw.size = end - split
+	rw.object = &module.Object{
+		ObjectHeader: seg.object.ObjectHeader,
+		Data:         dataData,
+	}
+	rw.object.BaseAddress = split
+	rw.object.VirtualSize = end - split
+	rw.object.Flags &^= module.ObjX
+	return []segment{code, rw}, nil
+}
+
 // assignSegments assigns each segment in an ELF file to an LE/LX object.
-func assignSegments(f *elf.File) ([]segment, error) {
+func assignSegments(f *elf.File, opts *ConvertOptions) ([]segment, error) {
 	var segments []segment
 	for i, p := range f.Progs {
 		switch p.Type {
 		case elf.PT_NULL, elf.PT_NOTE, ptGNUEHFrame:
 			// NULL means discard, we don't want to keep comments, and we
 			// explicitly discard exception handling information.
+			opts.explainf("segment %d: type %s, discarded", i, p.Type)
+		case ptGNUProperty:
+			// These features are meaningless under DOS, but report them so
+			// the user knows what is being discarded.
+			opts.explainf("segment %d: type %s, discarded", i, p.Type)
+			props, err := readGNUProperties(p, noteAlign(f))
+			if err != nil {
+				return nil, wrapErrorSegment(
+					fmt.Errorf("invalid GNU property note: %v", err), i)
+			}
+			for _, prop := range props {
+				opts.logf("segment %d: discarding GNU property: %s",
+					i, describeGNUProperty(prop.ptype, prop.data))
+			}
 		case elf.PT_LOAD:
 			seg, err := readLoadSegment(i, p)
 			if err != nil {
 				return nil, wrapErrorSegment(err, i)
 			}
-			segments = append(segments, seg)
+			segs, err := checkWX(f, seg, opts)
+			if err != nil {
+				return nil, wrapErrorSegment(err, i)
+			}
+			segments = append(segments, segs...)
 		default:
 			return nil, wrapErrorSegment(
 				fmt.Errorf("segment has type %s, which is unsupported", p.Type), i)
 		}
 	}
+	if err := checkOverlap(segments); err != nil {
+		return nil, err
+	}
+	segments = mergeBSS(segments, opts)
+	if opts.MergeSegments {
+		segments = mergeAdjacent(segments, opts)
+	}
 	return segments, nil
 }
 
-// resolveSymbols resolves each symbol in an ELF file to an LE/LX object
-// reference.
-func resolveSymbols(f *elf.File, segs []segment) ([]symbol, error) {
+// checkOverlap checks that no two segments share any addresses.
+func checkOverlap(segs []segment) error {
+	for i, x := range segs {
+		for _, y := range segs[i+1:] {
+			if x.size == 0 || y.size == 0 || !x.overlaps(y.addrRange) {
+				continue
+			}
+			start, end := x.addr, x.addr+x.size
+			if y.addr > start {
+				start = y.addr
+			}
+			if y.addr+y.size < end {
+				end = y.addr + y.size
+			}
+			return fmt.Errorf("segment %d and segment %d overlap at 0x%x-0x%x",
+				x.index, y.index, start, end)
+		}
+	}
+	return nil
+}
+
+// mergeBSS merges each writable segment which has no file data, like .bss, into
+// the previous segment if that segment is also writable and ends in the same
+// page where the BSS segment starts. The merged object's data covers only the
+// first segment, and the loader fills the rest of the object with zeroes.
+func mergeBSS(segs []segment, opts *ConvertOptions) []segment {
+	var out []segment
+	for _, seg := range segs {
+		if n := len(out); n != 0 && len(seg.object.Data) == 0 {
+			prev := &out[n-1]
+			end := prev.addr + prev.size
+			if prev.object.Flags == seg.object.Flags && seg.object.Flags&module.ObjW != 0 &&
+				seg.addr >= end && seg.addr>>module.PageBits == end>>module.PageBits {
+				opts.logf("segment %d: merging BSS into object for segment %d", seg.index, prev.index)
+				prev.merged = append(append(prev.merged, seg.index), seg.merged...)
+				prev.size = seg.addr + seg.size - prev.addr
+				prev.object.VirtualSize = prev.size
+				continue
+			}
+		}
+		out = append(out, seg)
+	}
+	return out
+}
+
+// mergeAdjacent merges each segment into the previous segment if the previous
+// segment ends in the page before or the same page where the segment starts,
+// and the merged object would not be both writable and executable. The merged
+// object has the flags of both segments, and its data is padded with zeroes
+// up to the start of the second segment's data.
+func mergeAdjacent(segs []segment, opts *ConvertOptions) []segment {
+	const wx = module.ObjW | module.ObjX
+	var out []segment
+	for _, seg := range segs {
+		if n := len(out); n != 0 {
+			prev := &out[n-1]
+			end := prev.addr + prev.size
+			endPage := (uint64(end) + module.PageSize - 1) >> module.PageBits
+			flags := prev.object.Flags | seg.object.Flags
+			if seg.addr >= end && uint64(seg.addr>>module.PageBits) <= endPage && flags&wx != wx {
+				opts.logf("segment %d: merging into object for segment %d", seg.index, prev.index)
+				prev.merged = append(append(prev.merged, seg.index), seg.merged...)
+				if len(seg.object.Data) != 0 {
+					data := make([]byte, seg.addr-prev.addr, int(seg.addr-prev.addr)+len(seg.object.Data))
+					copy(data, prev.object.Data)
+					prev.object.Data = append(data, seg.object.Data...)
+				}
+				prev.size = seg.addr + seg.size - prev.addr
+				prev.object.VirtualSize = prev.size
+				prev.object.Flags = flags
+				continue
+			}
+		}
+		out = append(out, seg)
+	}
+	return out
+}
+
+// checkCompressed checks that no compressed section is in a loaded segment.
+// Segment data is read directly from the file, so the object would contain the
+// compressed bytes.
+func checkCompressed(f *elf.File, segs []segment) error {
+	for i, s := range f.Sections {
+		if s.Flags&elf.SHF_COMPRESSED == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		// The size is the uncompressed size, and the file size is the
+		// compressed size.
+		size := s.Size
+		if s.FileSize > size {
+			size = s.FileSize
+		}
+		if max := uint64(^uint32(0)) - s.Addr; size > max {
+			size = max
+		}
+		r := addrRange{uint32(s.Addr), uint32(size)}
+		for _, seg := range segs {
+			if seg.overlaps(r) {
+				return wrapErrorSection(
+					fmt.Errorf("section is compressed and is in segment %d, which is loaded", seg.index),
+					i, s)
+			}
+		}
+	}
+	return nil
+}
+
+// overrideBases sets the base address of the objects for the given segments,
+// and checks that the resulting objects do not overlap. A segment which was
+// split into several objects moves as a whole: the first object gets the new
+// base address, and the others keep their distance from it.
+func overrideBases(segs []segment, bases map[int]uint32) error {
+	if len(bases) == 0 {
+		return nil
+	}
+	delta := make(map[int]int64)
+	for _, seg := range segs {
+		base, ok := bases[seg.index]
+		if !ok {
+			continue
+		}
+		d, ok := delta[seg.index]
+		if !ok {
+			d = int64(base) - int64(seg.addr)
+			delta[seg.index] = d
+		}
+		addr := int64(seg.addr) + d
+		if addr+int64(seg.size) > 1<<32 {
+			return wrapErrorSegment(
+				fmt.Errorf("base address 0x%x places object past end of address space", base),
+				seg.index)
+		}
+		seg.object.BaseAddress = uint32(addr)
+	}
+	for idx := range bases {
+		if _, ok := delta[idx]; ok {
+			continue
+		}
+		for _, seg := range segs {
+			for _, m := range seg.merged {
+				if m == idx {
+					return fmt.Errorf("cannot set base address of segment %d, which is merged "+
+						"into the object for segment %d; set the base address of segment %d instead",
+						idx, seg.index, seg.index)
+				}
+			}
+		}
+		return fmt.Errorf("cannot set base address of segment %d, which is not loaded", idx)
+	}
+	for i, x := range segs {
+		xr := addrRange{x.object.BaseAddress, x.object.VirtualSize}
+		for _, y := range segs[i+1:] {
+			if xr.overlaps(addrRange{y.object.BaseAddress, y.object.VirtualSize}) {
+				return fmt.Errorf("segment %d and segment %d overlap after setting base addresses",
+					x.index, y.index)
+			}
+		}
+	}
+	return nil
+}
+
+// roundSizes rounds the size of each object up to a whole number of pages,
+// and checks that the resulting objects do not overlap. The number of pages in
+// each object does not change.
+func roundSizes(segs []segment) error {
+	for i := range segs {
+		seg := &segs[i]
+		size := (uint64(seg.size) + module.PageSize - 1) &^ (module.PageSize - 1)
+		if uint64(seg.addr)+size > 1<<32 {
+			return wrapErrorSegment(errors.New("rounded size extends past end of address space"),
+				seg.index)
+		}
+		seg.size = uint32(size)
+		seg.object.VirtualSize = uint32(size)
+	}
+	for i, x := range segs {
+		for _, y := range segs[i+1:] {
+			if x.overlaps(y.addrRange) {
+				return fmt.Errorf("segment %d and segment %d overlap after rounding sizes to pages",
+					x.index, y.index)
+			}
+		}
+	}
+	return nil
+}
+
+// symbolTables maps the section index of each symbol table in an ELF file to
+// its resolved symbols. Relocation sections refer to a table by index, in
+// their sh_link field.
+type symbolTables map[uint32][]symbol
+
+// resolveSymbols resolves each symbol in an ELF file's symbol table and
+// dynamic symbol table to an LE/LX object reference. Symbols in sections which
+// are not loaded are left unresolved, so relocations which refer to them fail.
+// The symbols which are looked up by name are returned separately: these come
+// from the symbol table, or the dynamic symbol table if the file has no symbol
+// table.
+func resolveSymbols(f *elf.File, segs []segment, opts *ConvertOptions) (symbolTables, []symbol, error) {
 	// Map sections to objects.
 	secObjects := make([]int, len(f.Sections))
 	for i, s := range f.Sections {
 		offset := uint32(s.Addr)
 		obj := -1
-		for _, seg := range segs {
+		for j, seg := range segs {
 			if seg.addr <= offset && offset < seg.addr+seg.size {
-				obj = seg.index
+				obj = j
 				break
 			}
 		}
 		secObjects[i] = obj
 	}
-	syms, err := f.Symbols()
-	if err != nil {
-		return nil, err
+	tables := make(symbolTables)
+	var named []symbol
+	for _, t := range []struct {
+		stype elf.SectionType
+		name  string
+		read  func() ([]elf.Symbol, error)
+	}{
+		{elf.SHT_SYMTAB, "symbol table", f.Symbols},
+		{elf.SHT_DYNSYM, "dynamic symbol table", f.DynamicSymbols},
+	} {
+		// The debug/elf package reads the first section of each type.
+		index := -1
+		for i, s := range f.Sections {
+			if s.Type == t.stype {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			opts.logf("no %s", t.name)
+			continue
+		}
+		syms, err := t.read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read %s: %v", t.name, err)
+		}
+		osyms, err := resolveSymbolTable(f, syms, segs, secObjects, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+		tables[uint32(index)] = osyms
+		if named == nil {
+			named = osyms
+		}
 	}
+	return tables, named, nil
+}
+
+// resolveSymbolTable resolves the symbols in one symbol table. The secObjects
+// slice gives the index of the segment containing each section, or -1.
+func resolveSymbolTable(f *elf.File, syms []elf.Symbol, segs []segment, secObjects []int,
+	opts *ConvertOptions) ([]symbol, error) {
 	osyms := make([]symbol, len(syms))
 	for i, sym := range syms {
 		osyms[i].addr = uint32(sym.Value)
@@ -205,6 +856,13 @@ func resolveSymbols(f *elf.File, segs []segment) ([]symbol, error) {
 		// Find the object using the symbol's section.
 		if 0 <= sym.Section && int(sym.Section) < len(secObjects) {
 			obj := secObjects[sym.Section]
+			if obj == -1 {
+				if s := f.Sections[sym.Section]; s.Flags&elf.SHF_ALLOC != 0 {
+					opts.warnf("symbol %q is in section %q, which is not in any loaded segment",
+						sym.Name, s.Name)
+				}
+				continue
+			}
 			seg := segs[obj]
 			osyms[i].Ref = module.Ref{
 				Obj: int32(obj + 1),
@@ -219,7 +877,205 @@ func resolveSymbols(f *elf.File, segs []segment) ([]symbol, error) {
 	return osyms, nil
 }
 
-func addRelocation(rel elf.Rel32, segs []segment, syms []symbol) error {
+// findSymbol resolves the symbol with the given name to an LE/LX object
+// reference. Absolute symbols are resolved by their address, using the given
+// function.
+func findSymbol(segs []segment, syms []symbol, name string,
+	resolve func([]segment, uint32) module.Ref) (module.Ref, error) {
+	var r module.Ref
+	for _, sym := range syms {
+		if sym.name == name {
+			r = sym.Ref
+			if r.Obj == objAbsolute {
+				// Resolve the address as if it were in an object.
+				r = resolve(segs, sym.addr)
+				if r.Obj == 0 {
+					return r, fmt.Errorf("absolute %s 0x%x is not in any object", name, sym.addr)
+				}
+			}
+		}
+	}
+	if r.Obj == 0 {
+		if len(syms) == 0 {
+			return r, fmt.Errorf("could not find %s, the ELF file has no symbol table", name)
+		}
+		return r, fmt.Errorf("could not find %s", name)
+	}
+	return r, nil
+}
+
+// objectSymbols returns the named symbols which are in an object, sorted by
+// object and offset.
+func objectSymbols(syms []symbol) []symbol {
+	var list []symbol
+	for _, sym := range syms {
+		if sym.name != "" && sym.Obj != 0 && sym.Obj != objAbsolute {
+			list = append(list, sym)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		x, y := list[i], list[j]
+		switch {
+		case x.Obj != y.Obj:
+			return x.Obj < y.Obj
+		case x.Off != y.Off:
+			return x.Off < y.Off
+		default:
+			return x.name < y.name
+		}
+	})
+	return list
+}
+
+// findEntrySymbol resolves the named entry symbol, which must be in a loaded
+// section.
+func findEntrySymbol(syms []symbol, name string) (module.Ref, error) {
+	var sym *symbol
+	for i := range syms {
+		if syms[i].name == name {
+			sym = &syms[i]
+		}
+	}
+	switch {
+	case sym == nil:
+		return module.Ref{}, fmt.Errorf("could not find entry symbol %s", name)
+	case sym.Obj == objAbsolute:
+		return module.Ref{}, fmt.Errorf("entry symbol %s is absolute (0x%x), expected a symbol in a section",
+			name, sym.addr)
+	case sym.Obj == 0:
+		return module.Ref{}, fmt.Errorf("entry symbol %s is not in any object", name)
+	}
+	return sym.Ref, nil
+}
+
+// writeSymbolMap writes each named symbol which is in an object, as
+// "obj:offset name", sorted by object and offset.
+func writeSymbolMap(w io.Writer, syms []symbol) error {
+	bw := bufio.NewWriter(w)
+	for _, sym := range objectSymbols(syms) {
+		fmt.Fprintf(bw, "%v %s\n", sym.Ref, sym.name)
+	}
+	return bw.Flush()
+}
+
+// writeSymbolPages writes the page containing each named symbol which is in
+// an object, as "object N page M name", sorted by object and offset. Pages
+// are numbered from 0 within each object.
+func writeSymbolPages(w io.Writer, syms []symbol, pageSize uint32) error {
+	if pageSize == 0 {
+		pageSize = module.PageSize
+	}
+	bw := bufio.NewWriter(w)
+	for _, sym := range objectSymbols(syms) {
+		fmt.Fprintf(bw, "object %d page %d %s\n", sym.Obj, uint32(sym.Off)/pageSize, sym.name)
+	}
+	return bw.Flush()
+}
+
+// writeRelocCoverage writes, for each allocated section in a loaded segment,
+// the number of the section's bytes which are modified by fixups.
+func writeRelocCoverage(w io.Writer, f *elf.File, segs []segment) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-20s  %8s  %8s  %7s\n", "Section", "Size", "Covered", "Percent")
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 || s.Addr+s.Size > 1<<32 {
+			continue
+		}
+		sr := addrRange{uint32(s.Addr), uint32(s.Size)}
+		var seg *segment
+		for i := range segs {
+			if segs[i].contains(sr) {
+				seg = &segs[i]
+				break
+			}
+		}
+		if seg == nil {
+			continue
+		}
+		var ranges []addrRange
+		for _, fix := range seg.object.Fixups {
+			r := addrRange{seg.addr + uint32(fix.Src), uint32(fix.SrcType.Size())}
+			if r.overlaps(sr) {
+				ranges = append(ranges, r)
+			}
+		}
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].addr < ranges[j].addr
+		})
+		// Count each byte once, even if fixups overlap.
+		var covered uint32
+		end := sr.addr
+		for _, r := range ranges {
+			start, stop := r.addr, r.addr+r.size
+			if start < end {
+				start = end
+			}
+			if stop > sr.addr+sr.size {
+				stop = sr.addr + sr.size
+			}
+			if start < stop {
+				covered += stop - start
+				end = stop
+			}
+		}
+		fmt.Fprintf(bw, "%-20s  %8d  %8d  %6.1f%%\n",
+			s.Name, sr.size, covered, 100*float64(covered)/float64(sr.size))
+	}
+	return bw.Flush()
+}
+
+// parseAddr parses an address given as a number. Returns false if the string
+// is not a number, such as a symbol name.
+func parseAddr(s string) (uint32, bool) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(v), true
+}
+
+// relocCounts counts the relocations which were intentionally not converted to
+// fixups.
+type relocCounts struct {
+	outside  int // source is not in any object, such as in EH frame data
+	relative int // PC-relative within a single object
+	absolute int // target is an absolute symbol
+	section  int // in a relocation section excluded by the options
+	orphans  []orphan
+	explain  bool        // record notes for the explanation
+	notes    []relocNote // relocations skipped within objects, if explain is set
+}
+
+// A relocNote is the reason a relocation was not converted to a fixup.
+type relocNote struct {
+	addr   uint32
+	reason string
+}
+
+// note records the reason a relocation was not converted, if the conversion
+// is being explained.
+func (c *relocCounts) note(addr uint32, format string, a ...interface{}) {
+	if c.explain {
+		c.notes = append(c.notes, relocNote{addr, fmt.Sprintf(format, a...)})
+	}
+}
+
+// An orphan is a relocation which was skipped because its source is not in
+// any object.
+type orphan struct {
+	addr   uint32
+	target string // symbol name, or a description if it has none
+}
+
+func (c *relocCounts) skipped() int {
+	return c.outside + c.relative + c.absolute + c.section
+}
+
+// addRelocation adds the fixup for a relocation to the object containing it.
+// If rela is false, the relocation is from a REL section and its addend is
+// ignored.
+func addRelocation(rel elf.Rela32, rela bool, segs []segment, syms []symbol,
+	counts *relocCounts) error {
 	// Find segment containing the relocation source (where the fixup applies).
 	var seg segment
 	var srcObj int32
@@ -234,10 +1090,40 @@ func addRelocation(rel elf.Rel32, segs []segment, syms []symbol) error {
 		// The relocation does not exist in any segment, which may mean that we
 		// have discarded the segment containing it. This can happen to EH frame
 		// data.
+		counts.outside++
+		target := "no symbol"
+		if rsym := rel.Info >> 8; rsym != 0 && rsym <= uint32(len(syms)) {
+			target = syms[rsym-1].name
+			if target == "" {
+				target = fmt.Sprintf("symbol %d", rsym)
+			}
+		}
+		counts.orphans = append(counts.orphans, orphan{rel.Off, target})
 		return nil
 	}
+	rtype := elf.R_386(rel.Info & 0xff)
+	if rtype == elf.R_386_COPY || rtype == elf.R_386_GLOB_DAT {
+		// These are only created for data from shared libraries, and are
+		// resolved by the dynamic linker, which the LE loader does not have.
+		// Their symbols are usually undefined, and copy relocations are in
+		// BSS, so check before looking at either.
+		return fmt.Errorf("relocation type %s at 0x%x requires dynamic linking, "+
+			"which LE/LX modules do not support; link with -static", rtype, rel.Off)
+	}
+	if end := uint64(rel.Off) + 4; end > uint64(seg.addr)+uint64(len(seg.object.Data)) {
+		// The rest of the segment is zero-filled by the loader, like BSS,
+		// and has no data for the fixup to apply to.
+		return fmt.Errorf("relocation at 0x%x is in the uninitialized part of segment %d, "+
+			"which has no file data (file size 0x%x)", rel.Off, seg.index, len(seg.object.Data))
+	}
+	if rtype == elf.R_386_RELATIVE {
+		return addRelativeRelocation(rel, rela, seg, segs)
+	}
 	// Get the relocation target, which is a symbol.
 	rsym := rel.Info >> 8
+	if len(syms) == 0 {
+		return fmt.Errorf("relocation needs symbol %d, but the relocation section has no symbol table", rsym)
+	}
 	if rsym == 0 || rsym > uint32(len(syms)) {
 		return fmt.Errorf("symbol reference %d out of bounds", rsym)
 	}
@@ -246,27 +1132,47 @@ func addRelocation(rel elf.Rel32, segs []segment, syms []symbol) error {
 		return fmt.Errorf("unresolved symbol %q (symbol %d)", sym.name, rsym)
 	}
 	if sym.Obj == objAbsolute {
+		counts.absolute++
+		counts.note(rel.Off, "target %q is an absolute symbol", sym.name)
 		return nil
 	}
 	// Get the current value stored in the relocation. Note that the value here
-	// is after the relocations are applied by the ELF linker.
+	// is after the relocations are applied by the ELF linker. With an explicit
+	// addend, compute the value the linker would store instead.
 	obj := seg.object
 	srcOff := int32(rel.Off - seg.addr)
-	val := binary.LittleEndian.Uint32(obj.Data[srcOff:])
+	var val uint32
+	if rela {
+		val = sym.addr + uint32(rel.Addend)
+		if rtype != elf.R_386_32 {
+			val -= rel.Off
+		}
+	} else {
+		val = binary.LittleEndian.Uint32(obj.Data[srcOff:])
+	}
 	var srcType module.SrcType
 	var fixOff int32
-	switch rtype := elf.R_386(rel.Info & 0xff); rtype {
+	switch rtype {
 	case elf.R_386_32:
 		srcType = module.SrcOffset32
 		fixOff = sym.Off + int32(val-sym.addr)
-	case elf.R_386_PC32:
+	case elf.R_386_PC32, elf.R_386_PLT32:
+		// In a static executable, a PLT entry is the symbol itself.
 		if sym.Obj == srcObj {
 			// Note that: srcOff+int32(val)+4 == fixOff
 			// Relative fixups within an object are not necessary.
+			counts.relative++
+			counts.note(rel.Off, "PC-relative to %q in the same object", sym.name)
 			return nil
 		}
 		srcType = module.SrcRelative32
 		fixOff = sym.Off + int32(val+rel.Off+4-sym.addr)
+	case elf.R_386_JMP_SLOT:
+		// A PLT slot in the GOT. The stored value is for lazy binding, which
+		// does not happen in a fully resolved executable, so the slot is set
+		// to the symbol itself.
+		srcType = module.SrcOffset32
+		fixOff = sym.Off
 	default:
 		return fmt.Errorf("unsupported relocation type %s", rtype)
 	}
@@ -281,13 +1187,55 @@ func addRelocation(rel elf.Rel32, segs []segment, syms []symbol) error {
 	return nil
 }
 
+// addRelativeRelocation adds the fixup for an R_386_RELATIVE relocation, which
+// has no symbol. The target address is the addend, which for a REL relocation
+// is the value stored at the relocation. The caller checks that the relocation
+// is within the segment's data.
+func addRelativeRelocation(rel elf.Rela32, rela bool, seg segment, segs []segment) error {
+	obj := seg.object
+	srcOff := int32(rel.Off - seg.addr)
+	addr := uint32(rel.Addend)
+	if !rela {
+		addr = binary.LittleEndian.Uint32(obj.Data[srcOff:])
+	}
+	target := resolveAddr(segs, addr)
+	if target.Obj == 0 {
+		return fmt.Errorf("relative relocation target 0x%x is not in any object", addr)
+	}
+	obj.Fixups = append(obj.Fixups, module.Fixup{
+		SrcType: module.SrcOffset32,
+		Src:     srcOff,
+		Target:  target,
+	})
+	return nil
+}
+
+// applyFixupHook replaces each fixup with the result of calling the hook on it,
+// removing the fixups which the hook drops.
+func applyFixupHook(segs []segment, hook func(int, module.Fixup) (module.Fixup, bool)) {
+	for i, seg := range segs {
+		obj := seg.object
+		fixups := obj.Fixups[:0]
+		for _, fix := range obj.Fixups {
+			if fix, ok := hook(i+1, fix); ok {
+				fixups = append(fixups, fix)
+			}
+		}
+		obj.Fixups = fixups
+	}
+}
+
 // readRelocationSection reads a single relocation section and adds its fixups
 // to the objects.
-func readRelocationSection(s *elf.Section, segs []segment, syms []symbol) error {
+func readRelocationSection(s *elf.Section, class elf.Class, segs []segment, syms []symbol,
+	counts *relocCounts) error {
 	data, err := s.Data()
 	if err != nil {
 		return err
 	}
+	if class == elf.ELFCLASS64 {
+		return readRelocationSection64(s, data, segs, syms, counts)
+	}
 	r := bytes.NewReader(data)
 	switch s.Type {
 	case elf.SHT_REL:
@@ -297,7 +1245,20 @@ func readRelocationSection(s *elf.Section, segs []segment, syms []symbol) error
 		for r.Len() > 0 {
 			var rel elf.Rel32
 			binary.Read(r, binary.LittleEndian, &rel)
-			if err := addRelocation(rel, segs, syms); err != nil {
+			rela := elf.Rela32{Off: rel.Off, Info: rel.Info}
+			if err := addRelocation(rela, false, segs, syms, counts); err != nil {
+				return wrapErrorf(err, "relocation at 0x%x", rel.Off)
+			}
+		}
+		return nil
+	case elf.SHT_RELA:
+		if len(data)%12 != 0 {
+			return errors.New("RELA section length is not a multiple of 12")
+		}
+		for r.Len() > 0 {
+			var rel elf.Rela32
+			binary.Read(r, binary.LittleEndian, &rel)
+			if err := addRelocation(rel, true, segs, syms, counts); err != nil {
 				return wrapErrorf(err, "relocation at 0x%x", rel.Off)
 			}
 		}
@@ -307,9 +1268,109 @@ func readRelocationSection(s *elf.Section, segs []segment, syms []symbol) error
 	}
 }
 
+// readRelocationSection64 reads a relocation section in a 64-bit ELF file,
+// converting each relocation to the equivalent i386 relocation.
+func readRelocationSection64(s *elf.Section, data []byte, segs []segment, syms []symbol,
+	counts *relocCounts) error {
+	r := bytes.NewReader(data)
+	switch s.Type {
+	case elf.SHT_REL:
+		if len(data)%16 != 0 {
+			return errors.New("REL section length is not a multiple of 16")
+		}
+	case elf.SHT_RELA:
+		if len(data)%24 != 0 {
+			return errors.New("RELA section length is not a multiple of 24")
+		}
+	default:
+		return fmt.Errorf("unsupported relocation section type %s", s.Type)
+	}
+	for r.Len() > 0 {
+		var rel elf.Rela64
+		if s.Type == elf.SHT_REL {
+			var rel64 elf.Rel64
+			binary.Read(r, binary.LittleEndian, &rel64)
+			rel = elf.Rela64{Off: rel64.Off, Info: rel64.Info}
+		} else {
+			binary.Read(r, binary.LittleEndian, &rel)
+		}
+		rel32, err := rela64(rel)
+		if err == nil {
+			err = addRelocation(rel32, s.Type == elf.SHT_RELA, segs, syms, counts)
+		}
+		if err != nil {
+			return wrapErrorf(err, "relocation at 0x%x", rel.Off)
+		}
+	}
+	return nil
+}
+
+// rela64 converts an x86-64 relocation to the i386 relocation which has the
+// same effect, if there is one. Only relocations which modify 32 bits can be
+// converted.
+func rela64(rel elf.Rela64) (elf.Rela32, error) {
+	if rel.Off > math.MaxUint32 {
+		return elf.Rela32{}, fmt.Errorf("address 0x%x does not fit in 32 bits", rel.Off)
+	}
+	if rel.Addend < math.MinInt32 || rel.Addend > math.MaxInt32 {
+		return elf.Rela32{}, fmt.Errorf("addend %d does not fit in 32 bits", rel.Addend)
+	}
+	sym := elf.R_SYM64(rel.Info)
+	if sym >= 1<<24 {
+		return elf.Rela32{}, fmt.Errorf("symbol reference %d out of bounds", sym)
+	}
+	var t elf.R_386
+	switch rtype := elf.R_X86_64(elf.R_TYPE64(rel.Info)); rtype {
+	case elf.R_X86_64_32:
+		t = elf.R_386_32
+	case elf.R_X86_64_PC32:
+		t = elf.R_386_PC32
+	case elf.R_X86_64_PLT32:
+		t = elf.R_386_PLT32
+	default:
+		return elf.Rela32{}, fmt.Errorf("unsupported relocation type %s", rtype)
+	}
+	return elf.Rela32{
+		Off:    uint32(rel.Off),
+		Info:   sym<<8 | uint32(t),
+		Addend: int32(rel.Addend),
+	}, nil
+}
+
+// check32Bit checks that the segments, entry point, and static and dynamic
+// symbols of a 64-bit ELF file all have addresses which fit in 32 bits.
+func check32Bit(f *elf.File) error {
+	if f.Entry > math.MaxUint32 {
+		return fmt.Errorf("entry point 0x%x does not fit in 32 bits", f.Entry)
+	}
+	for i, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr+p.Memsz > 1<<32 {
+			return wrapErrorSegment(fmt.Errorf(
+				"address range 0x%x-0x%x does not fit in 32 bits", p.Vaddr, p.Vaddr+p.Memsz), i)
+		}
+	}
+	for _, read := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		syms, err := read()
+		if err != nil {
+			if err == elf.ErrNoSymbols {
+				continue
+			}
+			return err
+		}
+		for _, sym := range syms {
+			if sym.Section != elf.SHN_UNDEF && sym.Value > math.MaxUint32 {
+				return fmt.Errorf("symbol %q value 0x%x does not fit in 32 bits", sym.Name, sym.Value)
+			}
+		}
+	}
+	return nil
+}
+
 // readSections reads the sections in an ELF file and applies all relevant
-// changes to the segments.
-func readSections(f *elf.File, segs []segment, syms []symbol) error {
+// changes to the segments. Relocations which are not converted to fixups are
+// counted.
+func readSections(f *elf.File, segs []segment, tables symbolTables, opts *ConvertOptions,
+	counts *relocCounts) error {
 	for i, s := range f.Sections {
 		switch s.Type {
 		case elf.SHT_REL, elf.SHT_RELA:
@@ -318,22 +1379,376 @@ func readSections(f *elf.File, segs []segment, syms []symbol) error {
 				return wrapErrorSection(
 					errors.New("relocation section refers to invalid section"), i, s)
 			}
-			if err := readRelocationSection(s, segs, syms); err != nil {
+			if !opts.useRelocSection(s.Name) {
+				opts.logf("section %d (%s): skipping relocations", i, s.Name)
+				opts.explainf("section %d (%s): %d relocations skipped by the options",
+					i, s.Name, relocEntries(s, f.Class))
+				counts.section += relocEntries(s, f.Class)
+				continue
+			}
+			// The relocations refer to symbols in the linked table, which
+			// is either the symbol table or the dynamic symbol table.
+			syms := tables[s.Link]
+			if err := readRelocationSection(s, f.Class, segs, syms, counts); err != nil {
 				return wrapErrorSection(err, i, s)
 			}
 		}
 	}
+	// More than one relocation section may apply to the same object. Merge
+	// them by source offset, keeping the section order for equal offsets, so
+	// the output does not depend on how the relocations are split into
+	// sections.
+	for _, seg := range segs {
+		fixups := seg.object.Fixups
+		sort.SliceStable(fixups, func(i, j int) bool {
+			return fixups[i].Src < fixups[j].Src
+		})
+	}
 	return nil
 }
 
-// ConvertToLELX reads an ELF executable and returns an LE/LX program.
-func ConvertToLELX(name string) (*module.Program, error) {
+// relocEntries returns the number of entries in a relocation section, or zero
+// if the section does not contain relocations.
+func relocEntries(s *elf.Section, class elf.Class) int {
+	rel, rela := 8, 12
+	if class == elf.ELFCLASS64 {
+		rel, rela = 16, 24
+	}
+	switch s.Type {
+	case elf.SHT_REL:
+		return int(s.Size) / rel
+	case elf.SHT_RELA:
+		return int(s.Size) / rela
+	default:
+		return 0
+	}
+}
+
+// verifyRelocations checks that every relocation entry in the ELF file either
+// became a fixup or was intentionally skipped.
+func verifyRelocations(f *elf.File, segs []segment, counts *relocCounts) error {
+	var total int
+	for _, s := range f.Sections {
+		total += relocEntries(s, f.Class)
+	}
+	var fixups int
+	for _, seg := range segs {
+		fixups += len(seg.object.Fixups)
+	}
+	if expect := total - counts.skipped(); fixups != expect {
+		return fmt.Errorf(
+			"%d relocations produced %d fixups, expected %d "+
+				"(skipped %d outside objects, %d relative within an object, %d absolute, "+
+				"%d in ignored sections)",
+			total, fixups, expect, counts.outside, counts.relative, counts.absolute, counts.section)
+	}
+	return nil
+}
+
+// ConvertOptions controls how an ELF executable is converted to an LE/LX
+// program. The zero value uses the default behavior.
+type ConvertOptions struct {
+	// Log, if not nil, receives verbose messages describing the conversion.
+	Log io.Writer
+	// MaxObjectSize, if nonzero, is the largest virtual size allowed for an
+	// object. Some loaders cannot load larger objects.
+	MaxObjectSize uint32
+	// Library marks the module as a library instead of a program. Libraries
+	// may have no entry point, indicated by an ELF entry address of zero.
+	Library bool
+	// SegmentBases overrides the base address of objects. It maps ELF segment
+	// indexes to the base address for the corresponding object. Since fixup
+	// targets and symbols are relative to the object, only the object's base
+	// address changes. The objects from a segment split by WXSplit move
+	// together. A segment merged into the object for another segment cannot
+	// have its own base address.
+	SegmentBases map[int]uint32
+	// RoundSizes rounds the virtual size of each object up to a whole number
+	// of pages, for loaders which expect it. It is applied after
+	// SegmentBases, and the objects must not share any pages.
+	RoundSizes bool
+	// Contiguous assigns new base addresses to the objects so they are laid
+	// out one after another, each aligned to a page, starting at the base
+	// address of the first object. It is applied after SegmentBases.
+	Contiguous bool
+	// MergeSegments merges loadable segments into one object when each
+	// segment starts in the page where the previous segment ends or the page
+	// after, as long as the object would not be both writable and executable.
+	// The object has the permissions of all its segments. Base addresses in
+	// SegmentBases apply to the first segment in each object.
+	MergeSegments bool
+	// Entry, if not empty, is the entry point to use instead of the ELF entry
+	// address. It is either a symbol name or an address, such as "0x10000".
+	Entry string
+	// EntrySymbol, if not empty, is the name of a symbol to use as the entry
+	// point instead of the ELF entry address. Unlike Entry, it is always a
+	// symbol name, and the symbol must be in a section, not absolute. It
+	// cannot be combined with Entry.
+	EntrySymbol string
+	// PreferStart uses the _start symbol as the entry point instead of the
+	// ELF entry address, when the symbol exists. Whether or not it is set, a
+	// warning is given if the two differ.
+	PreferStart bool
+	// Stack, if not empty, is the initial stack pointer to use instead of
+	// the _stack_end symbol. It is either a symbol name or an address. If
+	// both Entry and Stack are addresses, the ELF file does not need a symbol
+	// table.
+	Stack string
+	// StackRef, if its object is nonzero, is the initial stack pointer, given
+	// as an offset in an object. It takes precedence over Stack and the
+	// _stack_end symbol, and must point into a writable object. As with
+	// Stack, if Entry is an address, the ELF file does not need a symbol table.
+	StackRef module.Ref
+	// StackSize, if nonzero, adds a new writable object of exactly this size
+	// for the stack, placed above all other objects, with the initial stack
+	// pointer at its top. It cannot be combined with Stack or StackRef.
+	StackSize uint32
+	// HeapSize is the size of the heap, in bytes, to write in the header.
+	// DOS/32A uses it to size the heap allocated when the program starts.
+	HeapSize uint32
+	// CPUType, if nonzero, is the minimum CPU type to write in the header.
+	// The CPU type may be raised further by hints in the ELF file.
+	CPUType uint16
+	// BuildIDVersion sets the module version from the GNU build ID note, if
+	// the ELF file has one. The version is the first four bytes of the build
+	// ID.
+	BuildIDVersion bool
+	// VerifyRelocations checks that every ELF relocation either produced a
+	// fixup or was skipped for a known reason, so that relocations are not
+	// silently lost.
+	VerifyRelocations bool
+	// Allow64 accepts 64-bit x86-64 ELF files, as long as every segment,
+	// the entry point, and every symbol are below 4 GiB, as with the small
+	// code model. Only relocations which modify 32 bits are supported.
+	Allow64 bool
+	// ReportOrphans gives a warning for each relocation which is skipped
+	// because its source is not in any object. These are expected for
+	// discarded data like EH frames, but may also be real references in a
+	// segment which was dropped. Without this option, they are only logged.
+	ReportOrphans bool
+	// FixupHook, if not nil, is called for each fixup before it is added to
+	// the program, and returns the fixup to add in its place, or false to
+	// drop the fixup. The object is the 1-based index of the object
+	// containing the fixup. The hook is called after all relocations are
+	// read and checked by VerifyRelocations, for each object in order, and
+	// for each fixup in an object in order of source offset.
+	FixupHook func(obj int, fix module.Fixup) (module.Fixup, bool)
+	// OnlyRelocSections, if not empty, lists the names of the only relocation
+	// sections to process. Other relocation sections are ignored.
+	OnlyRelocSections []string
+	// SkipRelocSections lists the names of relocation sections to ignore.
+	// Ignoring relocations produces a broken program, so this is only useful
+	// for debugging.
+	SkipRelocSections []string
+	// WX is what to do with segments which are both writable and executable.
+	WX WXPolicy
+	// RelocCoverage, if not nil, receives a report of how many bytes of each
+	// allocated section are modified by fixups, one section per line.
+	RelocCoverage io.Writer
+	// SymbolMap, if not nil, receives the symbols resolved to objects, one per
+	// line as "obj:offset name", sorted by address.
+	SymbolMap io.Writer
+	// SymbolPages, if not nil, receives the page within its object of each
+	// symbol resolved to an object, one per line as "object N page M name",
+	// sorted by address. This shows which pages must be loaded to use a
+	// symbol.
+	SymbolPages io.Writer
+	// PageSize is the page size used for SymbolPages, or 0 for the default
+	// page size. It must match the page size the module is written with.
+	PageSize uint32
+	// Warnings, if not nil, receives warnings about the conversion.
+	Warnings io.Writer
+	// Explain, if not nil, receives a step by step description of the
+	// conversion: the object each segment is assigned to, where each symbol
+	// resolves, and whether each relocation became a fixup, or why not.
+	Explain io.Writer
+}
+
+// useRelocSection returns true if the relocation section with the given name
+// should be processed.
+func (o *ConvertOptions) useRelocSection(name string) bool {
+	for _, n := range o.SkipRelocSections {
+		if n == name {
+			return false
+		}
+	}
+	if len(o.OnlyRelocSections) == 0 {
+		return true
+	}
+	for _, n := range o.OnlyRelocSections {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logf writes a verbose message to the log, if there is one.
+func (o *ConvertOptions) logf(format string, a ...interface{}) {
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, format+"\n", a...)
+	}
+}
+
+// explainf writes a step of the explanation, if there is a writer for it.
+func (o *ConvertOptions) explainf(format string, a ...interface{}) {
+	if o.Explain != nil {
+		fmt.Fprintf(o.Explain, format+"\n", a...)
+	}
+}
+
+// warnf writes a warning, if there is a writer for warnings.
+func (o *ConvertOptions) warnf(format string, a ...interface{}) {
+	if o.Warnings != nil {
+		fmt.Fprintf(o.Warnings, "warning: "+format+"\n", a...)
+	}
+}
+
+// ConvertToLELX reads an ELF executable and returns an LE/LX program. If opts
+// is nil, the default options are used.
+func ConvertToLELX(name string, opts *ConvertOptions) (*module.Program, error) {
+	res, err := ConvertWithSymbols(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Program, nil
+}
+
+// ConvertWithSymbols reads an ELF executable and returns an LE/LX program,
+// along with the ELF symbols resolved to locations in the program. If opts is
+// nil, the default options are used.
+func ConvertWithSymbols(name string, opts *ConvertOptions) (*ConvertResult, error) {
 	f, err := elf.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	if f.Class != elf.ELFCLASS32 {
+	return convert(f, opts)
+}
+
+// ConvertReader reads an ELF executable of the given size from r and returns an
+// LE/LX program. If opts is nil, the default options are used.
+func ConvertReader(r io.ReaderAt, size int64, opts *ConvertOptions) (*module.Program, error) {
+	res, err := ConvertReaderWithSymbols(r, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Program, nil
+}
+
+// ConvertReaderWithSymbols reads an ELF executable of the given size from r,
+// like ConvertReader, and also returns the resolved symbols.
+func ConvertReaderWithSymbols(r io.ReaderAt, size int64, opts *ConvertOptions) (*ConvertResult, error) {
+	f, err := elf.NewFile(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return convert(f, opts)
+}
+
+// A Symbol is a named ELF symbol, resolved to a location in the LE/LX
+// program.
+type Symbol struct {
+	Name string
+	// Addr is the symbol's value in the ELF file.
+	Addr uint32
+	// Absolute is set for absolute symbols, which are not relative to any
+	// section. Their Ref is the object containing the address, or zero if
+	// no object contains it.
+	Absolute bool
+	Ref      module.Ref
+}
+
+// A Section is an allocated ELF section, resolved to the LE/LX object which
+// contains it.
+type Section struct {
+	Name string
+	Ref  module.Ref // start of the section
+	Size uint32
+}
+
+// A ConvertResult is a converted program, its symbols, and its sections.
+type ConvertResult struct {
+	Program *module.Program
+	// Symbols are the named symbols which are in an object or absolute,
+	// sorted by object and offset. Absolute symbols which are not in any
+	// object come last, sorted by address.
+	Symbols []Symbol
+	// Sections are the nonempty allocated sections which are in an object,
+	// sorted by object and offset.
+	Sections []Section
+}
+
+// exportSymbols returns the named symbols which are in an object or are
+// absolute.
+func exportSymbols(segs []segment, syms []symbol) []Symbol {
+	var out, abs []Symbol
+	for _, sym := range syms {
+		if sym.name == "" || sym.Obj == 0 {
+			continue
+		}
+		s := Symbol{Name: sym.name, Addr: sym.addr, Ref: sym.Ref}
+		if sym.Obj == objAbsolute {
+			s.Absolute = true
+			s.Ref = resolveAddr(segs, sym.addr)
+			if s.Ref.Obj == 0 {
+				abs = append(abs, s)
+				continue
+			}
+		}
+		out = append(out, s)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		x, y := out[i], out[j]
+		switch {
+		case x.Ref.Obj != y.Ref.Obj:
+			return x.Ref.Obj < y.Ref.Obj
+		case x.Ref.Off != y.Ref.Off:
+			return x.Ref.Off < y.Ref.Off
+		default:
+			return x.Name < y.Name
+		}
+	})
+	sort.SliceStable(abs, func(i, j int) bool {
+		return abs[i].Addr < abs[j].Addr
+	})
+	return append(out, abs...)
+}
+
+// exportSections returns the nonempty allocated sections which are in an
+// object.
+func exportSections(f *elf.File, segs []segment) []Section {
+	var out []Section
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 {
+			continue
+		}
+		r := resolveAddr(segs, uint32(s.Addr))
+		if r.Obj == 0 {
+			// In a discarded segment, like the GNU property note.
+			continue
+		}
+		out = append(out, Section{Name: s.Name, Ref: r, Size: uint32(s.Size)})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		x, y := out[i].Ref, out[j].Ref
+		if x.Obj != y.Obj {
+			return x.Obj < y.Obj
+		}
+		return x.Off < y.Off
+	})
+	return out
+}
+
+// convert converts an ELF executable to an LE/LX program.
+func convert(f *elf.File, opts *ConvertOptions) (*ConvertResult, error) {
+	if opts == nil {
+		opts = new(ConvertOptions)
+	}
+	machine := elf.EM_386
+	if f.Class == elf.ELFCLASS64 && opts.Allow64 {
+		machine = elf.EM_X86_64
+	} else if f.Class != elf.ELFCLASS32 {
 		return nil, fmt.Errorf("ELF has class %s, expected ELFCLASS32", f.Class)
 	}
 	if f.Data != elf.ELFDATA2LSB {
@@ -342,42 +1757,248 @@ func ConvertToLELX(name string) (*module.Program, error) {
 	if f.Type != elf.ET_EXEC {
 		return nil, fmt.Errorf("ELF has type %s, expected ET_EXEC", f.Type)
 	}
-	if f.Machine != elf.EM_386 {
-		return nil, fmt.Errorf("ELF Has machine %s, expected EM_386", f.Machine)
+	if f.Machine != machine {
+		return nil, fmt.Errorf("ELF Has machine %s, expected %s", f.Machine, machine)
 	}
-	segs, err := assignSegments(f)
+	if f.Class == elf.ELFCLASS64 {
+		if err := check32Bit(f); err != nil {
+			return nil, err
+		}
+	}
+	segs, err := assignSegments(f, opts)
 	if err != nil {
 		return nil, err
 	}
-	entry := resolveAddr(segs, uint32(f.Entry))
-	if entry.Obj == 0 {
-		return nil, fmt.Errorf("could not resolve entry point 0x%0x", f.Entry)
+	if err := checkCompressed(f, segs); err != nil {
+		return nil, err
+	}
+	if err := overrideBases(segs, opts.SegmentBases); err != nil {
+		return nil, err
+	}
+	if opts.RoundSizes {
+		if err := roundSizes(segs); err != nil {
+			return nil, err
+		}
+	}
+	if max := opts.MaxObjectSize; max != 0 {
+		for i, seg := range segs {
+			if seg.size > max {
+				return nil, fmt.Errorf(
+					"object %d (segment %d) has size 0x%x, which exceeds the maximum object size 0x%x; "+
+						"split the segment into smaller segments",
+					i+1, seg.index, seg.size, max)
+			}
+		}
 	}
-	syms, err := resolveSymbols(f, segs)
+	if opts.Explain != nil {
+		explainSegments(segs, opts)
+	}
+	entryAddr, entryIsAddr := parseAddr(opts.Entry)
+	stackName := opts.Stack
+	if stackName == "" {
+		stackName = "_stack_end"
+	}
+	stackAddr, stackIsAddr := parseAddr(stackName)
+	stackIsRef := opts.StackRef.Obj != 0
+	stackIsNew := opts.StackSize != 0
+	if stackIsNew && (opts.Stack != "" || stackIsRef) {
+		return nil, errors.New("a stack size cannot be combined with a stack pointer")
+	}
+	tables, syms, err := resolveSymbols(f, segs, opts)
 	if err != nil {
 		return nil, err
 	}
+	for _, sym := range objectSymbols(syms) {
+		opts.explainf("symbol %s: 0x%x is %v", sym.name, sym.addr, sym.Ref)
+	}
+	if opts.EntrySymbol != "" && opts.Entry != "" {
+		return nil, errors.New("an entry symbol cannot be combined with an entry point")
+	}
+	var entry module.Ref
+	switch {
+	case opts.EntrySymbol != "":
+		entry, err = findEntrySymbol(syms, opts.EntrySymbol)
+		if err != nil {
+			return nil, err
+		}
+	case entryIsAddr:
+		entry = resolveAddr(segs, entryAddr)
+		if entry.Obj == 0 {
+			return nil, fmt.Errorf("could not resolve entry point 0x%0x", entryAddr)
+		}
+	case opts.Entry != "":
+		entry, err = findSymbol(segs, syms, opts.Entry, resolveAddr)
+		if err != nil {
+			return nil, err
+		}
+	case f.Entry != 0 || !opts.Library:
+		entry = resolveAddr(segs, uint32(f.Entry))
+		start, err := findSymbol(segs, syms, "_start", resolveAddr)
+		if err == nil && start != entry {
+			opts.warnf("_start is %v, but the ELF entry point 0x%x is %v", start, f.Entry, entry)
+			if opts.PreferStart {
+				entry = start
+			}
+		}
+		if entry.Obj == 0 {
+			return nil, fmt.Errorf("could not resolve entry point 0x%0x", f.Entry)
+		}
+	}
 	var stack module.Ref
-	for _, sym := range syms {
-		if sym.name == "_stack_end" {
-			stack = sym.Ref
+	switch {
+	case stackIsRef, stackIsNew:
+		// Set after the program is created, below.
+	case stackIsAddr:
+		stack = resolveTop(segs, stackAddr)
+		if stack.Obj == 0 {
+			return nil, fmt.Errorf("stack address 0x%x is not in any object", stackAddr)
+		}
+	default:
+		stack, err = findSymbol(segs, syms, stackName, resolveTop)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.SymbolMap != nil {
+		if err := writeSymbolMap(opts.SymbolMap, syms); err != nil {
+			return nil, err
 		}
 	}
-	if stack.Obj == 0 {
-		return nil, errors.New("could not find _stack_end")
+	if opts.SymbolPages != nil {
+		if err := writeSymbolPages(opts.SymbolPages, syms, opts.PageSize); err != nil {
+			return nil, err
+		}
 	}
-	if err := readSections(f, segs, syms); err != nil {
+	counts := relocCounts{explain: opts.Explain != nil}
+	if err := readSections(f, segs, tables, opts, &counts); err != nil {
 		return nil, err
 	}
+	if opts.Explain != nil {
+		explainRelocations(segs, &counts, opts)
+	}
+	opts.logf("skipped relocations: %d outside objects, %d relative within an object, %d absolute, "+
+		"%d in ignored sections", counts.outside, counts.relative, counts.absolute, counts.section)
+	for _, o := range counts.orphans {
+		msg := "relocation at 0x%x (target %s) is not in any object, ignored"
+		if opts.ReportOrphans {
+			opts.warnf(msg, o.addr, o.target)
+		} else {
+			opts.logf(msg, o.addr, o.target)
+		}
+	}
+	if opts.VerifyRelocations {
+		if err := verifyRelocations(f, segs, &counts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FixupHook != nil {
+		applyFixupHook(segs, opts.FixupHook)
+	}
+	if opts.RelocCoverage != nil {
+		if err := writeRelocCoverage(opts.RelocCoverage, f, segs); err != nil {
+			return nil, err
+		}
+	}
 	var objs []*module.Object
 	for _, seg := range segs {
 		objs = append(objs, seg.object)
 	}
-	return &module.Program{
+	var flags uint32
+	if opts.Library {
+		flags |= module.ModLibrary
+	}
+	cpu, err := minCPUType(f)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CPUType > cpu {
+		cpu = opts.CPUType
+	}
+	var version uint32
+	if opts.BuildIDVersion {
+		id, err := readBuildID(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build ID note: %v", err)
+		}
+		if id != nil {
+			version = buildIDVersion(id)
+			opts.logf("build ID %x, module version 0x%08x", id, version)
+		} else {
+			opts.warnf("no build ID, module version is zero")
+		}
+	}
+	prog := &module.Program{
 		ProgramHeader: module.ProgramHeader{
-			EIP: entry,
-			ESP: stack,
+			CPUType:       cpu,
+			ModuleVersion: version,
+			ModuleFlags:   flags,
+			HeapSize:      opts.HeapSize,
+			ESP:           stack,
 		},
 		Objects: objs,
+	}
+	if entry.Obj != 0 {
+		if err := prog.SetEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	if stackIsRef {
+		if err := prog.SetStack(opts.StackRef); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Contiguous {
+		if err := prog.MakeContiguous(module.PageSize); err != nil {
+			return nil, err
+		}
+	}
+	if stackIsNew {
+		if err := prog.AddStack(opts.StackSize); err != nil {
+			return nil, err
+		}
+		opts.logf("stack object %d at 0x%x, size 0x%x",
+			len(prog.Objects), prog.Objects[len(prog.Objects)-1].BaseAddress, opts.StackSize)
+	}
+	opts.explainf("entry point: %v", prog.EIP)
+	opts.explainf("stack pointer: %v", prog.ESP)
+	return &ConvertResult{
+		Program:  prog,
+		Symbols:  exportSymbols(segs, syms),
+		Sections: exportSections(f, segs),
 	}, nil
 }
+
+// explainSegments explains the object assigned to each segment.
+func explainSegments(segs []segment, opts *ConvertOptions) {
+	for i, seg := range segs {
+		obj := seg.object
+		opts.explainf("segment %d: object %d at 0x%x, size 0x%x, %s, 0x%x bytes of data",
+			seg.index, i+1, obj.BaseAddress, obj.VirtualSize, obj.Flags, len(obj.Data))
+	}
+}
+
+// explainRelocations explains, in address order, which relocations became
+// fixups and why the others were skipped.
+func explainRelocations(segs []segment, counts *relocCounts, opts *ConvertOptions) {
+	var notes []relocNote
+	for i, seg := range segs {
+		for _, fix := range seg.object.Fixups {
+			notes = append(notes, relocNote{seg.addr + uint32(fix.Src),
+				fmt.Sprintf("fixup in object %d at 0x%x, type 0x%02x, target %v",
+					i+1, fix.Src, uint8(fix.SrcType), fix.Target)})
+		}
+	}
+	for _, n := range counts.notes {
+		notes = append(notes, relocNote{n.addr, "skipped, " + n.reason})
+	}
+	for _, o := range counts.orphans {
+		notes = append(notes, relocNote{o.addr,
+			fmt.Sprintf("skipped, not in any object (target %s)", o.target)})
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].addr < notes[j].addr
+	})
+	for _, n := range notes {
+		opts.explainf("relocation at 0x%x: %s", n.addr, n.reason)
+	}
+}
@@ -0,0 +1,1341 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"moria.us/elf2dos/internal/elftest"
+	"moria.us/elf2dos/module"
+)
+
+func TestSegmentFileSizeExceedsMemSize(t *testing.T) {
+	f := &elf.File{
+		Progs: []*elf.Prog{
+			{
+				ProgHeader: elf.ProgHeader{
+					Type:   elf.PT_LOAD,
+					Flags:  elf.PF_R,
+					Vaddr:  0x10000,
+					Filesz: 0x20,
+					Memsz:  0x10,
+				},
+				ReaderAt: bytes.NewReader(make([]byte, 0x20)),
+			},
+		},
+	}
+	_, err := assignSegments(f, new(ConvertOptions))
+	if err == nil {
+		t.Fatal("assignSegments: expected error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "segment 0: ") ||
+		!strings.Contains(msg, "exceeds memory size") {
+		t.Errorf("assignSegments: unexpected error: %v", err)
+	}
+}
+
+// testELF returns a small ELF executable with a code segment referring to a
+// data segment.
+func testELF() *elftest.File {
+	code := make([]byte, 16)
+	code[0] = 0xb8 // mov eax, msg
+	binary.LittleEndian.PutUint32(code[1:], 0x20004)
+	code[5] = 0xc3 // ret
+	return &elftest.File{
+		Entry: 0x10000,
+		Progs: []elftest.Prog{
+			{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Vaddr: 0x10000, Data: code},
+			{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Vaddr: 0x20000,
+				Data: []byte("....Hello!\n\x00"), Memsz: 0x1000},
+		},
+		Sections: []elftest.Section{
+			{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+				Addr: 0x10000, Size: 16},
+			{Name: ".data", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+				Addr: 0x20000, Size: 12},
+			{Name: ".bss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+				Addr: 0x20010, Size: 0xff0},
+			{Name: ".rel.text", Type: elf.SHT_REL, Info: ".text", Rels: []elf.Rel32{
+				{Off: 0x10001, Info: elftest.RInfo(2, elf.R_386_32)},
+			}},
+		},
+		Symbols: []elftest.Symbol{
+			{Name: "_start", Value: 0x10000, Section: ".text"},
+			{Name: "msg", Value: 0x20004, Section: ".data"},
+			{Name: "_stack_end", Value: 0x21000, Section: ".bss"},
+		},
+	}
+}
+
+// convertTest converts a synthetic ELF file.
+func convertTest(t *testing.T, f *elftest.File, opts *ConvertOptions) (*module.Program, error) {
+	t.Helper()
+	data, err := f.Bytes()
+	if err != nil {
+		t.Fatal("Bytes:", err)
+	}
+	return ConvertReader(bytes.NewReader(data), int64(len(data)), opts)
+}
+
+func TestConvertReader(t *testing.T) {
+	p, err := convertTest(t, testELF(), nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 2 {
+		t.Fatalf("got %d objects, expected 2", len(p.Objects))
+	}
+	if e := (module.Ref{Obj: 1, Off: 0}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	if o := p.Objects[1]; o.BaseAddress != 0x20000 || o.VirtualSize != 0x1000 {
+		t.Errorf("object 2 at 0x%x size 0x%x, expected 0x20000 size 0x1000",
+			o.BaseAddress, o.VirtualSize)
+	}
+	expect := []module.Fixup{{
+		SrcType: module.SrcOffset32,
+		Src:     1,
+		Target:  module.Ref{Obj: 2, Off: 4},
+	}}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+}
+
+func TestGNUProperty(t *testing.T) {
+	// GNU property note with x86 features IBT and SHSTK.
+	note := make([]byte, 28)
+	for i, v := range []uint32{4, 12, ntGNUPropertyType0, 0, gnuPropertyX86Feature1, 4, 3} {
+		binary.LittleEndian.PutUint32(note[i*4:], v)
+	}
+	copy(note[12:], "GNU\x00")
+	f := testELF()
+	f.Progs = append(f.Progs, elftest.Prog{Type: ptGNUProperty, Flags: elf.PF_R, Data: note})
+	var log bytes.Buffer
+	p, err := convertTest(t, f, &ConvertOptions{Log: &log})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 2 {
+		t.Errorf("got %d objects, expected 2", len(p.Objects))
+	}
+	if msg := log.String(); !strings.Contains(msg,
+		"segment 2: discarding GNU property: x86 features: IBT, SHSTK") {
+		t.Errorf("unexpected log: %q", msg)
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	_, err := convertTest(t, testELF(), &ConvertOptions{MaxObjectSize: 0x800})
+	if err == nil {
+		t.Fatal("ConvertReader: expected error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "object 2 (segment 1) has size 0x1000") {
+		t.Errorf("ConvertReader: unexpected error: %v", err)
+	}
+	if _, err := convertTest(t, testELF(), &ConvertOptions{MaxObjectSize: 0x1000}); err != nil {
+		t.Error("ConvertReader:", err)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	f := testELF()
+	f.Entry = 0
+	if _, err := convertTest(t, f, nil); err == nil {
+		t.Error("ConvertReader: expected error for zero entry point")
+	}
+	p, err := convertTest(t, f, &ConvertOptions{Library: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.ModuleFlags&module.ModLibrary == 0 {
+		t.Errorf("module flags 0x%08x do not have library bit", p.ModuleFlags)
+	}
+	if p.EIP != (module.Ref{}) {
+		t.Errorf("EIP = %v, expected none", p.EIP)
+	}
+	p, err = convertTest(t, testELF(), nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.ModuleFlags&module.ModLibrary != 0 {
+		t.Errorf("program has library bit set")
+	}
+}
+
+func TestSegmentBases(t *testing.T) {
+	p, err := convertTest(t, testELF(), &ConvertOptions{
+		SegmentBases: map[int]uint32{1: 0x80000},
+	})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if b := p.Objects[1].BaseAddress; b != 0x80000 {
+		t.Errorf("object 2 base = 0x%x, expected 0x80000", b)
+	}
+	if b := p.Objects[0].BaseAddress; b != 0x10000 {
+		t.Errorf("object 1 base = 0x%x, expected 0x10000", b)
+	}
+	// References into the object are relative to its base.
+	if e := (module.Ref{Obj: 2, Off: 4}); p.Objects[0].Fixups[0].Target != e {
+		t.Errorf("fixup target = %v, expected %v", p.Objects[0].Fixups[0].Target, e)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	image, base, err := p.Relocate()
+	if err != nil {
+		t.Fatal("Relocate:", err)
+	}
+	if v := binary.LittleEndian.Uint32(image[0x10001-base:]); v != 0x80004 {
+		t.Errorf("relocated reference = 0x%x, expected 0x80004", v)
+	}
+
+	_, err = convertTest(t, testELF(), &ConvertOptions{
+		SegmentBases: map[int]uint32{1: 0x10008},
+	})
+	if err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("ConvertReader: got error %v, expected overlap", err)
+	}
+
+	// Both objects from a split segment move together.
+	p, err = convertTest(t, rwxELF(), &ConvertOptions{
+		WX:           WXSplit,
+		SegmentBases: map[int]uint32{0: 0x80000},
+	})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	for i, base := range []uint32{0x80000, 0x80010} {
+		if b := p.Objects[i].BaseAddress; b != base {
+			t.Errorf("split: object %d base = 0x%x, expected 0x%x", i+1, b, base)
+		}
+	}
+
+	// A segment merged into another has no object of its own.
+	f := testELF()
+	f.Progs[1].Memsz = 0
+	f.Progs = append(f.Progs, elftest.Prog{
+		Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Vaddr: 0x20010, Memsz: 0xff0})
+	rodata := elftest.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R, Vaddr: 0x11010, Data: []byte("abc")}
+	g := testELF()
+	g.Progs = []elftest.Prog{g.Progs[0], rodata, g.Progs[1]}
+	for _, c := range []struct {
+		name   string
+		f      *elftest.File
+		opts   ConvertOptions
+		expect string
+	}{
+		{"BSS", f, ConvertOptions{SegmentBases: map[int]uint32{2: 0x80000}},
+			"cannot set base address of segment 2, which is merged into the object for segment 1"},
+		{"adjacent", g, ConvertOptions{MergeSegments: true, SegmentBases: map[int]uint32{1: 0x80000}},
+			"cannot set base address of segment 1, which is merged into the object for segment 0"},
+	} {
+		_, err := convertTest(t, c.f, &c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("%s: got error %v, expected %q", c.name, err, c.expect)
+		}
+	}
+}
+
+func TestAbsoluteStack(t *testing.T) {
+	f := testELF()
+	f.Symbols[2] = elftest.Symbol{Name: "_stack_end", Value: 0x20800, Abs: true}
+	p, err := convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x800}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	f.Symbols[2].Value = 0x90000
+	_, err = convertTest(t, f, nil)
+	if err == nil || err.Error() != "absolute _stack_end 0x90000 is not in any object" {
+		t.Errorf("ConvertReader: unexpected error %v", err)
+	}
+}
+
+// rwxELF returns an ELF executable with a single segment which is writable and
+// executable, containing code followed by data.
+func rwxELF() *elftest.File {
+	data := make([]byte, 0x1c)
+	data[0] = 0xb8 // mov eax, msg
+	binary.LittleEndian.PutUint32(data[1:], 0x10014)
+	data[5] = 0xc3 // ret
+	copy(data[0x10:], "....Hello!\n\x00")
+	return &elftest.File{
+		Entry: 0x10000,
+		Progs: []elftest.Prog{
+			{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W | elf.PF_X, Vaddr: 0x10000,
+				Data: data, Memsz: 0x1000},
+		},
+		Sections: []elftest.Section{
+			{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+				Addr: 0x10000, Size: 16},
+			{Name: ".data", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+				Addr: 0x10010, Size: 12},
+			{Name: ".bss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+				Addr: 0x10020, Size: 0xfe0},
+			{Name: ".rel.text", Type: elf.SHT_REL, Info: ".text", Rels: []elf.Rel32{
+				{Off: 0x10001, Info: elftest.RInfo(2, elf.R_386_32)},
+			}},
+		},
+		Symbols: []elftest.Symbol{
+			{Name: "_start", Value: 0x10000, Section: ".text"},
+			{Name: "msg", Value: 0x10014, Section: ".data"},
+			{Name: "_stack_end", Value: 0x11000, Section: ".bss"},
+		},
+	}
+}
+
+func TestWX(t *testing.T) {
+	const wx = module.ObjW | module.ObjX
+	var warnings bytes.Buffer
+	p, err := convertTest(t, rwxELF(), &ConvertOptions{Warnings: &warnings})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 1 || p.Objects[0].Flags&wx != wx {
+		t.Errorf("expected a single writable and executable object")
+	}
+	if msg := warnings.String(); !strings.Contains(msg,
+		"warning: segment 0 is both writable and executable") {
+		t.Errorf("unexpected warnings: %q", msg)
+	}
+
+	if _, err := convertTest(t, rwxELF(), &ConvertOptions{WX: WXError}); err == nil {
+		t.Error("ConvertReader: expected error")
+	}
+
+	p, err = convertTest(t, rwxELF(), &ConvertOptions{WX: WXDropWrite})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if f := p.Objects[0].Flags; f&wx != module.ObjX {
+		t.Errorf("drop-w: object flags %v, expected executable only", f)
+	}
+
+	p, err = convertTest(t, rwxELF(), &ConvertOptions{WX: WXSplit})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 2 {
+		t.Fatalf("split: got %d objects, expected 2", len(p.Objects))
+	}
+	code, data := p.Objects[0], p.Objects[1]
+	if code.BaseAddress != 0x10000 || code.VirtualSize != 0x10 || code.Flags&wx != module.ObjX {
+		t.Errorf("split: code object at 0x%x size 0x%x flags %v",
+			code.BaseAddress, code.VirtualSize, code.Flags)
+	}
+	if data.BaseAddress != 0x10010 || data.VirtualSize != 0xff0 || data.Flags&wx != module.ObjW {
+		t.Errorf("split: data object at 0x%x size 0x%x flags %v",
+			data.BaseAddress, data.VirtualSize, data.Flags)
+	}
+	if !bytes.Equal(data.Data, []byte("....Hello!\n\x00")) {
+		t.Errorf("split: data object data = %q", data.Data)
+	}
+	expect := []module.Fixup{{
+		SrcType: module.SrcOffset32,
+		Src:     1,
+		Target:  module.Ref{Obj: 2, Off: 4},
+	}}
+	if f := code.Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("split: fixups = %+v, expected %+v", f, expect)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0xff0}); p.ESP != e {
+		t.Errorf("split: ESP = %v, expected %v", p.ESP, e)
+	}
+}
+
+func TestCPUType(t *testing.T) {
+	p, err := convertTest(t, testELF(), nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.CPUType != module.CPU80386 {
+		t.Errorf("CPU type = %d, expected 80386", p.CPUType)
+	}
+
+	// GNU property note requiring the 80486 instructions.
+	note := make([]byte, 28)
+	for i, v := range []uint32{4, 12, ntGNUPropertyType0, 0, gnuPropertyX86ISA1NeededOld, 4, 1} {
+		binary.LittleEndian.PutUint32(note[i*4:], v)
+	}
+	copy(note[12:], "GNU\x00")
+	f := testELF()
+	f.Progs = append(f.Progs, elftest.Prog{Type: ptGNUProperty, Flags: elf.PF_R, Data: note})
+	p, err = convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.CPUType != module.CPU80486 {
+		t.Errorf("CPU type = %d, expected 80486", p.CPUType)
+	}
+
+	p, err = convertTest(t, testELF(), &ConvertOptions{CPUType: module.CPU80486})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.CPUType != module.CPU80486 {
+		t.Errorf("CPU type = %d, expected 80486", p.CPUType)
+	}
+}
+
+func TestVerifyRelocations(t *testing.T) {
+	f := testELF()
+	// A PC-relative relocation within the code object, which is skipped.
+	rel := &f.Sections[3]
+	rel.Rels = append(rel.Rels, elf.Rel32{Off: 0x10008, Info: elftest.RInfo(1, elf.R_386_PC32)})
+	if _, err := convertTest(t, f, &ConvertOptions{VerifyRelocations: true}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+
+	// A relocation section which was never processed.
+	data, err := testELF().Bytes()
+	if err != nil {
+		t.Fatal("Bytes:", err)
+	}
+	ef, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("NewFile:", err)
+	}
+	segs, err := assignSegments(ef, new(ConvertOptions))
+	if err != nil {
+		t.Fatal("assignSegments:", err)
+	}
+	err = verifyRelocations(ef, segs, new(relocCounts))
+	if err == nil || !strings.HasPrefix(err.Error(), "1 relocations produced 0 fixups, expected 1") {
+		t.Errorf("verifyRelocations: unexpected error %v", err)
+	}
+}
+
+func TestMergeBSS(t *testing.T) {
+	f := testELF()
+	f.Progs[1].Memsz = 0
+	f.Progs = append(f.Progs, elftest.Prog{
+		Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Vaddr: 0x20010, Memsz: 0xff0})
+	var log bytes.Buffer
+	p, err := convertTest(t, f, &ConvertOptions{Log: &log})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 2 {
+		t.Fatalf("got %d objects, expected 2", len(p.Objects))
+	}
+	obj := p.Objects[1]
+	if obj.BaseAddress != 0x20000 || obj.VirtualSize != 0x1000 {
+		t.Errorf("object 2 at 0x%x size 0x%x, expected 0x20000 size 0x1000",
+			obj.BaseAddress, obj.VirtualSize)
+	}
+	if !bytes.Equal(obj.Data, []byte("....Hello!\n\x00")) {
+		t.Errorf("object 2 data = %q", obj.Data)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	if msg := log.String(); !strings.Contains(msg,
+		"segment 2: merging BSS into object for segment 1") {
+		t.Errorf("unexpected log: %q", msg)
+	}
+}
+
+func TestMergeSegments(t *testing.T) {
+	f := testELF()
+	rodata := elftest.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R, Vaddr: 0x11010, Data: []byte("abc")}
+	f.Progs = []elftest.Prog{f.Progs[0], rodata, f.Progs[1]}
+	p, err := convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects) != 3 {
+		t.Fatalf("without merging, got %d objects, expected 3", len(p.Objects))
+	}
+	var log bytes.Buffer
+	p, err = convertTest(t, f, &ConvertOptions{MergeSegments: true, Log: &log})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	// The data segment is not merged, because the object would be writable
+	// and executable.
+	if len(p.Objects) != 2 {
+		t.Fatalf("got %d objects, expected 2", len(p.Objects))
+	}
+	obj := p.Objects[0]
+	if obj.BaseAddress != 0x10000 || obj.VirtualSize != 0x1013 {
+		t.Errorf("object 1 at 0x%x size 0x%x, expected 0x10000 size 0x1013",
+			obj.BaseAddress, obj.VirtualSize)
+	}
+	if flags := module.ObjR | module.ObjX | module.Obj32Bit; obj.Flags != flags {
+		t.Errorf("object 1 flags = 0x%x, expected 0x%x", obj.Flags, flags)
+	}
+	if len(obj.Data) != 0x1013 || !bytes.Equal(obj.Data[0x1010:], []byte("abc")) ||
+		!bytes.Equal(obj.Data[:16], f.Progs[0].Data) {
+		t.Errorf("object 1 data is incorrect")
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	if msg := log.String(); !strings.Contains(msg,
+		"segment 1: merging into object for segment 0") {
+		t.Errorf("unexpected log: %q", msg)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	f := testELF()
+	code := f.Progs[0].Data
+	code[6] = 0xe8 // call _start
+	binary.LittleEndian.PutUint32(code[7:], 0xfffffff5)
+	f.Sections[3].Rels = append(f.Sections[3].Rels,
+		elf.Rel32{Off: 0x10007, Info: elftest.RInfo(1, elf.R_386_PC32)})
+	var buf bytes.Buffer
+	if _, err := convertTest(t, f, &ConvertOptions{Explain: &buf}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	s := buf.String()
+	for _, line := range []string{
+		"segment 1: object 2 at 0x20000, size 0x1000, rw- 32-bit, 0xc bytes of data\n",
+		"symbol msg: 0x20004 is 2:0x4\n",
+		"relocation at 0x10001: fixup in object 1 at 0x1, type 0x07, target 2:0x4\n",
+		"relocation at 0x10007: skipped, PC-relative to \"_start\" in the same object\n",
+		"entry point: 1:0x0\n",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("explanation does not contain %q:\n%s", line, s)
+		}
+	}
+}
+
+func TestJumpSlot(t *testing.T) {
+	// The GOT slot at 0x20000 holds the lazy binding address, which is
+	// ignored.
+	f := testELF()
+	binary.LittleEndian.PutUint32(f.Progs[1].Data, 0x10006)
+	f.DynSymbols = []elftest.Symbol{{Name: "_start", Value: 0x10000, Section: ".text"}}
+	f.Sections = append(f.Sections, elftest.Section{
+		Name: ".rel.plt", Type: elf.SHT_REL, Info: ".data", Dynamic: true, Rels: []elf.Rel32{
+			{Off: 0x20000, Info: elftest.RInfo(1, elf.R_386_JMP_SLOT)},
+		}})
+	p, err := convertTest(t, f, &ConvertOptions{VerifyRelocations: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{{SrcType: module.SrcOffset32, Src: 0, Target: module.Ref{Obj: 1, Off: 0}}}
+	if f := p.Objects[1].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+}
+
+func TestRelocationInBSS(t *testing.T) {
+	// The data segment has 12 bytes of file data, followed by zeroes.
+	for _, off := range []uint32{0x2000a, 0x20010} {
+		f := testELF()
+		f.Sections[3].Rels = append(f.Sections[3].Rels,
+			elf.Rel32{Off: off, Info: elftest.RInfo(2, elf.R_386_32)})
+		_, err := convertTest(t, f, nil)
+		expect := fmt.Sprintf("relocation at 0x%x is in the uninitialized part of segment 1", off)
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("ConvertReader: got error %v, expected %q", err, expect)
+		}
+	}
+	// Copy relocations are always in BSS, but need a dynamic linker.
+	f := testELF()
+	f.Sections[3].Rels = append(f.Sections[3].Rels,
+		elf.Rel32{Off: 0x20010, Info: elftest.RInfo(2, elf.R_386_COPY)})
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "R_386_COPY at 0x20010 requires dynamic linking") {
+		t.Errorf("ConvertReader: got error %v, expected dynamic linking error", err)
+	}
+}
+
+func TestOverlappingSegments(t *testing.T) {
+	f := testELF()
+	f.Progs = append(f.Progs, elftest.Prog{
+		Type: elf.PT_LOAD, Flags: elf.PF_R, Vaddr: 0x1000c, Data: []byte("abcdefgh")})
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "segment 0 and segment 2 overlap at 0x1000c-0x10010") {
+		t.Errorf("ConvertReader: got error %v, expected overlapping segments", err)
+	}
+}
+
+func TestBuildIDVersion(t *testing.T) {
+	id := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	note := make([]byte, 16, 16+len(id))
+	for i, v := range []uint32{4, uint32(len(id)), ntGNUBuildID} {
+		binary.LittleEndian.PutUint32(note[i*4:], v)
+	}
+	copy(note[12:], "GNU\x00")
+	note = append(note, id...)
+	f := testELF()
+	f.Sections = append(f.Sections, elftest.Section{
+		Name: ".note.gnu.build-id", Type: elf.SHT_NOTE, Data: note})
+	p, err := convertTest(t, f, &ConvertOptions{BuildIDVersion: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.ModuleVersion != 0x01234567 {
+		t.Errorf("module version = 0x%08x, expected 0x01234567", p.ModuleVersion)
+	}
+	if p, err := convertTest(t, f, nil); err != nil {
+		t.Error("ConvertReader:", err)
+	} else if p.ModuleVersion != 0 {
+		t.Errorf("module version = 0x%08x without option, expected 0", p.ModuleVersion)
+	}
+
+	var warnings bytes.Buffer
+	p, err = convertTest(t, testELF(), &ConvertOptions{BuildIDVersion: true, Warnings: &warnings})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.ModuleVersion != 0 {
+		t.Errorf("module version = 0x%08x without build ID, expected 0", p.ModuleVersion)
+	}
+	if msg := warnings.String(); !strings.Contains(msg, "no build ID") {
+		t.Errorf("unexpected warnings: %q", msg)
+	}
+}
+
+func TestRelocSections(t *testing.T) {
+	f := testELF()
+	// A pointer to _start in the data segment.
+	data := append([]byte(nil), f.Progs[1].Data...)
+	binary.LittleEndian.PutUint32(data, 0x10000)
+	f.Progs[1].Data = data
+	f.Sections = append(f.Sections, elftest.Section{
+		Name: ".rel.data", Type: elf.SHT_REL, Info: ".data", Rels: []elf.Rel32{
+			{Off: 0x20000, Info: elftest.RInfo(1, elf.R_386_32)},
+		}})
+	p, err := convertTest(t, f, &ConvertOptions{VerifyRelocations: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects[0].Fixups) != 1 || len(p.Objects[1].Fixups) != 1 {
+		t.Errorf("got %d and %d fixups, expected 1 and 1",
+			len(p.Objects[0].Fixups), len(p.Objects[1].Fixups))
+	}
+	p, err = convertTest(t, f, &ConvertOptions{
+		OnlyRelocSections: []string{".rel.text"},
+		VerifyRelocations: true,
+	})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects[0].Fixups) != 1 || len(p.Objects[1].Fixups) != 0 {
+		t.Errorf("only .rel.text: got %d and %d fixups, expected 1 and 0",
+			len(p.Objects[0].Fixups), len(p.Objects[1].Fixups))
+	}
+	p, err = convertTest(t, f, &ConvertOptions{SkipRelocSections: []string{".rel.text"}})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if len(p.Objects[0].Fixups) != 0 || len(p.Objects[1].Fixups) != 1 {
+		t.Errorf("skip .rel.text: got %d and %d fixups, expected 0 and 1",
+			len(p.Objects[0].Fixups), len(p.Objects[1].Fixups))
+	}
+}
+
+func TestMultipleRelocSections(t *testing.T) {
+	f := testELF()
+	code := make([]byte, 16)
+	for _, off := range []int{1, 6, 11} {
+		binary.LittleEndian.PutUint32(code[off:], 0x20004)
+	}
+	f.Progs[0].Data = code
+	f.Sections[3].Rels = []elf.Rel32{
+		{Off: 0x1000b, Info: elftest.RInfo(2, elf.R_386_32)},
+		{Off: 0x10001, Info: elftest.RInfo(2, elf.R_386_32)},
+	}
+	f.Sections = append(f.Sections, elftest.Section{
+		Name: ".rel.text.more", Type: elf.SHT_REL, Info: ".text", Rels: []elf.Rel32{
+			{Off: 0x10006, Info: elftest.RInfo(2, elf.R_386_32)},
+		}})
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// The order of the sections does not matter.
+			f.Sections[3], f.Sections[4] = f.Sections[4], f.Sections[3]
+		}
+		p, err := convertTest(t, f, &ConvertOptions{VerifyRelocations: true})
+		if err != nil {
+			t.Fatal("ConvertReader:", err)
+		}
+		var srcs []int32
+		for _, fix := range p.Objects[0].Fixups {
+			srcs = append(srcs, fix.Src)
+		}
+		if expect := []int32{1, 6, 11}; !reflect.DeepEqual(srcs, expect) {
+			t.Errorf("order %d: fixup sources = %v, expected %v", i, srcs, expect)
+		}
+	}
+}
+
+func TestFixupHook(t *testing.T) {
+	f := testELF()
+	f.Sections[3].Rels = append(f.Sections[3].Rels,
+		elf.Rel32{Off: 0x10008, Info: elftest.RInfo(1, elf.R_386_32)})
+	target := module.Ref{Obj: 2, Off: 0x100}
+	var calls []int32
+	p, err := convertTest(t, f, &ConvertOptions{
+		FixupHook: func(obj int, fix module.Fixup) (module.Fixup, bool) {
+			if obj != 1 {
+				t.Errorf("hook called for object %d, expected 1", obj)
+			}
+			calls = append(calls, fix.Src)
+			fix.Target = target
+			return fix, true
+		},
+	})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if expect := []int32{1, 8}; !reflect.DeepEqual(calls, expect) {
+		t.Errorf("hook called with sources %v, expected %v", calls, expect)
+	}
+	for _, fix := range p.Objects[0].Fixups {
+		if fix.Target != target {
+			t.Errorf("fixup at 0x%x has target %v, expected %v", fix.Src, fix.Target, target)
+		}
+	}
+	if n := len(p.Objects[0].Fixups); n != 2 {
+		t.Errorf("got %d fixups, expected 2", n)
+	}
+
+	p, err = convertTest(t, f, &ConvertOptions{
+		FixupHook: func(obj int, fix module.Fixup) (module.Fixup, bool) {
+			return fix, fix.Src != 1
+		},
+	})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if fs := p.Objects[0].Fixups; len(fs) != 1 || fs[0].Src != 8 {
+		t.Errorf("got fixups %v, expected only the fixup at 0x8", fs)
+	}
+}
+
+func TestRelocCoverage(t *testing.T) {
+	f := testELF()
+	// Two overlapping references count each byte once.
+	f.Sections[3].Rels = append(f.Sections[3].Rels,
+		elf.Rel32{Off: 0x10003, Info: elftest.RInfo(2, elf.R_386_32)})
+	var buf bytes.Buffer
+	if _, err := convertTest(t, f, &ConvertOptions{RelocCoverage: &buf}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	const expect = "" +
+		"Section                   Size   Covered  Percent\n" +
+		".text                       16         6    37.5%\n" +
+		".data                       12         0     0.0%\n" +
+		".bss                      4080         0     0.0%\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
+
+func TestSymbolInDiscardedSection(t *testing.T) {
+	f := testELF()
+	f.Sections = append(f.Sections, elftest.Section{
+		Name: ".eh_frame", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: 0x30000, Size: 0x10})
+	f.Symbols = append(f.Symbols, elftest.Symbol{Name: "frame", Value: 0x30000, Section: ".eh_frame"})
+	var warnings bytes.Buffer
+	if _, err := convertTest(t, f, &ConvertOptions{Warnings: &warnings}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if msg := warnings.String(); !strings.Contains(msg,
+		`symbol "frame" is in section ".eh_frame", which is not in any loaded segment`) {
+		t.Errorf("unexpected warnings: %q", msg)
+	}
+
+	// Relocations cannot refer to the symbol.
+	rel := &f.Sections[3]
+	rel.Rels = append(rel.Rels, elf.Rel32{Off: 0x10008, Info: elftest.RInfo(4, elf.R_386_32)})
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), `unresolved symbol "frame"`) {
+		t.Errorf("ConvertReader: got error %v, expected unresolved symbol", err)
+	}
+}
+
+func TestEntrySymbol(t *testing.T) {
+	f := testELF()
+	f.Symbols = append(f.Symbols,
+		elftest.Symbol{Name: "main", Value: 0x10005, Section: ".text"},
+		elftest.Symbol{Name: "abs", Value: 0x10005, Abs: true})
+	p, err := convertTest(t, f, &ConvertOptions{EntrySymbol: "main"})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 5}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	for _, c := range []struct {
+		opts   ConvertOptions
+		expect string
+	}{
+		{ConvertOptions{EntrySymbol: "missing"}, "could not find entry symbol missing"},
+		{ConvertOptions{EntrySymbol: "abs"}, "entry symbol abs is absolute (0x10005)"},
+		{ConvertOptions{EntrySymbol: "main", Entry: "0x10000"}, "cannot be combined"},
+	} {
+		_, err := convertTest(t, f, &c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("ConvertReader: got error %v, expected %q", err, c.expect)
+		}
+	}
+}
+
+func TestEntryStackAddresses(t *testing.T) {
+	f := testELF()
+	f.Sections = f.Sections[:3]
+	f.Symbols = nil
+	if _, err := convertTest(t, f, nil); err == nil {
+		t.Fatal("ConvertReader: expected error without symbols")
+	}
+	p, err := convertTest(t, f, &ConvertOptions{Entry: "0x10005", Stack: "0x20800"})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 5}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x800}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+
+	// Symbol names are still looked up.
+	p, err = convertTest(t, testELF(), &ConvertOptions{Entry: "_start", Stack: "0x20800"})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 0}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+}
+
+func TestEntryNotExecutable(t *testing.T) {
+	f := testELF()
+	f.Entry = 0x20004
+	for _, opts := range []*ConvertOptions{
+		nil,
+		{Entry: "0x20004"},
+		{Entry: "msg"},
+		{EntrySymbol: "msg"},
+	} {
+		_, err := convertTest(t, f, opts)
+		if err == nil || !strings.Contains(err.Error(),
+			"invalid entry point 2:0x4: object 2 is not executable (flags rw-") {
+			t.Errorf("ConvertReader(%+v): got error %v, expected entry point not executable", opts, err)
+		}
+	}
+}
+
+func TestStripped(t *testing.T) {
+	f := testELF()
+	f.Symbols = nil
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "could not find _stack_end, the ELF file has no symbol table") {
+		t.Errorf("ConvertReader: got error %v, expected missing stack symbol", err)
+	}
+	opts := &ConvertOptions{Stack: "0x20800"}
+	_, err = convertTest(t, f, opts)
+	if err == nil || !strings.Contains(err.Error(),
+		"relocation needs symbol 2, but the relocation section has no symbol table") {
+		t.Errorf("ConvertReader: got error %v, expected relocation needing a symbol", err)
+	}
+	// Relative relocations do not need symbols.
+	f.Sections[3].Rels = []elf.Rel32{{Off: 0x10001, Info: uint32(elf.R_386_RELATIVE)}}
+	p, err := convertTest(t, f, opts)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 0}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if n := len(p.Objects[0].Fixups); n != 1 {
+		t.Errorf("got %d fixups, expected 1", n)
+	}
+}
+
+func TestDynamicSymbols(t *testing.T) {
+	// The relocation refers to the dynamic symbol table, which is in a
+	// different order from the symbol table.
+	f := testELF()
+	f.DynSymbols = []elftest.Symbol{
+		{Name: "msg", Value: 0x20004, Section: ".data"},
+	}
+	f.Sections[3].Rels[0].Info = elftest.RInfo(1, elf.R_386_32)
+	f.Sections[3].Dynamic = true
+	p, err := convertTest(t, f, &ConvertOptions{VerifyRelocations: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}}}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+
+	// Without a symbol table, symbols are found in the dynamic symbol table.
+	f.Symbols = nil
+	_, err = convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "could not find _stack_end") {
+		t.Errorf("ConvertReader: got error %v, expected missing _stack_end", err)
+	}
+	f.DynSymbols = append(f.DynSymbols, elftest.Symbol{Name: "_stack_end", Value: 0x21000, Section: ".bss"})
+	p, err = convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+}
+
+func TestObjectBoundary(t *testing.T) {
+	// Each object is immediately followed by another object, so addresses at
+	// the boundaries are both the end of one object and the start of the
+	// next.
+	f := testELF()
+	f.Progs[0].Memsz = 0x1000
+	f.Progs = append(f.Progs,
+		elftest.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Vaddr: 0x11000, Data: []byte{0xc3}},
+		elftest.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Vaddr: 0x21000, Memsz: 0x1000})
+	f.Entry = 0x11000
+	p, err := convertTest(t, f, &ConvertOptions{Stack: "0x21000"})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	// The entry point is the start of an object, and the stack is the top of
+	// an object.
+	if e := (module.Ref{Obj: 3, Off: 0}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+}
+
+func TestStackRef(t *testing.T) {
+	f := testELF()
+	f.Symbols = f.Symbols[:2] // no _stack_end
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "could not find _stack_end") {
+		t.Errorf("ConvertReader: got error %v, expected missing _stack_end", err)
+	}
+	stack := module.Ref{Obj: 2, Off: 0x800}
+	// The explicit reference takes precedence over the stack symbol.
+	p, err := convertTest(t, f, &ConvertOptions{Stack: "msg", StackRef: stack})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if p.ESP != stack {
+		t.Errorf("ESP = %v, expected %v", p.ESP, stack)
+	}
+	_, err = convertTest(t, f, &ConvertOptions{StackRef: module.Ref{Obj: 1, Off: 4}})
+	if err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Errorf("ConvertReader: got error %v, expected stack in read-only object", err)
+	}
+}
+
+func TestStackSize(t *testing.T) {
+	f := testELF()
+	f.Symbols = f.Symbols[:2] // no _stack_end
+	p, err := convertTest(t, f, &ConvertOptions{StackSize: 0x4000})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	n := len(p.Objects)
+	stack := p.Objects[n-1]
+	for i, obj := range p.Objects[:n-1] {
+		if obj.BaseAddress >= stack.BaseAddress {
+			t.Errorf("object %d base 0x%x is not below stack base 0x%x", i+1, obj.BaseAddress, stack.BaseAddress)
+		}
+	}
+	if stack.VirtualSize != 0x4000 || stack.Flags&module.ObjW == 0 {
+		t.Errorf("stack object has size 0x%x, flags 0x%x", stack.VirtualSize, stack.Flags)
+	}
+	if e := (module.Ref{Obj: int32(n), Off: 0x4000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	_, err = convertTest(t, f, &ConvertOptions{StackSize: 0x4000, Stack: "msg"})
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+		t.Errorf("ConvertReader: got error %v, expected conflicting stack options", err)
+	}
+}
+
+func TestStartSymbol(t *testing.T) {
+	f := testELF()
+	f.Entry = 0x10005
+	var warnings bytes.Buffer
+	p, err := convertTest(t, f, &ConvertOptions{Warnings: &warnings})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 5}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if msg := warnings.String(); !strings.Contains(msg,
+		"_start is 1:0x0, but the ELF entry point 0x10005 is 1:0x5") {
+		t.Errorf("unexpected warnings: %q", msg)
+	}
+
+	p, err = convertTest(t, f, &ConvertOptions{PreferStart: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 0}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+}
+
+func TestRoundSizes(t *testing.T) {
+	countPages := func(p *module.Program) []int {
+		n := make([]int, len(p.Objects))
+		for _, pg := range p.Pages() {
+			n[pg.Object-1]++
+		}
+		return n
+	}
+	p1, err := convertTest(t, testELF(), nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	p2, err := convertTest(t, testELF(), &ConvertOptions{RoundSizes: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if s := p1.Objects[0].VirtualSize; s != 0x10 {
+		t.Errorf("unrounded object 1 size = 0x%x, expected 0x10", s)
+	}
+	if s := p2.Objects[0].VirtualSize; s != 0x1000 {
+		t.Errorf("rounded object 1 size = 0x%x, expected 0x1000", s)
+	}
+	if s := p2.Objects[1].VirtualSize; s != 0x1000 {
+		t.Errorf("rounded object 2 size = 0x%x, expected 0x1000", s)
+	}
+	if n1, n2 := countPages(p1), countPages(p2); !reflect.DeepEqual(n1, n2) {
+		t.Errorf("page counts %v unrounded, %v rounded", n1, n2)
+	}
+
+	if _, err := convertTest(t, rwxELF(), &ConvertOptions{WX: WXSplit, RoundSizes: true}); err == nil ||
+		!strings.Contains(err.Error(), "overlap after rounding") {
+		t.Errorf("ConvertReader: got error %v, expected overlap", err)
+	}
+}
+
+func TestSymbolMap(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := convertTest(t, testELF(), &ConvertOptions{SymbolMap: &buf}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	const expect = "1:0x0 _start\n" +
+		"2:0x4 msg\n" +
+		"2:0x1000 _stack_end\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
+
+func TestConvertWithSymbols(t *testing.T) {
+	f := testELF()
+	f.Symbols = append(f.Symbols,
+		elftest.Symbol{Name: "greeting_end", Value: 0x2000b, Abs: true},
+		elftest.Symbol{Name: "video", Value: 0xb8000, Abs: true})
+	data, err := f.Bytes()
+	if err != nil {
+		t.Fatal("Bytes:", err)
+	}
+	res, err := ConvertReaderWithSymbols(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatal("ConvertReaderWithSymbols:", err)
+	}
+	if len(res.Program.Objects) != 2 {
+		t.Errorf("got %d objects, expected 2", len(res.Program.Objects))
+	}
+	expect := []Symbol{
+		{Name: "_start", Addr: 0x10000, Ref: module.Ref{Obj: 1, Off: 0}},
+		{Name: "msg", Addr: 0x20004, Ref: module.Ref{Obj: 2, Off: 4}},
+		{Name: "greeting_end", Addr: 0x2000b, Absolute: true, Ref: module.Ref{Obj: 2, Off: 0xb}},
+		{Name: "_stack_end", Addr: 0x21000, Ref: module.Ref{Obj: 2, Off: 0x1000}},
+		{Name: "video", Addr: 0xb8000, Absolute: true},
+	}
+	if !reflect.DeepEqual(res.Symbols, expect) {
+		t.Errorf("symbols = %+v, expected %+v", res.Symbols, expect)
+	}
+	expectSections := []Section{
+		{Name: ".text", Ref: module.Ref{Obj: 1, Off: 0}, Size: 16},
+		{Name: ".data", Ref: module.Ref{Obj: 2, Off: 0}, Size: 12},
+		{Name: ".bss", Ref: module.Ref{Obj: 2, Off: 0x10}, Size: 0xff0},
+	}
+	if !reflect.DeepEqual(res.Sections, expectSections) {
+		t.Errorf("sections = %+v, expected %+v", res.Sections, expectSections)
+	}
+}
+
+func TestSymbolPages(t *testing.T) {
+	f := testELF()
+	f.Progs[1].Memsz = 0x3000
+	f.Sections[2].Size = 0x2ff0
+	f.Symbols = append(f.Symbols, elftest.Symbol{Name: "buf", Value: 0x21800, Section: ".bss"})
+	f.Symbols[2].Value = 0x23000
+	var buf bytes.Buffer
+	if _, err := convertTest(t, f, &ConvertOptions{SymbolPages: &buf}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	const expect = "object 1 page 0 _start\n" +
+		"object 2 page 0 msg\n" +
+		"object 2 page 1 buf\n" +
+		"object 2 page 3 _stack_end\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+	buf.Reset()
+	if _, err := convertTest(t, f, &ConvertOptions{SymbolPages: &buf, PageSize: 0x2000}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if s := buf.String(); !strings.Contains(s, "object 2 page 0 buf\n") {
+		t.Errorf("with 8 KiB pages, buf is not on page 0:\n%s", s)
+	}
+}
+
+func TestCompressedSection(t *testing.T) {
+	f := testELF()
+	f.Sections[1].Flags |= elf.SHF_COMPRESSED
+	_, err := convertTest(t, f, nil)
+	if err == nil {
+		t.Fatal("ConvertReader: expected error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, `section 2 ".data": `) ||
+		!strings.Contains(msg, "section is compressed and is in segment 1") {
+		t.Errorf("ConvertReader: unexpected error: %v", err)
+	}
+}
+
+func TestRelativeRelocation(t *testing.T) {
+	f := testELF()
+	f.Sections[3].Rels = []elf.Rel32{{Off: 0x10001, Info: uint32(elf.R_386_RELATIVE)}}
+	p, err := convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{{
+		SrcType: module.SrcOffset32,
+		Src:     1,
+		Target:  module.Ref{Obj: 2, Off: 4},
+	}}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+
+	f.Sections[3].Rels[0].Off = 0x10006
+	_, err = convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "relative relocation target 0x0 is not in any object") {
+		t.Errorf("ConvertReader: got error %v, expected unresolved target", err)
+	}
+}
+
+func TestPLT32Relocation(t *testing.T) {
+	f := testELF()
+	code := f.Progs[0].Data
+	code[5] = 0xe8 // call msg
+	binary.LittleEndian.PutUint32(code[6:], 0x20004-0x1000a)
+	f.Sections[3].Rels = append(f.Sections[3].Rels,
+		elf.Rel32{Off: 0x10006, Info: elftest.RInfo(2, elf.R_386_PLT32)})
+	p, err := convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{
+		{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}},
+		{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 2, Off: 4}},
+	}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+}
+
+func TestDynamicRelocation(t *testing.T) {
+	for _, c := range []struct {
+		rtype elf.R_386
+		name  string
+	}{
+		{elf.R_386_COPY, "R_386_COPY"},
+		{elf.R_386_GLOB_DAT, "R_386_GLOB_DAT"},
+	} {
+		f := testELF()
+		f.Sections[3].Rels = append(f.Sections[3].Rels,
+			elf.Rel32{Off: 0x10008, Info: elftest.RInfo(2, c.rtype)})
+		_, err := convertTest(t, f, nil)
+		expect := "relocation type " + c.name + " at 0x10008 requires dynamic linking, " +
+			"which LE/LX modules do not support; link with -static"
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: got error %v, expected %q", c.name, err, expect)
+		}
+	}
+}
+
+func TestOrphanRelocation(t *testing.T) {
+	f := testELF()
+	// A relocation in a section which is not in any segment.
+	f.Sections = append(f.Sections,
+		elftest.Section{Name: ".eh_frame", Type: elf.SHT_PROGBITS, Addr: 0x30000, Size: 8},
+		elftest.Section{Name: ".rel.eh_frame", Type: elf.SHT_REL, Info: ".eh_frame", Rels: []elf.Rel32{
+			{Off: 0x30004, Info: elftest.RInfo(2, elf.R_386_32)},
+		}})
+	const msg = "relocation at 0x30004 (target msg) is not in any object, ignored"
+	var log, warnings bytes.Buffer
+	p, err := convertTest(t, f, &ConvertOptions{Log: &log, Warnings: &warnings})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if n := len(p.Objects[0].Fixups) + len(p.Objects[1].Fixups); n != 1 {
+		t.Errorf("got %d fixups, expected 1", n)
+	}
+	if !strings.Contains(log.String(), msg) {
+		t.Errorf("log does not contain %q:\n%s", msg, log.String())
+	}
+	if warnings.Len() != 0 {
+		t.Errorf("unexpected warnings: %q", warnings.String())
+	}
+	warnings.Reset()
+	if _, err := convertTest(t, f, &ConvertOptions{ReportOrphans: true, Warnings: &warnings}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	if s := warnings.String(); s != "warning: "+msg+"\n" {
+		t.Errorf("got warnings %q, expected %q", s, msg)
+	}
+}
+
+// testELF64 returns the program from testELF as an x86-64 ELF file.
+func testELF64() *elftest.File {
+	f := testELF()
+	f.Class64 = true
+	code := f.Progs[0].Data
+	binary.LittleEndian.PutUint32(code[1:], 0)
+	code[5] = 0xe8 // call msg+4
+	binary.LittleEndian.PutUint32(code[6:], 0)
+	code[10] = 0xc3
+	f.Sections[3] = elftest.Section{Name: ".rela.text", Type: elf.SHT_RELA, Info: ".text", Relas64: []elf.Rela64{
+		{Off: 0x10001, Info: elftest.RInfo64(2, elf.R_X86_64_32)},
+		{Off: 0x10006, Info: elftest.RInfo64(2, elf.R_X86_64_PC32), Addend: -4},
+	}}
+	return f
+}
+
+func TestConvert64(t *testing.T) {
+	f := testELF64()
+	_, err := convertTest(t, f, nil)
+	if err == nil || !strings.Contains(err.Error(), "ELF has class ELFCLASS64, expected ELFCLASS32") {
+		t.Errorf("ConvertReader: got error %v, expected class error", err)
+	}
+	p, err := convertTest(t, f, &ConvertOptions{Allow64: true, VerifyRelocations: true})
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{
+		{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}},
+		{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 2, Off: 4}},
+	}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+
+	// GNU property note as written by gcc -m64 -fcf-protection, where each
+	// property is padded to 8 bytes.
+	note := make([]byte, 48)
+	for i, v := range []uint32{4, 32, ntGNUPropertyType0, 0,
+		gnuPropertyX86Feature1, 4, 3, 0, gnuPropertyX86ISA1Needed, 4, 1, 0} {
+		binary.LittleEndian.PutUint32(note[i*4:], v)
+	}
+	copy(note[12:], "GNU\x00")
+	f = testELF64()
+	f.Progs = append(f.Progs, elftest.Prog{Type: ptGNUProperty, Flags: elf.PF_R, Data: note})
+	var log bytes.Buffer
+	if _, err := convertTest(t, f, &ConvertOptions{Allow64: true, Log: &log}); err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	for _, s := range []string{
+		"segment 2: discarding GNU property: x86 features: IBT, SHSTK",
+		"segment 2: discarding GNU property: x86 ISA needed: baseline",
+	} {
+		if msg := log.String(); !strings.Contains(msg, s) {
+			t.Errorf("log %q does not contain %q", msg, s)
+		}
+	}
+
+	f = testELF64()
+	f.Sections[3].Relas64[0].Info = elftest.RInfo64(2, elf.R_X86_64_64)
+	_, err = convertTest(t, f, &ConvertOptions{Allow64: true})
+	if err == nil || !strings.Contains(err.Error(),
+		"relocation at 0x10001: unsupported relocation type R_X86_64_64") {
+		t.Errorf("ConvertReader: got error %v, expected unsupported relocation", err)
+	}
+
+	f = testELF64()
+	f.Sections[3].Relas64[1].Off = 0x100010006
+	_, err = convertTest(t, f, &ConvertOptions{Allow64: true})
+	if err == nil || !strings.Contains(err.Error(),
+		"relocation at 0x100010006: address 0x100010006 does not fit in 32 bits") {
+		t.Errorf("ConvertReader: got error %v, expected address too large", err)
+	}
+
+	// Dynamic symbols are checked as well as the static symbol table. The
+	// test ELF only has 32-bit values, so set the high word of the value of
+	// the first dynamic symbol after the null symbol.
+	f = testELF64()
+	f.DynSymbols = []elftest.Symbol{{Name: "msg", Value: 0x20004, Section: ".data"}}
+	data, err := f.Bytes()
+	if err != nil {
+		t.Fatal("Bytes:", err)
+	}
+	ef, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("NewFile:", err)
+	}
+	dynsym := ef.Section(".dynsym")
+	binary.LittleEndian.PutUint32(data[dynsym.Offset+elf.Sym64Size+12:], 1)
+	_, err = ConvertReader(bytes.NewReader(data), int64(len(data)), &ConvertOptions{Allow64: true})
+	if err == nil || !strings.Contains(err.Error(), `symbol "msg" value 0x100020004 does not fit in 32 bits`) {
+		t.Errorf("ConvertReader: got error %v, expected dynamic symbol too large", err)
+	}
+}
+
+func TestRelaSection(t *testing.T) {
+	f := testELF()
+	// The stored values are ignored, only the addends are used.
+	code := f.Progs[0].Data
+	binary.LittleEndian.PutUint32(code[1:], 0)
+	code[5] = 0xe8 // call msg+4
+	f.Progs[0].Data = append(code, make([]byte, 8)...)
+	f.Sections[0].Size += 8
+	f.Sections[3] = elftest.Section{Name: ".rela.text", Type: elf.SHT_RELA, Info: ".text",
+		Relas: []elf.Rela32{
+			{Off: 0x10001, Info: elftest.RInfo(2, elf.R_386_32), Addend: 0},
+			{Off: 0x10006, Info: elftest.RInfo(2, elf.R_386_PC32), Addend: 0},
+			{Off: 0x10010, Info: uint32(elf.R_386_RELATIVE), Addend: 0x20008},
+		}}
+	p, err := convertTest(t, f, nil)
+	if err != nil {
+		t.Fatal("ConvertReader:", err)
+	}
+	expect := []module.Fixup{
+		{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}},
+		{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 2, Off: 8}},
+		{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 2, Off: 8}},
+	}
+	if f := p.Objects[0].Fixups; !reflect.DeepEqual(f, expect) {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+	image, _, err := p.Relocate()
+	if err != nil {
+		t.Fatal("Relocate:", err)
+	}
+	// The call is relative to the end of the instruction, so with a zero
+	// addend it refers to msg+4.
+	if v := binary.LittleEndian.Uint32(image[6:]); v != 0x20008-0x1000a {
+		t.Errorf("relocated call = 0x%x, expected 0x%x", v, 0x20008-0x1000a)
+	}
+}
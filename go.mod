@@ -1 +1,3 @@
 module moria.us/elf2dos
+
+go 1.21
@@ -0,0 +1,352 @@
+// Package elftest builds small synthetic ELF executables for tests.
+package elftest
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// A Prog is a program header (segment) in a synthetic ELF file.
+type Prog struct {
+	Type  elf.ProgType
+	Flags elf.ProgFlag
+	Vaddr uint32
+	Data  []byte // file contents of the segment
+	Memsz uint32 // size in memory, if larger than the data
+}
+
+// A Section is a section in a synthetic ELF file. Allocated sections take their
+// contents from the segment containing their address.
+type Section struct {
+	Name  string
+	Type  elf.SectionType
+	Flags elf.SectionFlag
+	Addr  uint32
+	Size  uint32
+	Data  []byte      // contents, for sections which are not allocated
+	Info  string      // name of the section that relocations apply to
+	Rels  []elf.Rel32 // contents of an SHT_REL section
+	Relas []elf.Rela32
+	// Relas64 is the contents of an SHT_RELA section in a 64-bit file.
+	Relas64 []elf.Rela64
+	// Dynamic links a relocation section to the dynamic symbol table
+	// instead of the symbol table.
+	Dynamic bool
+}
+
+// A Symbol is an entry in the symbol table of a synthetic ELF file.
+type Symbol struct {
+	Name    string
+	Value   uint32
+	Section string // section name, or empty for an undefined symbol
+	Abs     bool   // symbol is absolute (SHN_ABS)
+}
+
+// A File is a synthetic 32-bit x86 ELF executable, or a 64-bit x86-64 ELF
+// executable if Class64 is set. Addresses are 32-bit in either case.
+type File struct {
+	Entry    uint32
+	Flags    uint32 // e_flags
+	Class64  bool
+	Progs    []Prog
+	Sections []Section
+	Symbols  []Symbol // symbol table, omitted if empty
+	// DynSymbols is the dynamic symbol table, omitted if empty.
+	DynSymbols []Symbol
+}
+
+// RInfo returns the r_info field of a relocation referring to the given 1-based
+// index in Symbols.
+func RInfo(sym int, t elf.R_386) uint32 {
+	return uint32(sym)<<8 | uint32(t)
+}
+
+// RInfo64 returns the r_info field of a 64-bit relocation referring to the
+// given 1-based index in Symbols.
+func RInfo64(sym int, t elf.R_X86_64) uint64 {
+	return uint64(sym)<<32 | uint64(t)
+}
+
+type strtab struct {
+	data []byte
+}
+
+func (t *strtab) add(s string) uint32 {
+	if len(t.data) == 0 {
+		t.data = []byte{0}
+	}
+	if s == "" {
+		return 0
+	}
+	off := uint32(len(t.data))
+	t.data = append(t.data, s...)
+	t.data = append(t.data, 0)
+	return off
+}
+
+func encode(v interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v)
+	return buf.Bytes()
+}
+
+// Bytes returns the contents of the ELF file.
+func (f *File) Bytes() ([]byte, error) {
+	ehsize, phentsize, shentsize, symentsize := 52, 32, 40, 16
+	if f.Class64 {
+		ehsize, phentsize, shentsize, symentsize = 64, 56, 64, 24
+	}
+	var body []byte
+	pos := uint32(ehsize + phentsize*len(f.Progs))
+	place := func(d []byte) uint32 {
+		for pos&3 != 0 {
+			body = append(body, 0)
+			pos++
+		}
+		off := pos
+		body = append(body, d...)
+		pos += uint32(len(d))
+		return off
+	}
+
+	// Segments. Headers are built in their 64-bit form and converted when
+	// writing a 32-bit file.
+	var phdrs []elf.Prog64
+	offsets := make([]uint32, len(f.Progs))
+	for i, p := range f.Progs {
+		off := place(p.Data)
+		offsets[i] = off
+		memsz := p.Memsz
+		if memsz == 0 {
+			memsz = uint32(len(p.Data))
+		}
+		phdrs = append(phdrs, elf.Prog64{
+			Type:   uint32(p.Type),
+			Flags:  uint32(p.Flags),
+			Off:    uint64(off),
+			Vaddr:  uint64(p.Vaddr),
+			Paddr:  uint64(p.Vaddr),
+			Filesz: uint64(len(p.Data)),
+			Memsz:  uint64(memsz),
+			Align:  4,
+		})
+	}
+
+	// Sections, with the symbol table and string tables at the end.
+	secIndex := make(map[string]int)
+	for i, s := range f.Sections {
+		secIndex[s.Name] = i + 1
+	}
+	nsec := len(f.Sections) + 1
+	symtabIndex := 0
+	if len(f.Symbols) != 0 {
+		symtabIndex = nsec
+		nsec += 2
+	}
+	dynsymIndex := 0
+	if len(f.DynSymbols) != 0 {
+		dynsymIndex = nsec
+		nsec += 2
+	}
+	shstrIndex := nsec
+	nsec++
+	var shstr strtab
+	shdrs := make([]elf.Section64, nsec)
+	for i, s := range f.Sections {
+		sh := elf.Section64{
+			Name:      shstr.add(s.Name),
+			Type:      uint32(s.Type),
+			Flags:     uint64(s.Flags),
+			Addr:      uint64(s.Addr),
+			Addralign: 1,
+		}
+		data := s.Data
+		switch {
+		case s.Type == elf.SHT_REL:
+			data = encode(s.Rels)
+			sh.Entsize = 8
+		case s.Type == elf.SHT_RELA && f.Class64:
+			data = encode(s.Relas64)
+			sh.Entsize = 24
+		case s.Type == elf.SHT_RELA:
+			data = encode(s.Relas)
+			sh.Entsize = 12
+		}
+		if s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA {
+			sh.Link = uint32(symtabIndex)
+			if s.Dynamic {
+				sh.Link = uint32(dynsymIndex)
+			}
+			if s.Info != "" {
+				idx, ok := secIndex[s.Info]
+				if !ok {
+					return nil, fmt.Errorf("unknown section %q", s.Info)
+				}
+				sh.Info = uint32(idx)
+			}
+		}
+		if s.Flags&elf.SHF_ALLOC != 0 {
+			sh.Size = uint64(s.Size)
+			for j, p := range f.Progs {
+				if p.Vaddr <= s.Addr && s.Addr < p.Vaddr+uint32(len(p.Data)) {
+					sh.Off = uint64(offsets[j] + s.Addr - p.Vaddr)
+				}
+			}
+		} else {
+			sh.Off = uint64(place(data))
+			sh.Size = uint64(len(data))
+		}
+		shdrs[i+1] = sh
+	}
+	// addSymbols adds a symbol table and its string table at the given
+	// section index.
+	addSymbols := func(index int, symName, strName string, stype elf.SectionType, symbols []Symbol) error {
+		var str strtab
+		syms := []elf.Sym64{{}}
+		for _, s := range symbols {
+			sym := elf.Sym64{
+				Name:  str.add(s.Name),
+				Value: uint64(s.Value),
+				Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE),
+			}
+			switch {
+			case s.Abs:
+				sym.Shndx = uint16(elf.SHN_ABS)
+			case s.Section != "":
+				idx, ok := secIndex[s.Section]
+				if !ok {
+					return fmt.Errorf("unknown section %q", s.Section)
+				}
+				sym.Shndx = uint16(idx)
+			}
+			syms = append(syms, sym)
+		}
+		var symdata []byte
+		if f.Class64 {
+			symdata = encode(syms)
+		} else {
+			syms32 := make([]elf.Sym32, len(syms))
+			for i, s := range syms {
+				syms32[i] = elf.Sym32{Name: s.Name, Value: uint32(s.Value), Info: s.Info, Shndx: s.Shndx}
+			}
+			symdata = encode(syms32)
+		}
+		shdrs[index] = elf.Section64{
+			Name:      shstr.add(symName),
+			Type:      uint32(stype),
+			Off:       uint64(place(symdata)),
+			Size:      uint64(len(symdata)),
+			Link:      uint32(index + 1),
+			Info:      1,
+			Addralign: 4,
+			Entsize:   uint64(symentsize),
+		}
+		str.add("")
+		shdrs[index+1] = elf.Section64{
+			Name:      shstr.add(strName),
+			Type:      uint32(elf.SHT_STRTAB),
+			Off:       uint64(place(str.data)),
+			Size:      uint64(len(str.data)),
+			Addralign: 1,
+		}
+		return nil
+	}
+	if symtabIndex != 0 {
+		if err := addSymbols(symtabIndex, ".symtab", ".strtab", elf.SHT_SYMTAB, f.Symbols); err != nil {
+			return nil, err
+		}
+	}
+	if dynsymIndex != 0 {
+		if err := addSymbols(dynsymIndex, ".dynsym", ".dynstr", elf.SHT_DYNSYM, f.DynSymbols); err != nil {
+			return nil, err
+		}
+	}
+	name := shstr.add(".shstrtab")
+	shdrs[shstrIndex] = elf.Section64{
+		Name:      name,
+		Type:      uint32(elf.SHT_STRTAB),
+		Off:       uint64(place(shstr.data)),
+		Size:      uint64(len(shstr.data)),
+		Addralign: 1,
+	}
+	shoff := place(nil)
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	phoff := uint32(ehsize)
+	if len(f.Progs) == 0 {
+		phoff = 0
+	}
+	var out []byte
+	if f.Class64 {
+		ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+		out = encode(&elf.Header64{
+			Ident:     ident,
+			Type:      uint16(elf.ET_EXEC),
+			Machine:   uint16(elf.EM_X86_64),
+			Version:   uint32(elf.EV_CURRENT),
+			Entry:     uint64(f.Entry),
+			Phoff:     uint64(phoff),
+			Shoff:     uint64(shoff),
+			Flags:     f.Flags,
+			Ehsize:    uint16(ehsize),
+			Phentsize: uint16(phentsize),
+			Phnum:     uint16(len(f.Progs)),
+			Shentsize: uint16(shentsize),
+			Shnum:     uint16(nsec),
+			Shstrndx:  uint16(shstrIndex),
+		})
+		out = append(out, encode(phdrs)...)
+		out = append(out, body...)
+		return append(out, encode(shdrs)...), nil
+	}
+	out = encode(&elf.Header32{
+		Ident:     ident,
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_386),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     f.Entry,
+		Phoff:     phoff,
+		Shoff:     shoff,
+		Flags:     f.Flags,
+		Ehsize:    uint16(ehsize),
+		Phentsize: uint16(phentsize),
+		Phnum:     uint16(len(f.Progs)),
+		Shentsize: uint16(shentsize),
+		Shnum:     uint16(nsec),
+		Shstrndx:  uint16(shstrIndex),
+	})
+	for _, p := range phdrs {
+		out = append(out, encode(&elf.Prog32{
+			Type:   p.Type,
+			Flags:  p.Flags,
+			Off:    uint32(p.Off),
+			Vaddr:  uint32(p.Vaddr),
+			Paddr:  uint32(p.Paddr),
+			Filesz: uint32(p.Filesz),
+			Memsz:  uint32(p.Memsz),
+			Align:  uint32(p.Align),
+		})...)
+	}
+	out = append(out, body...)
+	for _, sh := range shdrs {
+		out = append(out, encode(&elf.Section32{
+			Name:      sh.Name,
+			Type:      sh.Type,
+			Flags:     uint32(sh.Flags),
+			Addr:      uint32(sh.Addr),
+			Off:       uint32(sh.Off),
+			Size:      uint32(sh.Size),
+			Link:      sh.Link,
+			Info:      sh.Info,
+			Addralign: uint32(sh.Addralign),
+			Entsize:   uint32(sh.Entsize),
+		})...)
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+// Package faulttest provides readers which inject I/O errors, for testing error
+// handling.
+package faulttest
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrInjected is the error returned by reads which are made to fail.
+var ErrInjected = errors.New("injected I/O error")
+
+// A ReaderAt wraps another ReaderAt and makes some reads fail with
+// ErrInjected. Reads which do not fail are passed through.
+type ReaderAt struct {
+	r     io.ReaderAt
+	limit int64   // total bytes which may be read, or -1 for no limit
+	at    []int64 // offsets which may not be read
+	count int64   // total bytes read so far
+}
+
+// After returns a ReaderAt which fails once a total of n bytes have been read.
+// The read which would exceed the limit returns the bytes up to the limit and
+// ErrInjected, and every read after it fails.
+func After(r io.ReaderAt, n int64) *ReaderAt {
+	return &ReaderAt{r: r, limit: n}
+}
+
+// At returns a ReaderAt which fails any read which includes one of the given
+// offsets.
+func At(r io.ReaderAt, offsets ...int64) *ReaderAt {
+	return &ReaderAt{r: r, limit: -1, at: offsets}
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for _, x := range f.at {
+		if off <= x && x < off+int64(len(p)) {
+			return 0, ErrInjected
+		}
+	}
+	if f.limit >= 0 {
+		if remain := f.limit - f.count; int64(len(p)) > remain {
+			var n int
+			if remain > 0 {
+				n, _ = f.r.ReadAt(p[:remain], off)
+				f.count += int64(n)
+			}
+			return n, ErrInjected
+		}
+	}
+	n, err := f.r.ReadAt(p, off)
+	f.count += int64(n)
+	return n, err
+}
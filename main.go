@@ -2,64 +2,880 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	goelf "debug/elf"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"moria.us/elf2dos/elf"
+	"moria.us/elf2dos/internal/elftest"
 	"moria.us/elf2dos/module"
 )
 
-func cmdObjDump(input string) error {
-	p, err := module.Open(input)
+func cmdObjDump(input string, ropts *module.ReadOptions, dopts *module.DumpOptions, table bool, format string) error {
+	p, err := openModule(input, ropts)
 	if err != nil {
 		return err
 	}
 	w := bufio.NewWriter(os.Stdout)
-	p.DumpText(w, "")
+	if table {
+		p.DumpTable(w, "")
+	} else if format == "json" {
+		if err := p.DumpJSON(w); err != nil {
+			return err
+		}
+	} else {
+		p.DumpTextWith(w, "", dopts)
+	}
 	if err := w.Flush(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func cmdConvert(input, output string) error {
-	prog, err := elf.ConvertToLELX(input)
+// readSymbolMap reads a symbol map written by -emit-sym, with one symbol per
+// line as "obj:offset name".
+func readSymbolMap(name string) ([]module.Symbol, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var syms []module.Symbol
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		ref, sym, _ := strings.Cut(line, " ")
+		r, ok := parseRef(ref)
+		if !ok || sym == "" {
+			return nil, fmt.Errorf("%s:%d: invalid symbol %q", name, i+1, line)
+		}
+		syms = append(syms, module.Symbol{Name: sym, Ref: r})
+	}
+	return syms, nil
+}
+
+// cmdInfo prints an interpretation of an existing module's header.
+func cmdInfo(w io.Writer, input string) error {
+	p, err := openModule(input, nil)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	p.DumpInfo(bw, "")
+	return bw.Flush()
+}
+
+// cmdValidate checks an existing module and prints every problem found, both
+// those recovered from while reading and those found by validating the
+// structure.
+func cmdValidate(w io.Writer, input string) error {
+	p, err := openModule(input, &module.ReadOptions{
+		Lenient:         true,
+		VerifyChecksums: true,
+	})
+	if err != nil {
+		return err
+	}
+	errs := append(p.ReadErrors, p.Validate()...)
+	bw := bufio.NewWriter(w)
+	for _, err := range errs {
+		fmt.Fprintf(bw, "%s: %v\n", input, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s: found %d problems", input, len(errs))
+	}
+	return nil
+}
+
+// cmdPageChecksums checks the per-page checksums of an existing module and
+// prints each page which does not match its checksum.
+func cmdPageChecksums(w io.Writer, input string) error {
+	p, err := openModule(input, &module.ReadOptions{
+		Lenient:         true,
+		VerifyChecksums: true,
+	})
+	if err != nil {
+		return err
+	}
+	if p.PerPageChecksumOffset == 0 {
+		return fmt.Errorf("%s: module has no per-page checksums", input)
+	}
+	bw := bufio.NewWriter(w)
+	var n int
+	for _, err := range p.ReadErrors {
+		var perr *module.PageChecksumError
+		if !errors.As(err, &perr) {
+			continue
+		}
+		n++
+		fmt.Fprintf(bw, "object %d page %d: checksum 0x%08x, expected 0x%08x\n",
+			perr.Object, perr.Page, perr.Computed, perr.Stored)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if n != 0 {
+		return fmt.Errorf("%s: %d pages do not match their checksums", input, n)
+	}
+	return nil
+}
+
+// stdio is the file name for standard input or standard output.
+const stdio = "-"
+
+// readStdin reads all of standard input, for commands which need to seek in
+// their input.
+func readStdin() (*bytes.Reader, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("could not read standard input: %v", err)
+	}
+	return bytes.NewReader(data), nil
+}
+
+// openModule reads an LE/LX module from the named file, or from standard
+// input if the name is "-".
+func openModule(name string, opts *module.ReadOptions) (*module.Program, error) {
+	if name != stdio {
+		return module.OpenWith(name, opts)
+	}
+	r, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	return module.OpenReaderAtWith(r, r.Size(), opts)
+}
+
+// convertELF converts the named ELF file, or standard input if the name is
+// "-".
+func convertELF(name string, opts *elf.ConvertOptions) (*elf.ConvertResult, error) {
+	if name != stdio {
+		return elf.ConvertWithSymbols(name, opts)
+	}
+	r, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	return elf.ConvertReaderWithSymbols(r, r.Size(), opts)
+}
+
+// writeClose calls write to write to w, then closes w. The writer is closed
+// exactly once, even if write fails, and the first error is returned.
+func writeClose(w io.WriteCloser, write func(w io.Writer) error) error {
+	err := write(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFile creates the named file and calls write to write its contents.
+func writeFile(name string, write func(w io.Writer) error) error {
+	if name == stdio {
+		return write(os.Stdout)
+	}
+	fp, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	return writeClose(fp, write)
+}
+
+// cmdConvert converts an ELF executable and writes the module. If verify is
+// true, the module is read back and compared with the converted program.
+func cmdConvert(input, output string, copts *elf.ConvertOptions, wopts *module.WriteOptions,
+	verify bool) error {
+	res, err := convertELF(input, copts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	prog := res.Program
+	if err := prog.Check(); err != nil {
+		return fmt.Errorf("%s: invalid conversion: %v", input, err)
+	}
+	if err := writeFile(output, func(w io.Writer) error {
+		return prog.WriteWith(w, wopts)
+	}); err != nil {
+		return err
+	}
+	if !verify {
+		return nil
+	}
+	written, err := module.Open(output)
+	if err != nil {
+		return fmt.Errorf("%s: verify: %v", output, err)
+	}
+	if err := prog.CompareLayout(written); err != nil {
+		return fmt.Errorf("%s: verify: %v", output, err)
+	}
+	return nil
+}
+
+func cmdNormalize(input, output string, wopts *module.WriteOptions) error {
+	prog, err := openModule(input, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	prog.Canonicalize()
+	return writeFile(output, func(w io.Writer) error {
+		return prog.WriteWith(w, wopts)
+	})
+}
+
+// cmdRelocateDump converts an ELF executable and writes its memory image, with
+// all fixups applied, to the output. The relocation information is discarded.
+func cmdRelocateDump(input, output string, copts *elf.ConvertOptions) error {
+	res, err := convertELF(input, copts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	image, base, err := res.Program.Relocate()
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	if copts.Log != nil {
+		fmt.Fprintf(copts.Log, "image base address: 0x%08x\n", base)
+	}
+	return writeFile(output, func(w io.Writer) error {
+		_, err := w.Write(image)
+		return err
+	})
+}
+
+// writeLinkerScript writes a linker script fragment which places each object
+// at its base address, so the ELF file can be linked again with the same
+// layout. Each object becomes an output section named after its index, which
+// collects the input sections with the names of the ELF sections in it, such
+// as .text and .text.* for the .text section.
+func writeLinkerScript(w io.Writer, res *elf.ConvertResult) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "SECTIONS")
+	fmt.Fprintln(bw, "{")
+	for i, obj := range res.Program.Objects {
+		var inputs string
+		for _, s := range res.Sections {
+			if s.Ref.Obj != int32(i+1) {
+				continue
+			}
+			inputs += fmt.Sprintf(" *(%s %s.*)", s.Name, s.Name)
+			if s.Name == ".bss" {
+				// Common symbols are allocated in .bss.
+				inputs += " *(COMMON)"
+			}
+		}
+		fmt.Fprintf(bw, "  .object%d 0x%08x : {%s } /* size 0x%x, %s */\n",
+			i+1, obj.BaseAddress, inputs, obj.VirtualSize, obj.Flags)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func cmdLinkerScript(w io.Writer, input string, copts *elf.ConvertOptions) error {
+	res, err := convertELF(input, copts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	return writeLinkerScript(w, res)
+}
+
+// A fixupKey identifies a fixup by its source and target.
+type fixupKey struct {
+	srcObj  int
+	srcOff  uint32
+	srcType module.SrcType
+	target  module.Ref
+	add     int32
+}
+
+func (k fixupKey) String() string {
+	s := fmt.Sprintf("%d:0x%x type 0x%02x -> %v", k.srcObj, k.srcOff, uint8(k.srcType), k.target)
+	if k.add != 0 {
+		s += fmt.Sprintf(" +0x%x", k.add)
+	}
+	return s
+}
+
+func (k fixupKey) less(y fixupKey) bool {
+	switch {
+	case k.srcObj != y.srcObj:
+		return k.srcObj < y.srcObj
+	case k.srcOff != y.srcOff:
+		return k.srcOff < y.srcOff
+	case k.srcType != y.srcType:
+		return k.srcType < y.srcType
+	case k.target.Obj != y.target.Obj:
+		return k.target.Obj < y.target.Obj
+	case k.target.Off != y.target.Off:
+		return k.target.Off < y.target.Off
+	default:
+		return k.add < y.add
+	}
+}
+
+// fixupSet returns the set of fixups in a program.
+func fixupSet(p *module.Program) map[fixupKey]bool {
+	set := make(map[fixupKey]bool)
+	p.RangeFixups(func(srcObj int, srcOff uint32, f module.Fixup) bool {
+		set[fixupKey{srcObj, srcOff, f.SrcType, f.Target, f.Add}] = true
+		return true
+	})
+	return set
+}
+
+// diffFixups returns the fixups which are only in a (removed) and only in b
+// (added), in sorted order.
+func diffFixups(a, b *module.Program) (removed, added []fixupKey) {
+	sa, sb := fixupSet(a), fixupSet(b)
+	for k := range sa {
+		if !sb[k] {
+			removed = append(removed, k)
+		}
+	}
+	for k := range sb {
+		if !sa[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].less(removed[j]) })
+	sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+	return removed, added
+}
+
+func cmdDiffFixups(w io.Writer, input1, input2 string) error {
+	a, err := openModule(input1, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input1, err)
+	}
+	b, err := openModule(input2, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input2, err)
+	}
+	removed, added := diffFixups(a, b)
+	bw := bufio.NewWriter(w)
+	for _, k := range removed {
+		fmt.Fprintln(bw, "-", k)
+	}
+	for _, k := range added {
+		fmt.Fprintln(bw, "+", k)
+	}
+	return bw.Flush()
+}
+
+// A histBucket is a range of fixup counts in a histogram, and the number of
+// pages with that many fixups.
+type histBucket struct {
+	min, max int
+	pages    int
+}
+
+func (b histBucket) String() string {
+	if b.min == b.max {
+		return strconv.Itoa(b.min)
+	}
+	return fmt.Sprintf("%d-%d", b.min, b.max)
+}
+
+// fixupHistogram counts the pages in a program by the number of fixups on each
+// page. The buckets are 0, 1, 2-3, 4-7, and so on, up to the bucket containing
+// the page with the most fixups.
+func fixupHistogram(p *module.Program) []histBucket {
+	hist := []histBucket{{0, 0, 0}}
+	for _, obj := range p.Objects {
+		for _, pg := range obj.Pages {
+			n := len(pg.Fixups)
+			i := 0
+			for v := n; v != 0; v >>= 1 {
+				i++
+			}
+			for len(hist) <= i {
+				min := 1 << uint(len(hist)-1)
+				hist = append(hist, histBucket{min, 2*min - 1, 0})
+			}
+			hist[i].pages++
+		}
+	}
+	return hist
+}
+
+func cmdFixupHistogram(w io.Writer, input string) error {
+	p, err := openModule(input, nil)
 	if err != nil {
 		return fmt.Errorf("%s: %v", input, err)
 	}
-	fp, err := os.Create(output)
+	hist := fixupHistogram(p)
+	var max int
+	for _, b := range hist {
+		if b.pages > max {
+			max = b.pages
+		}
+	}
+	const width = 50
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-9s  %5s\n", "Fixups", "Pages")
+	for _, b := range hist {
+		bar := b.pages
+		if max > width {
+			bar = (b.pages*width + max - 1) / max
+		}
+		line := fmt.Sprintf("%-9s  %5d  %s", b, b.pages, strings.Repeat("#", bar))
+		fmt.Fprintln(bw, strings.TrimRight(line, " "))
+	}
+	return bw.Flush()
+}
+
+// segmentBases is a flag value mapping ELF segment indexes to base addresses,
+// given as index=address.
+type segmentBases map[int]uint32
+
+func (b segmentBases) String() string {
+	var s []string
+	for idx, addr := range b {
+		s = append(s, fmt.Sprintf("%d=0x%x", idx, addr))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (b segmentBases) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i == -1 {
+		return errors.New("expected segment=address")
+	}
+	idx, err := strconv.ParseUint(v[:i], 10, 31)
+	if err != nil {
+		return err
+	}
+	addr, err := strconv.ParseUint(v[i+1:], 0, 32)
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	if err := prog.Write(fp); err != nil {
+	b[int(idx)] = uint32(addr)
+	return nil
+}
+
+// parseSize parses a size in bytes, with an optional suffix "k" or "M" for
+// KiB or MiB, such as "64k".
+func parseSize(s string) (uint32, error) {
+	var shift uint
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		shift = 20
+	}
+	num := s
+	if shift != 0 {
+		num = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(num, 0, 32)
+	if err != nil || v<<shift > 1<<32-1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint32(v << shift), nil
+}
+
+// parseCPU parses the -cpu flag, a minimum CPU type of "386" or "486".
+func parseCPU(s string) (uint16, error) {
+	switch s {
+	case "386":
+		return module.CPU80386, nil
+	case "486":
+		return module.CPU80486, nil
+	}
+	return 0, fmt.Errorf("invalid -cpu %q, expected 386 or 486", s)
+}
+
+// parseRef parses a reference in obj:offset form, such as "2:0x800". Returns
+// false if the string is not in that form, such as a symbol name.
+func parseRef(s string) (module.Ref, bool) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return module.Ref{}, false
+	}
+	obj, err := strconv.ParseUint(s[:i], 10, 31)
+	if err != nil || obj == 0 {
+		return module.Ref{}, false
+	}
+	off, err := strconv.ParseUint(s[i+1:], 0, 31)
+	if err != nil {
+		return module.Ref{}, false
+	}
+	return module.Ref{Obj: int32(obj), Off: int32(off)}, true
+}
+
+// selfTestELF returns a small ELF executable with a code segment containing a
+// reference to a data segment.
+func selfTestELF() ([]byte, error) {
+	code := []byte{
+		0xb8, 0x04, 0x00, 0x02, 0x00, // mov eax, 0x20004
+		0xc3, // ret
+	}
+	f := &elftest.File{
+		Entry: 0x10000,
+		Progs: []elftest.Prog{
+			{Type: goelf.PT_LOAD, Flags: goelf.PF_R | goelf.PF_X, Vaddr: 0x10000, Data: code},
+			{Type: goelf.PT_LOAD, Flags: goelf.PF_R | goelf.PF_W, Vaddr: 0x20000,
+				Data: []byte("....Hello!\n\x00"), Memsz: 0x1000},
+		},
+		Sections: []elftest.Section{
+			{Name: ".text", Type: goelf.SHT_PROGBITS, Flags: goelf.SHF_ALLOC | goelf.SHF_EXECINSTR,
+				Addr: 0x10000, Size: uint32(len(code))},
+			{Name: ".data", Type: goelf.SHT_PROGBITS, Flags: goelf.SHF_ALLOC | goelf.SHF_WRITE,
+				Addr: 0x20000, Size: 0x1000},
+			{Name: ".rel.text", Type: goelf.SHT_REL, Info: ".text", Rels: []goelf.Rel32{
+				{Off: 0x10001, Info: elftest.RInfo(2, goelf.R_386_32)},
+			}},
+		},
+		Symbols: []elftest.Symbol{
+			{Name: "_start", Value: 0x10000, Section: ".text"},
+			{Name: "msg", Value: 0x20004, Section: ".data"},
+			{Name: "_stack_end", Value: 0x21000, Section: ".data"},
+		},
+	}
+	return f.Bytes()
+}
+
+// selfTest converts a synthetic ELF executable, writes it, reads it back, and
+// checks that it is relocated correctly when its data object is moved.
+func selfTest() error {
+	data, err := selfTestELF()
+	if err != nil {
+		return fmt.Errorf("build ELF: %v", err)
+	}
+	p, err := elf.ConvertReader(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return fmt.Errorf("convert: %v", err)
+	}
+	fp, err := os.CreateTemp("", "selftest*.le")
+	if err != nil {
 		return err
 	}
-	return fp.Close() // Double-close is OK
+	name := fp.Name()
+	defer os.Remove(name)
+	if err := writeClose(fp, p.Write); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	r, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true})
+	if err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	if len(r.Objects) != 2 {
+		return fmt.Errorf("read: got %d objects, expected 2", len(r.Objects))
+	}
+	if r.EIP != (module.Ref{Obj: 1, Off: 0}) {
+		return fmt.Errorf("read: EIP is %v, expected 1:0x0", r.EIP)
+	}
+	r.Objects[1].BaseAddress = 0x40000
+	image, base, err := r.Relocate()
+	if err != nil {
+		return fmt.Errorf("relocate: %v", err)
+	}
+	expect := []byte{0xb8, 0x04, 0x00, 0x04, 0x00} // mov eax, 0x40004
+	if base != 0x10000 || !bytes.HasPrefix(image, expect) {
+		return fmt.Errorf("relocate: got % x at 0x%x, expected % x at 0x10000",
+			image[:len(expect)], base, expect)
+	}
+	return nil
+}
+
+// cmdSelfTest runs the self test and prints OK if it succeeds.
+func cmdSelfTest(w io.Writer) error {
+	if err := selfTest(); err != nil {
+		return fmt.Errorf("self test failed: %v", err)
+	}
+	_, err := fmt.Fprintln(w, "OK")
+	return err
 }
 
 func mainE() error {
-	var output string
-	var objdump bool
-	flag.StringVar(&output, "output", "", "Output file")
+	var output, wx, cpu, onlyRelocs, skipRelocs, entry, stack, entrySym, emitSym, emitSymPages, symbolFile, heap, stub, format, stackSize, pageSize string
+	var objdump, normal, strict, verbose, relocDump, library, crc, hexdump, lenient, checksums bool
+	var preload, explain, dos4gw, roundSizes, mergeSegs, diff, histogram, ldscript, contiguous, table, verifyRelocs, validate, buildID bool
+	var preferStart, pageChecksums, sourceLists, info, sectionSums, selftest, verify, coverage, writeMap, compress, allow64 bool
+	var maxObjectSize uint
+	bases := make(segmentBases)
+	flag.StringVar(&output, "output", "", "Output file, or - for standard output")
 	flag.BoolVar(&objdump, "objdump", false, "Dump input file")
+	flag.StringVar(&format, "format", "text", "Format for -objdump: text or json")
+	flag.BoolVar(&selftest, "selftest", false, "Convert, write, read, and relocate a built-in sample program")
+	flag.BoolVar(&info, "info", false, "Print an interpretation of the input file's header")
+	flag.BoolVar(&table, "table", false, "Dump the input file's objects as a table")
+	flag.BoolVar(&crc, "crc", false, "Include a CRC-32 of each object's data in the dump")
+	flag.BoolVar(&hexdump, "hexdump", false, "Include a hex listing of each object's data in the dump")
+	flag.StringVar(&symbolFile, "symbols", "",
+		"Annotate the dump with symbols from `file`, written by -emit-sym")
+	flag.BoolVar(&lenient, "lenient", false, "Continue reading past recoverable errors in the input module")
+	flag.BoolVar(&checksums, "verify-checksums", false, "Verify the checksums in the input module")
+	flag.BoolVar(&pageChecksums, "page-checksums", false,
+		"Report each page of the input module which does not match its checksum")
+	flag.BoolVar(&validate, "validate-only", false, "Check the input module and report all problems found")
+	flag.BoolVar(&histogram, "page-fixup-histogram", false,
+		"Print a histogram of the number of fixups on each page of the input module")
+	flag.BoolVar(&diff, "diff-fixups", false, "Print fixups which differ between two input modules")
+	flag.BoolVar(&ldscript, "ldscript", false,
+		"Print a linker script fragment placing each converted object at its address")
+	flag.BoolVar(&normal, "normalize", false, "Rewrite input module in canonical form")
+	flag.BoolVar(&relocDump, "relocate-dump", false,
+		"Write a flat memory image with all fixups applied, discarding relocation info")
+	flag.BoolVar(&sourceLists, "source-lists", false,
+		"Write fixups which share a target as source lists, which some loaders do not support")
+	flag.BoolVar(&compress, "compress", false,
+		"Write an LX module, storing pages with repeated bytes as iterated pages")
+	flag.StringVar(&pageSize, "page-size", "4k",
+		"Page `size` of the output module, such as 16k; sizes other than 4k write an LX module")
+	flag.BoolVar(&preload, "preload-all", false, "Mark all objects as preloaded")
+	flag.BoolVar(&sectionSums, "section-checksums", false,
+		"Write the loader and fixup section checksums, which are not verified against any loader")
+	flag.BoolVar(&strict, "strict", false, "Write all fields required for full LE conformance")
+	flag.BoolVar(&buildID, "build-id-version", false, "Set the module version from the ELF build ID")
+	flag.BoolVar(&library, "lib", false, "Mark the module as a library, which may have no entry point")
+	flag.BoolVar(&roundSizes, "round-sizes", false, "Round object sizes up to whole pages")
+	flag.BoolVar(&contiguous, "contiguous", false, "Lay out objects contiguously, each aligned to a page")
+	flag.BoolVar(&mergeSegs, "merge-segments", false,
+		"Merge segments which are adjacent in memory into one object, if they are not writable and executable")
+	flag.Var(bases, "segment-base", "Set base address of an ELF segment's object, as `index=address`")
+	flag.StringVar(&wx, "wx", "warn",
+		"What to do with writable and executable segments: warn, error, drop-w, drop-x, or split")
+	flag.StringVar(&entry, "entry", "", "Entry point, as a symbol name or address, instead of the ELF entry")
+	flag.StringVar(&entrySym, "entry-symbol", "",
+		"Entry point, as the name of a symbol which is not absolute, instead of the ELF entry")
+	flag.BoolVar(&preferStart, "prefer-start", false, "Use the _start symbol as the entry point instead of the ELF entry")
+	flag.StringVar(&stack, "stack", "", "Initial stack pointer, as a symbol name, address, or obj:offset, instead of _stack_end")
+	flag.StringVar(&stackSize, "stack-size", "0",
+		"Add a stack object of this `size` above all other objects, such as 64k, instead of using -stack")
+	flag.StringVar(&heap, "heap", "0", "Heap `size` for the loader to allocate, such as 64k or 1M")
+	flag.StringVar(&cpu, "cpu", "386", "Minimum CPU type: 386 or 486")
+	flag.StringVar(&onlyRelocs, "only-relocs", "",
+		"Process only the relocation sections in this comma-separated `list`, for debugging")
+	flag.StringVar(&skipRelocs, "skip-relocs", "",
+		"Ignore the relocation sections in this comma-separated `list`, for debugging")
+	flag.BoolVar(&allow64, "allow-64", false,
+		"Accept x86-64 ELF files whose addresses all fit in 32 bits")
+	flag.BoolVar(&verifyRelocs, "verify-relocs", false,
+		"Check that every ELF relocation produced a fixup or was skipped for a known reason")
+	flag.BoolVar(&writeMap, "write-map", false, "Print the file offset and size of each part of the output module")
+	flag.StringVar(&stub, "stub", "", "Write the DOS MZ executable in `file` before the LE header")
+	flag.BoolVar(&dos4gw, "dos4gw", false, "Patch the -stub so the output is a bound DOS/4GW executable")
+	flag.StringVar(&emitSym, "emit-sym", "", "Write the resolved symbols to `file`, as obj:offset name")
+	flag.StringVar(&emitSymPages, "emit-sym-pages", "",
+		"Write the page containing each resolved symbol to `file`, for choosing pages to preload")
+	flag.BoolVar(&coverage, "reloc-coverage", false,
+		"Print how many bytes of each ELF section are modified by fixups")
+	flag.BoolVar(&verify, "verify", false, "Read the output back and check that it matches the converted program")
+	flag.BoolVar(&verbose, "v", false, "Print details about the conversion")
+	flag.BoolVar(&explain, "explain", false,
+		"Print each step of the conversion: segments, symbols, and what became of each relocation")
+	flag.BoolVar(&explain, "e", false, "Short for -explain")
+	flag.UintVar(&maxObjectSize, "max-object-size", 0, "Maximum object size in bytes, or 0 for no limit")
 	flag.Parse()
 	args := flag.Args()
-	if objdump {
+	if selftest {
+		if len(args) != 0 {
+			return fmt.Errorf("got %d arguments, expected 0", len(args))
+		}
+		return cmdSelfTest(os.Stdout)
+	}
+	if objdump || table {
 		if len(args) != 1 {
 			return fmt.Errorf("got %d arguments, expected 1", len(args))
 		}
-		return cmdObjDump(args[0])
+		if format != "text" && format != "json" {
+			return fmt.Errorf("invalid -format %q", format)
+		}
+		if table && format != "text" {
+			return errors.New("cannot use -format json with -table")
+		}
+		ropts := module.ReadOptions{
+			Lenient:         lenient,
+			VerifyChecksums: checksums,
+		}
+		dopts := module.DumpOptions{CRC: crc, Hex: hexdump}
+		if symbolFile != "" {
+			syms, err := readSymbolMap(symbolFile)
+			if err != nil {
+				return err
+			}
+			dopts.Symbols = syms
+		}
+		return cmdObjDump(args[0], &ropts, &dopts, table, format)
+	}
+	if info {
+		if len(args) != 1 {
+			return fmt.Errorf("got %d arguments, expected 1", len(args))
+		}
+		return cmdInfo(os.Stdout, args[0])
+	}
+	if validate {
+		if len(args) != 1 {
+			return fmt.Errorf("got %d arguments, expected 1", len(args))
+		}
+		return cmdValidate(os.Stdout, args[0])
+	}
+	if pageChecksums {
+		if len(args) != 1 {
+			return fmt.Errorf("got %d arguments, expected 1", len(args))
+		}
+		return cmdPageChecksums(os.Stdout, args[0])
+	}
+	if histogram {
+		if len(args) != 1 {
+			return fmt.Errorf("got %d arguments, expected 1", len(args))
+		}
+		return cmdFixupHistogram(os.Stdout, args[0])
+	}
+	if diff {
+		if len(args) != 2 {
+			return fmt.Errorf("got %d arguments, expected 2", len(args))
+		}
+		return cmdDiffFixups(os.Stdout, args[0], args[1])
 	}
 	if len(args) != 1 {
 		return fmt.Errorf("got %d arguments, expected 1", len(args))
 	}
-	if output == "" {
+	if output == "" && !ldscript {
 		return errors.New("flag -output is required")
 	}
-	return cmdConvert(args[0], output)
+	if output == stdio && verify {
+		return errors.New("cannot use -verify when writing to standard output")
+	}
+	if output == stdio && writeMap {
+		return errors.New("cannot use -write-map when writing to standard output")
+	}
+	if output == stdio && coverage {
+		return errors.New("cannot use -reloc-coverage when writing to standard output")
+	}
+	wopts := module.WriteOptions{
+		Strict:           strict,
+		PreloadAll:       preload,
+		SourceLists:      sourceLists,
+		SectionChecksums: sectionSums,
+		LX:               compress,
+		Compress:         compress,
+		DOS4GW:           dos4gw,
+	}
+	if strict && output != stdio {
+		name := filepath.Base(output)
+		wopts.ModuleName = strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+	if writeMap {
+		wopts.Map = os.Stdout
+	}
+	size, err := parseSize(pageSize)
+	if err != nil {
+		return fmt.Errorf("invalid -page-size %q", pageSize)
+	}
+	wopts.PageSize = size
+	if size != module.PageSize {
+		wopts.LX = true
+	}
+	if stub != "" {
+		data, err := os.ReadFile(stub)
+		if err != nil {
+			return err
+		}
+		wopts.Stub = data
+	}
+	if normal {
+		return cmdNormalize(args[0], output, &wopts)
+	}
+	if maxObjectSize > 1<<32-1 {
+		return fmt.Errorf("invalid -max-object-size %d", maxObjectSize)
+	}
+	wxPolicy, err := elf.ParseWXPolicy(wx)
+	if err != nil {
+		return err
+	}
+	cpuType, err := parseCPU(cpu)
+	if err != nil {
+		return err
+	}
+	heapSize, err := parseSize(heap)
+	if err != nil {
+		return fmt.Errorf("invalid -heap %q", heap)
+	}
+	stackBytes, err := parseSize(stackSize)
+	if err != nil {
+		return fmt.Errorf("invalid -stack-size %q", stackSize)
+	}
+	copts := elf.ConvertOptions{
+		CPUType:           cpuType,
+		HeapSize:          heapSize,
+		Entry:             entry,
+		EntrySymbol:       entrySym,
+		PreferStart:       preferStart,
+		Stack:             stack,
+		StackSize:         stackBytes,
+		MaxObjectSize:     uint32(maxObjectSize),
+		Library:           library,
+		RoundSizes:        roundSizes,
+		Contiguous:        contiguous,
+		MergeSegments:     mergeSegs,
+		BuildIDVersion:    buildID,
+		VerifyRelocations: verifyRelocs,
+		ReportOrphans:     strict,
+		Allow64:           allow64,
+		SegmentBases:      bases,
+		WX:                wxPolicy,
+		Warnings:          os.Stderr,
+	}
+	if r, ok := parseRef(stack); ok {
+		copts.Stack = ""
+		copts.StackRef = r
+	}
+	if onlyRelocs != "" {
+		copts.OnlyRelocSections = strings.Split(onlyRelocs, ",")
+	}
+	if skipRelocs != "" {
+		copts.SkipRelocSections = strings.Split(skipRelocs, ",")
+	}
+	if verbose {
+		copts.Log = os.Stderr
+	}
+	if explain {
+		copts.Explain = os.Stderr
+	}
+	var symbols, symbolPages bytes.Buffer
+	if emitSym != "" {
+		copts.SymbolMap = &symbols
+	}
+	if emitSymPages != "" {
+		copts.SymbolPages = &symbolPages
+		copts.PageSize = wopts.PageSize
+	}
+	if coverage {
+		copts.RelocCoverage = os.Stdout
+	}
+	switch {
+	case ldscript:
+		err = cmdLinkerScript(os.Stdout, args[0], &copts)
+	case relocDump:
+		err = cmdRelocateDump(args[0], output, &copts)
+	default:
+		err = cmdConvert(args[0], output, &copts, &wopts, verify)
+	}
+	if err != nil {
+		return err
+	}
+	if emitSym != "" {
+		if err := os.WriteFile(emitSym, symbols.Bytes(), 0666); err != nil {
+			return err
+		}
+	}
+	if emitSymPages != "" {
+		return os.WriteFile(emitSymPages, symbolPages.Bytes(), 0666)
+	}
+	return nil
 }
 
 func main() {
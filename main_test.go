@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	elf2dos "moria.us/elf2dos/elf"
+	"moria.us/elf2dos/internal/elftest"
+	"moria.us/elf2dos/module"
+)
+
+// testProgram returns a small program with code and data objects.
+func testProgram() *module.Program {
+	return &module.Program{
+		ProgramHeader: module.ProgramHeader{
+			EIP: module.Ref{Obj: 1, Off: 0},
+			ESP: module.Ref{Obj: 2, Off: 0x1000},
+		},
+		Objects: []*module.Object{
+			{
+				ObjectHeader: module.ObjectHeader{
+					VirtualSize: 0x100,
+					BaseAddress: 0x10000,
+					Flags:       module.ObjR | module.ObjX | module.Obj32Bit,
+				},
+				Data: []byte{0xb8, 0, 0, 0, 0, 0xe8, 0, 0, 0, 0, 0xc3},
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 0x10}},
+					{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 2, Off: 0x20}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{
+					VirtualSize: 0x1000,
+					BaseAddress: 0x20000,
+					Flags:       module.ObjR | module.ObjW | module.Obj32Bit,
+				},
+				Data: []byte("data"),
+			},
+		},
+	}
+}
+
+// writeTemp writes a program to a temporary file and returns its name.
+func writeTemp(t *testing.T, p *module.Program, name string) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	fp, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := p.Write(fp); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// writeTestELF writes a small ELF executable, with code and BSS segments, to a
+// temporary file and returns its name.
+func writeTestELF(t *testing.T) string {
+	t.Helper()
+	f := elftest.File{
+		Entry: 0x10000,
+		Progs: []elftest.Prog{
+			{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Vaddr: 0x10000,
+				Data: []byte{0xb8, 0x00, 0x00, 0x02, 0x00, 0xc3}}, // mov eax, 0x20000; ret
+			{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Vaddr: 0x20000, Memsz: 0x1000},
+		},
+		Sections: []elftest.Section{
+			{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+				Addr: 0x10000, Size: 6},
+			{Name: ".bss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+				Addr: 0x20000, Size: 0x1000},
+			{Name: ".rel.text", Type: elf.SHT_REL, Info: ".text", Rels: []elf.Rel32{
+				{Off: 0x10001, Info: elftest.RInfo(1, elf.R_386_32)},
+			}},
+		},
+		Symbols: []elftest.Symbol{
+			{Name: "buf", Value: 0x20000, Section: ".bss"},
+			{Name: "_stack_end", Value: 0x21000, Section: ".bss"},
+		},
+	}
+	data, err := f.Bytes()
+	if err != nil {
+		t.Fatal("Bytes:", err)
+	}
+	name := filepath.Join(t.TempDir(), "in.elf")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestConvert(t *testing.T) {
+	input := writeTestELF(t)
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.le")
+	if err := cmdConvert(input, output, &elf2dos.ConvertOptions{}, &module.WriteOptions{}, true); err != nil {
+		t.Fatal(err)
+	}
+	p, err := module.Open(output)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if len(p.Objects) != 2 {
+		t.Fatalf("got %d objects, expected 2", len(p.Objects))
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x1000}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	expect := module.Fixup{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 0}}
+	if f := p.Objects[0].Fixups; len(f) != 1 || f[0] != expect {
+		t.Errorf("fixups = %+v, expected %+v", f, expect)
+	}
+
+	// Output with a stub can be verified.
+	stub := make([]byte, 0x40)
+	copy(stub, "MZ")
+	if err := cmdConvert(input, output, &elf2dos.ConvertOptions{}, &module.WriteOptions{Stub: stub}, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	p1 := testProgram()
+	p2 := testProgram()
+	// Same fixups in a different order, and data with extra zero padding.
+	f := p2.Objects[0].Fixups
+	f[0], f[1] = f[1], f[0]
+	p2.Objects[1].Data = append(p2.Objects[1].Data, make([]byte, 0x80)...)
+	in1 := writeTemp(t, p1, "in1.le")
+	in2 := writeTemp(t, p2, "in2.le")
+	if b1, b2 := readFile(t, in1), readFile(t, in2); bytes.Equal(b1, b2) {
+		t.Fatal("inputs are identical")
+	}
+	out1 := filepath.Join(t.TempDir(), "out1.le")
+	out2 := filepath.Join(t.TempDir(), "out2.le")
+	if err := cmdNormalize(in1, out1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdNormalize(in2, out2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFile(t, out1), readFile(t, out2)) {
+		t.Error("normalized modules differ")
+	}
+}
+
+func TestStdio(t *testing.T) {
+	in := writeTemp(t, testProgram(), "in.le")
+	expectName := filepath.Join(t.TempDir(), "expect.le")
+	if err := cmdNormalize(in, expectName, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Read from standard input and write to standard output.
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+	}()
+	var err error
+	if os.Stdin, err = os.Open(in); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Stdin.Close()
+	outName := filepath.Join(t.TempDir(), "out.le")
+	if os.Stdout, err = os.Create(outName); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Stdout.Close()
+	if err := cmdNormalize("-", "-", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFile(t, outName), readFile(t, expectName)) {
+		t.Error("output written to standard output differs from output written to a file")
+	}
+}
+
+func TestReadSymbolMap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "syms.txt")
+	if err := os.WriteFile(name, []byte("1:0x0 _start\n2:0x1000 _stack_end\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	syms, err := readSymbolMap(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []module.Symbol{
+		{Name: "_start", Ref: module.Ref{Obj: 1, Off: 0}},
+		{Name: "_stack_end", Ref: module.Ref{Obj: 2, Off: 0x1000}},
+	}
+	if len(syms) != len(expect) || syms[0] != expect[0] || syms[1] != expect[1] {
+		t.Errorf("got %+v, expected %+v", syms, expect)
+	}
+	if err := os.WriteFile(name, []byte("1:0x0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSymbolMap(name); err == nil || !strings.Contains(err.Error(), ":1: invalid symbol") {
+		t.Errorf("got error %v, expected invalid symbol on line 1", err)
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDiffFixups(t *testing.T) {
+	p1 := testProgram()
+	p2 := testProgram()
+	p2.Objects[0].Fixups[1].Target.Off = 0x24
+	in1 := writeTemp(t, p1, "in1.le")
+	in2 := writeTemp(t, p2, "in2.le")
+	var buf bytes.Buffer
+	if err := cmdDiffFixups(&buf, in1, in2); err != nil {
+		t.Fatal(err)
+	}
+	const expect = "- 1:0x6 type 0x08 -> 2:0x20\n" +
+		"+ 1:0x6 type 0x08 -> 2:0x24\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
+
+func TestLinkerScript(t *testing.T) {
+	var buf bytes.Buffer
+	if err := cmdLinkerScript(&buf, writeTestELF(t), &elf2dos.ConvertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, line := range []string{
+		".object1 0x00010000 : { *(.text .text.*) } /* size 0x6, r-x 32-bit */",
+		".object2 0x00020000 : { *(.bss .bss.*) *(COMMON) } /* size 0x1000, rw- 32-bit */",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("linker script does not contain %q:\n%s", line, s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := cmdValidate(&buf, writeTemp(t, testProgram(), "good.le")); err != nil {
+		t.Errorf("valid module: %v\n%s", err, buf.String())
+	}
+	p := testProgram()
+	p.Objects[0].Flags |= module.ObjW
+	p.Objects[1].Flags &^= module.ObjR
+	p.ESP = module.Ref{Obj: 2, Off: 0x2000}
+	in := writeTemp(t, p, "bad.le")
+	buf.Reset()
+	err := cmdValidate(&buf, in)
+	if err == nil || !strings.HasSuffix(err.Error(), "found 3 problems") {
+		t.Errorf("got error %v, expected 3 problems", err)
+	}
+	for _, msg := range []string{
+		"object 1 is both writable and executable",
+		"object 2 is not readable",
+		"invalid stack pointer 2:0x2000",
+	} {
+		if !strings.Contains(buf.String(), msg) {
+			t.Errorf("output does not contain %q:\n%s", msg, buf.String())
+		}
+	}
+}
+
+func TestFixupHistogram(t *testing.T) {
+	p := testProgram()
+	obj := p.Objects[0]
+	obj.VirtualSize = 0x3000
+	obj.Data = append(obj.Data, make([]byte, 0x2000)...)
+	// Page 1 has 2 fixups, page 2 has none, and page 3 has 5.
+	for _, src := range []int32{0x2000, 0x2010, 0x2020, 0x2030, 0x2040} {
+		obj.Fixups = append(obj.Fixups,
+			module.Fixup{SrcType: module.SrcOffset32, Src: src, Target: module.Ref{Obj: 2}})
+	}
+	var buf bytes.Buffer
+	if err := cmdFixupHistogram(&buf, writeTemp(t, p, "in.le")); err != nil {
+		t.Fatal(err)
+	}
+	const expect = "" +
+		"Fixups     Pages\n" +
+		"0              2  ##\n" +
+		"1              0\n" +
+		"2-3            1  #\n" +
+		"4-7            1  #\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
+
+// errWriteCloser is a WriteCloser which returns errors and counts calls to
+// Close.
+type errWriteCloser struct {
+	writeErr, closeErr error
+	closes             int
+}
+
+func (w *errWriteCloser) Write(p []byte) (int, error) {
+	if w.writeErr != nil {
+		return 0, w.writeErr
+	}
+	return len(p), nil
+}
+
+func (w *errWriteCloser) Close() error {
+	w.closes++
+	return w.closeErr
+}
+
+func TestWriteClose(t *testing.T) {
+	writeErr := errors.New("write failed")
+	closeErr := errors.New("close failed")
+	write := func(w io.Writer) error {
+		return testProgram().Write(w)
+	}
+	for _, c := range []struct {
+		writeErr, closeErr, expect error
+	}{
+		{nil, nil, nil},
+		{writeErr, nil, writeErr},
+		{nil, closeErr, closeErr},
+		{writeErr, closeErr, writeErr},
+	} {
+		w := &errWriteCloser{writeErr: c.writeErr, closeErr: c.closeErr}
+		if err := writeClose(w, write); err != c.expect {
+			t.Errorf("write error %v, close error %v: got %v, expected %v",
+				c.writeErr, c.closeErr, err, c.expect)
+		}
+		if w.closes != 1 {
+			t.Errorf("write error %v, close error %v: closed %d times, expected once",
+				c.writeErr, c.closeErr, w.closes)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		expect uint32
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"0x1000", 0x1000},
+		{"64k", 64 << 10},
+		{"64K", 64 << 10},
+		{"1M", 1 << 20},
+		{"4095M", 4095 << 20},
+	} {
+		v, err := parseSize(c.in)
+		if err != nil {
+			t.Errorf("parseSize(%q): %v", c.in, err)
+		} else if v != c.expect {
+			t.Errorf("parseSize(%q) = %d, expected %d", c.in, v, c.expect)
+		}
+	}
+	for _, s := range []string{"", "k", "1G", "4096M", "-1"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q): expected error", s)
+		}
+	}
+}
+
+func TestParseCPU(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		expect uint16
+	}{
+		{"386", module.CPU80386},
+		{"486", module.CPU80486},
+	} {
+		v, err := parseCPU(c.in)
+		if err != nil {
+			t.Errorf("parseCPU(%q): %v", c.in, err)
+		} else if v != c.expect {
+			t.Errorf("parseCPU(%q) = %d, expected %d", c.in, v, c.expect)
+		}
+	}
+	for _, s := range []string{"", "286", "586", "i386"} {
+		if _, err := parseCPU(s); err == nil {
+			t.Errorf("parseCPU(%q): expected error", s)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := cmdSelfTest(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "OK\n" {
+		t.Errorf("got output %q, expected \"OK\\n\"", s)
+	}
+}
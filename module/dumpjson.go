@@ -0,0 +1,209 @@
+package module
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// jsonRef is a Ref in the JSON dump.
+type jsonRef struct {
+	Obj int32 `json:"obj"`
+	Off int32 `json:"off"`
+}
+
+// jsonFixup is a Fixup in the JSON dump.
+type jsonFixup struct {
+	Type     uint32  `json:"type"`
+	TypeName string  `json:"type_name"`
+	Src      int32   `json:"src"`
+	Target   jsonRef `json:"target"`
+	Add      int32   `json:"add"`
+}
+
+// jsonPage is an ObjectPage in the JSON dump.
+type jsonPage struct {
+	FixupPageIndex uint16      `json:"fixup_page_index"`
+	Type           uint8       `json:"type"`
+	Reserved       uint8       `json:"reserved"`
+	DataOffset     uint32      `json:"data_offset"`
+	DataSize       uint16      `json:"data_size"`
+	Fixups         []jsonFixup `json:"fixups"`
+}
+
+// jsonObjectHeader is an ObjectHeader in the JSON dump. The field names are
+// part of the output format, and must not change.
+type jsonObjectHeader struct {
+	VirtualSize         uint32 `json:"virtual_size"`
+	BaseAddress         uint32 `json:"base_address"`
+	Flags               uint32 `json:"flags"`
+	PageTableIndex      uint32 `json:"page_table_index"`
+	NumPageTableEntries uint32 `json:"page_table_entries"`
+	Reserved            uint32 `json:"reserved"`
+}
+
+// jsonObject is an Object in the JSON dump.
+type jsonObject struct {
+	Header jsonObjectHeader `json:"header"`
+	Pages  []jsonPage       `json:"pages"`
+}
+
+// jsonProgramHeader is a ProgramHeader in the JSON dump. The field names are
+// part of the output format, and must not change.
+type jsonProgramHeader struct {
+	Signature                 string  `json:"signature"`
+	ByteOrder                 uint8   `json:"byte_order"`
+	WordOrder                 uint8   `json:"word_order"`
+	FormatLevel               uint32  `json:"format_level"`
+	CPUType                   uint16  `json:"cpu_type"`
+	OSType                    uint16  `json:"os_type"`
+	ModuleVersion             uint32  `json:"module_version"`
+	ModuleFlags               uint32  `json:"module_flags"`
+	ModuleNumPages            uint32  `json:"module_num_pages"`
+	EIP                       jsonRef `json:"eip"`
+	ESP                       jsonRef `json:"esp"`
+	PageSize                  uint32  `json:"page_size"`
+	LastPageSize              uint32  `json:"last_page_size"`
+	FixupSectionSize          uint32  `json:"fixup_section_size"`
+	FixupSectionChecksum      uint32  `json:"fixup_section_checksum"`
+	LoaderSectionSize         uint32  `json:"loader_section_size"`
+	LoaderSectionChecksum     uint32  `json:"loader_section_checksum"`
+	ObjectTableOffset         uint32  `json:"object_table_offset"`
+	NumObjects                uint32  `json:"num_objects"`
+	ObjectPageTableOffset     uint32  `json:"object_page_table_offset"`
+	ObjectIterPageTableOffset uint32  `json:"object_iter_page_table_offset"`
+	ResourceTableOffset       uint32  `json:"resource_table_offset"`
+	NumResourceTableEntries   uint32  `json:"num_resource_table_entries"`
+	ResidentNameTableOffset   uint32  `json:"resident_name_table_offset"`
+	EntryTableOffset          uint32  `json:"entry_table_offset"`
+	ModuleDirectivesOffset    uint32  `json:"module_directives_offset"`
+	NumModuleDirectives       uint32  `json:"num_module_directives"`
+	FixupPageTableOffset      uint32  `json:"fixup_page_table_offset"`
+	FixupRecordOffset         uint32  `json:"fixup_record_offset"`
+	ImportModuleTableOffset   uint32  `json:"import_module_table_offset"`
+	ImportModuleEntryCount    uint32  `json:"import_module_entry_count"`
+	ImportProcTableOffset     uint32  `json:"import_proc_table_offset"`
+	PerPageChecksumOffset     uint32  `json:"per_page_checksum_offset"`
+	DataPagesOffset           uint32  `json:"data_pages_offset"`
+	NumPreloadPages           uint32  `json:"num_preload_pages"`
+	NonResNameTableOffset     uint32  `json:"non_resname_table_offset"`
+	NonResNameTableLength     uint32  `json:"non_resname_table_length"`
+	NonResNameTableChecksum   uint32  `json:"non_resname_table_checksum"`
+	AutoDSObject              uint32  `json:"auto_ds_object"`
+	DebugInfoOffset           uint32  `json:"debug_info_offset"`
+	DebugInfoLength           uint32  `json:"debug_info_length"`
+	NumInstancePreload        uint32  `json:"num_instance_preload"`
+	NumInstanceDemand         uint32  `json:"num_instance_demand"`
+	HeapSize                  uint32  `json:"heap_size"`
+}
+
+// jsonProgram is a Program in the JSON dump.
+type jsonProgram struct {
+	Header  jsonProgramHeader `json:"header"`
+	Objects []jsonObject      `json:"objects"`
+	Errors  []string          `json:"errors,omitempty"`
+}
+
+// jsonObjectHeaderOf converts an object header for the JSON dump.
+func jsonObjectHeaderOf(h *ObjectHeader) jsonObjectHeader {
+	return jsonObjectHeader{
+		VirtualSize:         h.VirtualSize,
+		BaseAddress:         h.BaseAddress,
+		Flags:               uint32(h.Flags),
+		PageTableIndex:      h.PageTableIndex,
+		NumPageTableEntries: h.NumPageTableEntries,
+		Reserved:            h.Reserved,
+	}
+}
+
+// jsonProgramHeaderOf converts a program header for the JSON dump.
+func jsonProgramHeaderOf(h *ProgramHeader) jsonProgramHeader {
+	return jsonProgramHeader{
+		Signature:                 string(h.Signature[:]),
+		ByteOrder:                 h.ByteOrder,
+		WordOrder:                 h.WordOrder,
+		FormatLevel:               h.FormatLevel,
+		CPUType:                   h.CPUType,
+		OSType:                    h.OSType,
+		ModuleVersion:             h.ModuleVersion,
+		ModuleFlags:               h.ModuleFlags,
+		ModuleNumPages:            h.ModuleNumPages,
+		EIP:                       jsonRef{h.EIP.Obj, h.EIP.Off},
+		ESP:                       jsonRef{h.ESP.Obj, h.ESP.Off},
+		PageSize:                  h.PageSize,
+		LastPageSize:              h.LastPageSize,
+		FixupSectionSize:          h.FixupSectionSize,
+		FixupSectionChecksum:      h.FixupSectionChecksum,
+		LoaderSectionSize:         h.LoaderSectionSize,
+		LoaderSectionChecksum:     h.LoaderSectionChecksum,
+		ObjectTableOffset:         h.ObjectTableOffset,
+		NumObjects:                h.NumObjects,
+		ObjectPageTableOffset:     h.ObjectPageTableOffset,
+		ObjectIterPageTableOffset: h.ObjectIterPageTableOffset,
+		ResourceTableOffset:       h.ResourceTableOffset,
+		NumResourceTableEntries:   h.NumResourceTableEntries,
+		ResidentNameTableOffset:   h.ResidentNameTableOffset,
+		EntryTableOffset:          h.EntryTableOffset,
+		ModuleDirectivesOffset:    h.ModuleDirectivesOffset,
+		NumModuleDirectives:       h.NumModuleDirectives,
+		FixupPageTableOffset:      h.FixupPageTableOffset,
+		FixupRecordOffset:         h.FixupRecordOffset,
+		ImportModuleTableOffset:   h.ImportModuleTableOffset,
+		ImportModuleEntryCount:    h.ImportModuleEntryCount,
+		ImportProcTableOffset:     h.ImportProcTableOffset,
+		PerPageChecksumOffset:     h.PerPageChecksumOffset,
+		DataPagesOffset:           h.DataPagesOffset,
+		NumPreloadPages:           h.NumPreloadPages,
+		NonResNameTableOffset:     h.NonResNameTableOffset,
+		NonResNameTableLength:     h.NonResNameTableLength,
+		NonResNameTableChecksum:   h.NonResNameTableChecksum,
+		AutoDSObject:              h.AutoDSObject,
+		DebugInfoOffset:           h.DebugInfoOffset,
+		DebugInfoLength:           h.DebugInfoLength,
+		NumInstancePreload:        h.NumInstancePreload,
+		NumInstanceDemand:         h.NumInstanceDemand,
+		HeapSize:                  h.HeapSize,
+	}
+}
+
+// DumpJSON writes the program, in JSON format, to the writer. The output
+// contains the same information as DumpText, and its field names will not
+// change, so it can be parsed by other tools.
+func (p *Program) DumpJSON(w io.Writer) error {
+	jp := jsonProgram{
+		Header:  jsonProgramHeaderOf(&p.ProgramHeader),
+		Objects: make([]jsonObject, 0, len(p.Objects)),
+	}
+	for _, obj := range p.Objects {
+		jo := jsonObject{
+			Header: jsonObjectHeaderOf(&obj.ObjectHeader),
+			Pages:  make([]jsonPage, 0, len(obj.Pages)),
+		}
+		for _, pg := range obj.Pages {
+			jpg := jsonPage{
+				FixupPageIndex: pg.FixupPageIndex,
+				Type:           uint8(pg.Type),
+				Reserved:       pg.Reserved1,
+				DataOffset:     pg.DataOffset,
+				DataSize:       pg.DataSize,
+				Fixups:         make([]jsonFixup, 0, len(pg.Fixups)),
+			}
+			for _, f := range pg.Fixups {
+				jpg.Fixups = append(jpg.Fixups, jsonFixup{
+					Type:     uint32(f.SrcType),
+					TypeName: srcTypeName(f.SrcType),
+					Src:      f.Src,
+					Target:   jsonRef{f.Target.Obj, f.Target.Off},
+					Add:      f.Add,
+				})
+			}
+			jo.Pages = append(jo.Pages, jpg)
+		}
+		jp.Objects = append(jp.Objects, jo)
+	}
+	for _, err := range p.ReadErrors {
+		jp.Errors = append(jp.Errors, err.Error())
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", indentLevel)
+	return e.Encode(&jp)
+}
@@ -0,0 +1,129 @@
+package module_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDumpJSON(t *testing.T) {
+	p, err := openBytes(t, writeBytes(t, testProgram()))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	var buf bytes.Buffer
+	if err := p.DumpJSON(&buf); err != nil {
+		t.Fatal("DumpJSON:", err)
+	}
+	var d struct {
+		Header struct {
+			Signature string
+			EIP       struct{ Obj, Off int32 }
+			PageSize  uint32 `json:"page_size"`
+		}
+		Objects []struct {
+			Header struct {
+				VirtualSize uint32 `json:"virtual_size"`
+				Flags       uint32
+			}
+			Pages []struct {
+				Fixups []struct {
+					Type     uint32
+					TypeName string `json:"type_name"`
+					Src      int32
+					Target   struct{ Obj, Off int32 }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		t.Fatalf("Unmarshal: %v\n%s", err, buf.String())
+	}
+	if d.Header.Signature != "LE" || d.Header.PageSize != 0x1000 {
+		t.Errorf("header: signature %q, page size 0x%x", d.Header.Signature, d.Header.PageSize)
+	}
+	if d.Header.EIP.Obj != p.EIP.Obj || d.Header.EIP.Off != p.EIP.Off {
+		t.Errorf("header: EIP %+v, expected %v", d.Header.EIP, p.EIP)
+	}
+	if len(d.Objects) != len(p.Objects) {
+		t.Fatalf("got %d objects, expected %d", len(d.Objects), len(p.Objects))
+	}
+	for i, obj := range p.Objects {
+		do := d.Objects[i]
+		if do.Header.VirtualSize != obj.VirtualSize || do.Header.Flags != uint32(obj.Flags) {
+			t.Errorf("object %d: header %+v", i+1, do.Header)
+		}
+		if len(do.Pages) != len(obj.Pages) {
+			t.Errorf("object %d: got %d pages, expected %d", i+1, len(do.Pages), len(obj.Pages))
+			continue
+		}
+		for j, pg := range obj.Pages {
+			fs := do.Pages[j].Fixups
+			if len(fs) != len(pg.Fixups) {
+				t.Errorf("object %d page %d: got %d fixups, expected %d", i+1, j, len(fs), len(pg.Fixups))
+				continue
+			}
+			for k, f := range pg.Fixups {
+				if fs[k].Type != uint32(f.SrcType) || fs[k].Src != f.Src || fs[k].Target.Obj != f.Target.Obj ||
+					fs[k].Target.Off != f.Target.Off {
+					t.Errorf("object %d page %d: got fixup %+v, expected %+v", i+1, j, fs[k], f)
+				}
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for _, pg := range d.Objects[0].Pages {
+		for _, f := range pg.Fixups {
+			names[f.TypeName] = true
+		}
+	}
+	if len(names) != 2 || !names["ad"] || !names["rd"] {
+		t.Errorf("got fixup type names %v, expected ad and rd", names)
+	}
+}
+
+func TestDumpJSONKeys(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testProgram().DumpJSON(&buf); err != nil {
+		t.Fatal("DumpJSON:", err)
+	}
+	var d struct {
+		Header  map[string]interface{}
+		Objects []struct {
+			Header map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		t.Fatal("Unmarshal:", err)
+	}
+	keys := func(m map[string]interface{}) string {
+		var k []string
+		for name := range m {
+			k = append(k, name)
+		}
+		sort.Strings(k)
+		return strings.Join(k, " ")
+	}
+	// These names are part of the output format.
+	const programKeys = "auto_ds_object byte_order cpu_type data_pages_offset debug_info_length " +
+		"debug_info_offset eip entry_table_offset esp fixup_page_table_offset fixup_record_offset " +
+		"fixup_section_checksum fixup_section_size format_level heap_size import_module_entry_count " +
+		"import_module_table_offset import_proc_table_offset last_page_size loader_section_checksum " +
+		"loader_section_size module_directives_offset module_flags module_num_pages module_version " +
+		"non_resname_table_checksum non_resname_table_length non_resname_table_offset " +
+		"num_instance_demand num_instance_preload num_module_directives num_objects " +
+		"num_preload_pages num_resource_table_entries object_iter_page_table_offset " +
+		"object_page_table_offset object_table_offset os_type page_size per_page_checksum_offset " +
+		"resident_name_table_offset resource_table_offset signature word_order"
+	const objectKeys = "base_address flags page_table_entries page_table_index reserved virtual_size"
+	if k := keys(d.Header); k != programKeys {
+		t.Errorf("program header keys:\n%s\nexpected:\n%s", k, programKeys)
+	}
+	for i, obj := range d.Objects {
+		if k := keys(obj.Header); k != objectKeys {
+			t.Errorf("object %d header keys:\n%s\nexpected:\n%s", i+1, k, objectKeys)
+		}
+	}
+}
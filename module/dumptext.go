@@ -3,6 +3,7 @@ package module
 import (
 	"bufio"
 	"fmt"
+	"hash/crc32"
 	"strconv"
 )
 
@@ -27,6 +28,48 @@ func writeHexStr(w *bufio.Writer, b []byte) {
 	w.Write(d)
 }
 
+// hexLineSize is the number of bytes on each line of a hex dump.
+const hexLineSize = 16
+
+// writeHexDump writes data as a hex and ASCII listing, 16 bytes per line,
+// with each line labeled by its address. A run of lines identical to the
+// previous line is written as a single "*" line.
+func writeHexDump(w *bufio.Writer, prefix string, addr uint32, data []byte) {
+	var prev []byte
+	var skipped bool
+	for off := 0; off < len(data); off += hexLineSize {
+		line := data[off:min(off+hexLineSize, len(data))]
+		if prev != nil && len(line) == hexLineSize && string(line) == string(prev) {
+			if !skipped {
+				w.WriteString(prefix)
+				w.WriteString("*\n")
+				skipped = true
+			}
+			continue
+		}
+		prev, skipped = line, false
+		w.WriteString(prefix)
+		writeInt0(w, addr+uint32(off), 4)
+		// Two spaces, three columns per byte, a space, then the ASCII.
+		var d [52 + hexLineSize]byte
+		for i := range d {
+			d[i] = ' '
+		}
+		d[51] = '|'
+		for i, c := range line {
+			d[2+i*3] = hexDigits[c>>4]
+			d[3+i*3] = hexDigits[c&15]
+			if 0x20 <= c && c <= 0x7e {
+				d[52+i] = c
+			} else {
+				d[52+i] = '.'
+			}
+		}
+		w.Write(d[:52+len(line)])
+		w.WriteString("|\n")
+	}
+}
+
 func endian(b byte) string {
 	switch b {
 	case 0:
@@ -40,11 +83,11 @@ func endian(b byte) string {
 
 func cpuType(v uint16) string {
 	switch v {
-	case 1:
+	case CPU80286:
 		return "80286"
-	case 2:
+	case CPU80386:
 		return "80386"
-	case 3:
+	case CPU80486:
 		return "80486"
 	default:
 		return "unknown"
@@ -132,19 +175,87 @@ func dumpFields(w *bufio.Writer, prefix string, fields []field) {
 	}
 }
 
-// DumpText writes the object header, in text format, to the writer.
-func (h *ObjectHeader) DumpText(w *bufio.Writer, prefix string) {
-	dumpFields(w, prefix, []field{
+// A DumpOptions controls what DumpTextWith includes in the dump.
+type DumpOptions struct {
+	// CRC includes the CRC-32 (IEEE) of each object's data, to help find
+	// which objects differ between two modules.
+	CRC bool
+	// Hex includes a hex and ASCII listing of each object's data, labeled
+	// with addresses relative to the object's base address.
+	Hex bool
+	// Symbols, if not empty, are used to annotate fixup targets and the
+	// entry and stack pointers with the nearest symbol at or before them, as
+	// <name+0x10>.
+	Symbols []Symbol
+}
+
+// A Symbol is a named location in a program, used to annotate dumps.
+type Symbol struct {
+	Name string
+	Ref  Ref
+}
+
+// symbolName returns the nearest symbol at or before the reference, in the
+// same object, as "<name>" or "<name+0x10>". It returns the empty string if
+// there is no such symbol.
+func symbolName(syms []Symbol, r Ref) string {
+	var best *Symbol
+	for i := range syms {
+		s := &syms[i]
+		if s.Ref.Obj == r.Obj && s.Ref.Off <= r.Off && (best == nil || s.Ref.Off > best.Ref.Off) {
+			best = s
+		}
+	}
+	switch {
+	case best == nil:
+		return ""
+	case best.Ref.Off == r.Off:
+		return "<" + best.Name + ">"
+	default:
+		return fmt.Sprintf("<%s+0x%x>", best.Name, r.Off-best.Ref.Off)
+	}
+}
+
+func (h *ObjectHeader) fields() []field {
+	return []field{
 		{"Virtual Size", h.VirtualSize, ""},
 		{"Base Address", h.BaseAddress, ""},
-		{"Flags", uint32(h.Flags), ""},
+		{"Flags", uint32(h.Flags), h.Flags.String()},
 		{"Page Table Index", h.PageTableIndex, ""},
 		{"Page Table Entries", h.NumPageTableEntries, ""},
 		{"Reserved", h.Reserved, ""},
-	})
+	}
+}
+
+// DumpText writes the object header, in text format, to the writer.
+func (h *ObjectHeader) DumpText(w *bufio.Writer, prefix string) {
+	dumpFields(w, prefix, h.fields())
 }
 
-func writeFixup(w *bufio.Writer, f Fixup) {
+// srcTypeName returns the short name of a fixup source type, ignoring the
+// source list and additive flags.
+func srcTypeName(t SrcType) string {
+	switch t & 15 {
+	case 0:
+		return "ab" // byte
+	case 2:
+		return "sw" // selector word
+	case 3:
+		return "fw" // far word
+	case 5:
+		return "aw" // absolute word
+	case 6:
+		return "fd" // far doubleword
+	case 7:
+		return "ad" // absolute doubleword
+	case 8:
+		return "rd" // relative doubleword
+	default:
+		return "??"
+	}
+}
+
+func writeFixup(w *bufio.Writer, f Fixup, syms []Symbol) {
 	writeInt0(w, uint32(f.SrcType), 1)
 	w.WriteByte(':')
 	if f.SrcType&0x20 != 0 {
@@ -152,31 +263,12 @@ func writeFixup(w *bufio.Writer, f Fixup) {
 	} else {
 		w.WriteByte('-')
 	}
-	if f.SrcType&0x10 != 0 {
+	if f.Add != 0 {
 		w.WriteByte('A')
 	} else {
 		w.WriteByte('-')
 	}
-	var t string
-	switch f.SrcType & 15 {
-	case 0:
-		t = "ab" // byte
-	case 2:
-		t = "sw" // selector word
-	case 3:
-		t = "fw" // far word
-	case 5:
-		t = "aw" // absolute word
-	case 6:
-		t = "fd" // far doubleword
-	case 7:
-		t = "ad" // absolute doubleword
-	case 8:
-		t = "rd" // relative doubleword
-	default:
-		t = "??"
-	}
-	w.WriteString(t)
+	w.WriteString(srcTypeName(f.SrcType))
 
 	w.WriteByte(' ')
 	if f.Src >= 0 {
@@ -199,34 +291,63 @@ func writeFixup(w *bufio.Writer, f Fixup) {
 	} else {
 		writeInt0(w, uint32(f.Target.Off), 2)
 	}
+	if f.Add != 0 {
+		w.WriteString(" +")
+		writeInt(w, uint32(f.Add), 4)
+	}
+	if name := symbolName(syms, f.Target); name != "" {
+		w.WriteByte(' ')
+		w.WriteString(name)
+	}
 }
 
 // DumpText writes the object, in text format, to the writer
 func (o *Object) DumpText(w *bufio.Writer, prefix string) {
+	o.DumpTextWith(w, prefix, nil)
+}
+
+// DumpTextWith writes the object, in text format, to the writer, using the
+// given options. If opts is nil, the default options are used.
+func (o *Object) DumpTextWith(w *bufio.Writer, prefix string, opts *DumpOptions) {
+	if opts == nil {
+		opts = new(DumpOptions)
+	}
 	nprefix3 := prefix + indentLevel + indentLevel + indentLevel
 	nprefix2 := nprefix3[:len(prefix)+len(indentLevel)*2]
 	nprefix1 := nprefix3[:len(prefix)+len(indentLevel)]
 	w.WriteString(prefix)
 	w.WriteString("Header:\n")
-	o.ObjectHeader.DumpText(w, nprefix1)
+	fields := o.ObjectHeader.fields()
+	if opts.CRC {
+		fields = append(fields, field{"Data CRC32", crc32.ChecksumIEEE(o.Data), ""})
+	}
+	dumpFields(w, nprefix1, fields)
 	if len(o.Pages) != 0 {
 		w.WriteString(nprefix1)
 		w.WriteString("Pages:\n")
 		for i, p := range o.Pages {
-			fmt.Fprintf(w, "%sPage %d, Fixup Page %d (Reserved: 0x%02x 0x%02x)\n",
-				nprefix2, i, p.FixupPageIndex, p.Reserved1, p.Reserved2)
+			fmt.Fprintf(w, "%sPage %d, Fixup Page %d, Type %d (Reserved: 0x%02x)",
+				nprefix2, i, p.FixupPageIndex, p.Type, p.Reserved1)
+			if p.DataOffset != 0 || p.DataSize != 0 {
+				fmt.Fprintf(w, ", Data Offset 0x%x, Size 0x%x", p.DataOffset, p.DataSize)
+			}
+			w.WriteByte('\n')
 			for _, f := range p.Fixups {
 				w.WriteString(nprefix3)
-				writeFixup(w, f)
+				writeFixup(w, f, opts.Symbols)
 				w.WriteByte('\n')
 			}
 		}
 	}
+	if opts.Hex && len(o.Data) != 0 {
+		w.WriteString(nprefix1)
+		w.WriteString("Data:\n")
+		writeHexDump(w, nprefix2, o.BaseAddress, o.Data)
+	}
 }
 
-// DumpText writes the program header, in text format, to the writer.
-func (p *ProgramHeader) DumpText(w *bufio.Writer, prefix string) {
-	dumpFields(w, prefix, []field{
+func (p *ProgramHeader) fields() []field {
+	return []field{
 		{"Signature", p.Signature[:], ""},
 		{"Byte Order", p.ByteOrder, endian(p.ByteOrder)},
 		{"Word Order", p.WordOrder, endian(p.WordOrder)},
@@ -271,22 +392,200 @@ func (p *ProgramHeader) DumpText(w *bufio.Writer, prefix string) {
 		{"Num Instance Preload", p.NumInstancePreload, ""},
 		{"Num Instance Demand", p.NumInstanceDemand, ""},
 		{"Heap Size", p.HeapSize, ""},
-	})
+	}
+}
+
+// DumpText writes the program header, in text format, to the writer.
+func (p *ProgramHeader) DumpText(w *bufio.Writer, prefix string) {
+	dumpFields(w, prefix, p.fields())
 }
 
 // DumpText writes the program, in text format, to the writer.
 func (p *Program) DumpText(w *bufio.Writer, prefix string) {
+	p.DumpTextWith(w, prefix, nil)
+}
+
+// DumpTextWith writes the program, in text format, to the writer, using the
+// given options. If opts is nil, the default options are used.
+func (p *Program) DumpTextWith(w *bufio.Writer, prefix string, opts *DumpOptions) {
 	nprefix := prefix + indentLevel
 	w.WriteString(prefix)
 	w.WriteString("Header:\n")
-	p.ProgramHeader.DumpText(w, nprefix)
+	fields := p.ProgramHeader.fields()
+	if opts != nil && len(opts.Symbols) != 0 {
+		for i, f := range fields {
+			if r, ok := f.data.(Ref); ok {
+				fields[i].hint = symbolName(opts.Symbols, r)
+			}
+		}
+	}
+	dumpFields(w, nprefix, fields)
 	w.WriteByte('\n')
 	for i, obj := range p.Objects {
 		w.WriteString(prefix)
 		w.WriteString("Object ")
 		w.WriteString(strconv.Itoa(i + 1))
 		w.WriteString(":\n")
-		obj.DumpText(w, nprefix)
+		obj.DumpTextWith(w, nprefix, opts)
 		w.WriteByte('\n')
 	}
+	if len(p.ReadErrors) != 0 {
+		w.WriteString(prefix)
+		w.WriteString("Errors:\n")
+		for _, err := range p.ReadErrors {
+			w.WriteString(nprefix)
+			w.WriteString(err.Error())
+			w.WriteByte('\n')
+		}
+	}
+}
+
+// DumpTable writes a summary of the program's objects to the writer, as a
+// table with one row for each object.
+func (p *Program) DumpTable(w *bufio.Writer, prefix string) {
+	npage := make([]int, len(p.Objects))
+	for _, pg := range p.Pages() {
+		npage[pg.Object-1]++
+	}
+	fmt.Fprintf(w, "%s%3s  %-8s  %-8s  %-14s  %5s  %6s\n",
+		prefix, "Obj", "Base", "Size", "Flags", "Pages", "Fixups")
+	for i, obj := range p.Objects {
+		fmt.Fprintf(w, "%s%3d  %08x  %08x  %-14s  %5d  %6d\n",
+			prefix, i+1, obj.BaseAddress, obj.VirtualSize, obj.Flags,
+			npage[i], len(obj.Fixups))
+	}
+}
+
+// moduleFlags returns the names of the module flags which are set.
+func moduleFlags(f uint32) string {
+	var s string
+	for _, c := range []struct {
+		flag uint32
+		name string
+	}{
+		{0x00000004, "library-init"},
+		{0x00000010, "no-internal-fixups"},
+		{ModNoExternalFixups, "no-external-fixups"},
+		{0x00002000, "not-loadable"},
+		{ModLibrary, "library"},
+		{0x40000000, "library-term"},
+	} {
+		if f&c.flag != 0 {
+			s += " " + c.name
+			f &^= c.flag
+		}
+	}
+	if f != 0 {
+		s += fmt.Sprintf(" +0x%x", f)
+	}
+	if s == "" {
+		return "none"
+	}
+	return s[1:]
+}
+
+// kib formats a size in bytes as KiB. Sizes which are not a whole number of
+// KiB also show the number of bytes.
+func kib(n uint32) string {
+	if n%1024 == 0 {
+		return fmt.Sprintf("%d KiB", n/1024)
+	}
+	return fmt.Sprintf("%.1f KiB (%d bytes)", float64(n)/1024, n)
+}
+
+// refInfo describes a reference, with the object it points into and the
+// address it points to.
+func (p *Program) refInfo(r Ref) string {
+	if r.Obj < 1 || int(r.Obj) > len(p.Objects) {
+		return fmt.Sprintf("%v (no such object)", r)
+	}
+	obj := p.Objects[r.Obj-1]
+	return fmt.Sprintf("%v (%s, address 0x%08x)", r, obj.Flags, obj.BaseAddress+uint32(r.Off))
+}
+
+// suspicious returns descriptions of header fields which are zero, but which
+// are normally set.
+func (p *Program) suspicious() []string {
+	var s []string
+	library := p.ModuleFlags&ModLibrary != 0
+	if p.PageSize == 0 {
+		s = append(s, "page size is zero")
+	}
+	if p.NumObjects == 0 {
+		s = append(s, "module has no objects")
+	} else {
+		if p.ObjectTableOffset == 0 {
+			s = append(s, "object table offset is zero")
+		}
+		if p.FixupPageTableOffset == 0 {
+			s = append(s, "fixup page table offset is zero")
+		}
+	}
+	if p.ModuleNumPages != 0 {
+		if p.DataPagesOffset == 0 {
+			s = append(s, "data pages offset is zero")
+		}
+		if p.IsLE() && p.LastPageSize == 0 {
+			s = append(s, "last page size is zero")
+		}
+	}
+	if p.EIP.Obj == 0 && !library {
+		s = append(s, "entry point object is zero")
+	}
+	if p.ESP.Obj == 0 && !library {
+		s = append(s, "stack pointer object is zero")
+	}
+	return s
+}
+
+// DumpInfo writes an interpretation of the program header to the writer, and
+// lists header fields which are zero but are normally set.
+func (p *Program) DumpInfo(w *bufio.Writer, prefix string) {
+	order := "little endian"
+	if p.ByteOrder != 0 || p.WordOrder != 0 {
+		order = fmt.Sprintf("byte order %s, word order %s", endian(p.ByteOrder), endian(p.WordOrder))
+	}
+	sig := string(p.Signature[:])
+	if !p.IsLE() && !p.IsLX() {
+		sig = strconv.Quote(sig)
+	}
+	info := [][2]string{
+		{"Format", fmt.Sprintf("%s, %s, level %d", sig, order, p.FormatLevel)},
+		{"CPU", cpuType(p.CPUType)},
+		{"OS", osType(p.OSType)},
+		{"Module Version", fmt.Sprintf("0x%08x", p.ModuleVersion)},
+		{"Module Flags", fmt.Sprintf("0x%08x %s", p.ModuleFlags, moduleFlags(p.ModuleFlags))},
+		{"Entry Point", p.refInfo(p.EIP)},
+		{"Stack Pointer", p.refInfo(p.ESP)},
+		{"Objects", strconv.Itoa(int(p.NumObjects))},
+		{"Pages", fmt.Sprintf("%d, %d preloaded, %s each", p.ModuleNumPages, p.NumPreloadPages, kib(p.PageSize))},
+		{"Loader Section", kib(p.LoaderSectionSize)},
+		{"Fixup Section", kib(p.FixupSectionSize)},
+		{"Heap Size", kib(p.HeapSize)},
+	}
+	for i, obj := range p.Objects {
+		info = append(info, [2]string{
+			fmt.Sprintf("Object %d", i+1),
+			fmt.Sprintf("0x%08x, %s, %s", obj.BaseAddress, kib(obj.VirtualSize), obj.Flags),
+		})
+	}
+	var width int
+	for _, f := range info {
+		if len(f[0]) > width {
+			width = len(f[0])
+		}
+	}
+	for _, f := range info {
+		fmt.Fprintf(w, "%s%-*s  %s\n", prefix, width+1, f[0]+":", f[1])
+	}
+	if s := p.suspicious(); len(s) != 0 {
+		w.WriteString(prefix)
+		w.WriteString("Suspicious:\n")
+		for _, msg := range s {
+			w.WriteString(prefix)
+			w.WriteString(indentLevel)
+			w.WriteString(msg)
+			w.WriteByte('\n')
+		}
+	}
 }
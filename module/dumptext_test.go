@@ -0,0 +1,163 @@
+package module_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"moria.us/elf2dos/module"
+)
+
+// dumpText returns the text dump of a program.
+func dumpText(p *module.Program, opts *module.DumpOptions) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	p.DumpTextWith(w, "", opts)
+	w.Flush()
+	return buf.String()
+}
+
+func TestDumpCRC(t *testing.T) {
+	p := testProgram()
+	if s := dumpText(p, nil); strings.Contains(s, "CRC32") {
+		t.Error("default dump contains CRC")
+	}
+	s := dumpText(p, &module.DumpOptions{CRC: true})
+	var crcs []string
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, "Data CRC32:"); i != -1 {
+			crcs = append(crcs, strings.TrimSpace(line[i+len("Data CRC32:"):]))
+		}
+	}
+	if len(crcs) != len(p.Objects) {
+		t.Fatalf("got %d CRCs, expected %d", len(crcs), len(p.Objects))
+	}
+	for i, obj := range p.Objects {
+		if e := fmt.Sprintf("0x%08x", crc32.ChecksumIEEE(obj.Data)); crcs[i] != e {
+			t.Errorf("object %d: CRC %s, expected %s", i+1, crcs[i], e)
+		}
+	}
+}
+
+func TestDumpHex(t *testing.T) {
+	obj := &module.Object{
+		ObjectHeader: module.ObjectHeader{VirtualSize: 0x100, BaseAddress: 0x20000},
+		Data:         make([]byte, 0x46),
+	}
+	copy(obj.Data, "Hello, world!\n")
+	copy(obj.Data[0x40:], "\x01end")
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	obj.DumpTextWith(w, "", nil)
+	w.Flush()
+	if s := buf.String(); strings.Contains(s, "Data:") {
+		t.Errorf("default dump contains data:\n%s", s)
+	}
+	buf.Reset()
+	obj.DumpTextWith(w, "", &module.DumpOptions{Hex: true})
+	w.Flush()
+	const expect = "" +
+		"  Data:\n" +
+		"    00020000  48 65 6c 6c 6f 2c 20 77 6f 72 6c 64 21 0a 00 00  |Hello, world!...|\n" +
+		"    00020010  00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00  |................|\n" +
+		"    *\n" +
+		"    00020040  01 65 6e 64 00 00                                |.end..|\n"
+	if s := buf.String(); !strings.HasSuffix(s, expect) {
+		t.Errorf("got:\n%s\nexpected suffix:\n%s", s, expect)
+	}
+}
+
+func TestDumpSymbols(t *testing.T) {
+	// Fixups are dumped by page, so the program must be read from a file.
+	p, err := openBytes(t, writeBytes(t, testProgram()))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if s := dumpText(p, nil); strings.Contains(s, "<") {
+		t.Errorf("default dump contains symbols:\n%s", s)
+	}
+	s := dumpText(p, &module.DumpOptions{Symbols: []module.Symbol{
+		{Name: "_start", Ref: module.Ref{Obj: 1, Off: 0}},
+		{Name: "main", Ref: module.Ref{Obj: 1, Off: 0x10}},
+		{Name: "data", Ref: module.Ref{Obj: 2, Off: 0}},
+		{Name: "_stack_end", Ref: module.Ref{Obj: 3, Off: 0x2000}},
+	}})
+	for _, e := range []string{
+		"EIP:                            0x00000001:0x00000010  <main>\n",
+		"ESP:                            0x00000003:0x00002000  <_stack_end>\n",
+	} {
+		if !strings.Contains(s, e) {
+			t.Errorf("dump does not contain %q:\n%s", e, s)
+		}
+	}
+	for _, obj := range testProgram().Objects {
+		for _, f := range obj.Fixups {
+			if f.Target.Obj == 2 {
+				e := fmt.Sprintf(" <data+0x%x>\n", f.Target.Off)
+				if f.Target.Off == 0 {
+					e = " <data>\n"
+				}
+				if !strings.Contains(s, e) {
+					t.Errorf("dump does not contain %q:\n%s", e, s)
+				}
+			}
+		}
+	}
+}
+
+func TestDumpTable(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	testProgram().DumpTable(w, "")
+	w.Flush()
+	const expect = "" +
+		"Obj  Base      Size      Flags           Pages  Fixups\n" +
+		"  1  00010000  00001800  r-x 32-bit          2       3\n" +
+		"  2  00020000  00000100  rw- 32-bit          1       1\n" +
+		"  3  00030000  00002000  rw- 32-bit          0       0\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
+
+func TestDumpInfo(t *testing.T) {
+	p := testProgram()
+	p.HeapSize = 0x10000
+	p.ESP = module.Ref{}
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{Strict: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	r, err := openBytes(t, buf.Bytes())
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	buf.Reset()
+	w := bufio.NewWriter(&buf)
+	r.DumpInfo(w, "")
+	w.Flush()
+	const expect = "" +
+		"Format:          LE, little endian, level 0\n" +
+		"CPU:             80386\n" +
+		"OS:              unknown\n" +
+		"Module Version:  0x00000000\n" +
+		"Module Flags:    0x00000020 no-external-fixups\n" +
+		"Entry Point:     1:0x10 (r-x 32-bit, address 0x00010010)\n" +
+		"Stack Pointer:   0:0x0 (no such object)\n" +
+		"Objects:         3\n" +
+		"Pages:           3, 0 preloaded, 4 KiB each\n" +
+		"Loader Section:  0.1 KiB (107 bytes)\n" +
+		"Fixup Section:   0.1 KiB (55 bytes)\n" +
+		"Heap Size:       64 KiB\n" +
+		"Object 1:        0x00010000, 6 KiB, r-x 32-bit\n" +
+		"Object 2:        0x00020000, 0.2 KiB (256 bytes), rw- 32-bit\n" +
+		"Object 3:        0x00030000, 8 KiB, rw- 32-bit\n" +
+		"Suspicious:\n" +
+		"  stack pointer object is zero\n"
+	if s := buf.String(); s != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", s, expect)
+	}
+}
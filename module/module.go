@@ -1,6 +1,12 @@
 // Package module provides an interface to LE linear executable modules.
 package module
 
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
 const (
 	// PageBits is the amount of shift to convert between bytes and pages.
 	PageBits = 12
@@ -8,13 +14,41 @@ const (
 	PageSize = 1 << PageBits
 )
 
+// MaxLXPageSize is the largest page size accepted when reading an LX module.
+// LX modules may use any power of two from PageSize up to this size.
+const MaxLXPageSize = 1 << 16
+
+// lxPageBits returns the number of bits in an LX page size, and false if the
+// page size is not allowed.
+func lxPageBits(size uint32) (uint, bool) {
+	for bits := uint(PageBits); 1<<bits <= MaxLXPageSize; bits++ {
+		if size == 1<<bits {
+			return bits, true
+		}
+	}
+	return 0, false
+}
+
+// pageBits returns the number of bits in the program's page size. This is
+// PageBits, except for LX modules which were read with a larger page size.
+func (p *ProgramHeader) pageBits() uint {
+	if p.IsLX() {
+		if bits, ok := lxPageBits(p.PageSize); ok {
+			return bits
+		}
+	}
+	return PageBits
+}
+
 // pagecount returns the smallest number of pages that contain the given number of bytes.
 func pagecount(size uint32) uint32 {
-	npage := size >> PageBits
-	if size&(PageSize-1) != 0 {
-		npage++
-	}
-	return npage
+	return pagecountBits(size, PageBits)
+}
+
+// pagecountBits returns the smallest number of pages of 1<<bits bytes that
+// contain the given number of bytes.
+func pagecountBits(size uint32, bits uint) uint32 {
+	return uint32((uint64(size) + 1<<bits - 1) >> bits)
 }
 
 // An ObjFlag is a set of flags for an object in an LE/LX executable.
@@ -27,10 +61,56 @@ const (
 	ObjW ObjFlag = 0x0002
 	// ObjX indicates an executable object
 	ObjX ObjFlag = 0x0004
+	// ObjPreload indicates an object whose pages are loaded when the module
+	// is loaded, rather than on demand
+	ObjPreload ObjFlag = 0x0040
 	// Obj32Bit indicates the object is 32-bit
 	Obj32Bit ObjFlag = 0x2000
 )
 
+// String returns the flags as an "rwx" permission string, with a dash for each
+// missing permission, followed by the names of any other flags, such as
+// "r-x 32-bit".
+func (f ObjFlag) String() string {
+	b := []byte("---")
+	for i, c := range []struct {
+		flag ObjFlag
+		name byte
+	}{{ObjR, 'r'}, {ObjW, 'w'}, {ObjX, 'x'}} {
+		if f&c.flag != 0 {
+			b[i] = c.name
+		}
+	}
+	s := string(b)
+	if f&Obj32Bit != 0 {
+		s += " 32-bit"
+	}
+	if f&ObjPreload != 0 {
+		s += " preload"
+	}
+	if other := f &^ (ObjR | ObjW | ObjX | ObjPreload | Obj32Bit); other != 0 {
+		s += fmt.Sprintf(" +0x%x", uint32(other))
+	}
+	return s
+}
+
+// Values for ProgramHeader.CPUType.
+const (
+	CPU80286 uint16 = 1
+	CPU80386 uint16 = 2
+	CPU80486 uint16 = 3
+)
+
+// Flags for ProgramHeader.ModuleFlags.
+const (
+	// ModNoExternalFixups indicates that the module has no external (imported)
+	// fixups.
+	ModNoExternalFixups uint32 = 0x00000020
+	// ModLibrary indicates that the module is a library, rather than a
+	// program.
+	ModLibrary uint32 = 0x00008000
+)
+
 // A SrcType is a fixup source type. These values match the LE/LX exe values.
 type SrcType uint32
 
@@ -41,6 +121,11 @@ const (
 	SrcRelative32 SrcType = 0x08
 )
 
+// Size returns the number of bytes modified by a fixup with the source type.
+func (t SrcType) Size() int {
+	return int(srcSize(t))
+}
+
 // A Fixup describes how a single reference in an object should be fixed after
 // it is loaded into memory.
 type Fixup struct {
@@ -61,17 +146,37 @@ type ObjectHeader struct {
 	Reserved            uint32
 }
 
+// A PageType is the type of a page in the object page table.
+type PageType uint8
+
+const (
+	// PageLegal indicates a page whose data is stored verbatim.
+	PageLegal PageType = 0
+	// PageIterated indicates a page whose data is stored in iterated
+	// (compressed) form.
+	PageIterated PageType = 1
+	// PageInvalid indicates a page which is not present.
+	PageInvalid PageType = 2
+	// PageZeroed indicates a page which is filled with zeroes.
+	PageZeroed PageType = 3
+)
+
 // An ObjectPageHeader is an entry in the object page table.
 type ObjectPageHeader struct {
 	Reserved1      uint8
 	FixupPageIndex uint16
-	Reserved2      uint8
+	Type           PageType
 }
 
 // An ObjectPage is an entry in the object page table and its fixups.
 type ObjectPage struct {
 	ObjectPageHeader
-	Fixups []Fixup
+	// DataOffset and DataSize locate the page's data in an LX module. The
+	// offset is relative to the data pages and shifted left by the page
+	// offset shift. They are zero for LE modules.
+	DataOffset uint32
+	DataSize   uint16
+	Fixups     []Fixup
 }
 
 // An Object is a region of memory to be loaded when the program is run.
@@ -88,6 +193,11 @@ type Ref struct {
 	Off int32 // offset within target
 }
 
+// String returns the reference in obj:offset form.
+func (r Ref) String() string {
+	return fmt.Sprintf("%d:0x%x", r.Obj, r.Off)
+}
+
 // A ProgramHeader is the header for an LE/LX format executable.
 type ProgramHeader struct {
 	Signature                 [2]byte // "LE" or "LX"
@@ -150,4 +260,245 @@ func (p *ProgramHeader) IsLX() bool {
 type Program struct {
 	ProgramHeader
 	Objects []*Object // objects to load
+
+	// ReadErrors are the errors which were recovered from when reading the
+	// program in lenient mode.
+	ReadErrors []error
+}
+
+// RangeFixups calls f for each fixup in the program, in order. The fixup's
+// source is given as the 1-based index of the object containing it and the
+// offset of the source within that object. Iteration stops if f returns false.
+func (p *Program) RangeFixups(f func(srcObj int, srcOff uint32, fix Fixup) bool) {
+	for i, obj := range p.Objects {
+		for _, fix := range obj.Fixups {
+			if !f(i+1, uint32(fix.Src), fix) {
+				return
+			}
+		}
+	}
+}
+
+// object returns the object a reference points into, checking that the offset
+// is within the object. If end is true, the offset may also be the end of the
+// object.
+func (p *Program) object(r Ref, end bool) (*Object, error) {
+	if r.Obj < 1 || int(r.Obj) > len(p.Objects) {
+		return nil, fmt.Errorf("invalid object %d", r.Obj)
+	}
+	obj := p.Objects[r.Obj-1]
+	if r.Off < 0 || uint32(r.Off) > obj.VirtualSize || (!end && uint32(r.Off) == obj.VirtualSize) {
+		return nil, fmt.Errorf("offset 0x%x is outside object %d (size 0x%x)",
+			r.Off, r.Obj, obj.VirtualSize)
+	}
+	return obj, nil
+}
+
+// checkEntry checks that a reference points into an executable object.
+func (p *Program) checkEntry(r Ref) error {
+	obj, err := p.object(r, false)
+	if err != nil {
+		return fmt.Errorf("invalid entry point %v: %v", r, err)
+	}
+	if obj.Flags&ObjX == 0 {
+		return fmt.Errorf("invalid entry point %v: object %d is not executable (flags %s)",
+			r, r.Obj, obj.Flags)
+	}
+	return nil
+}
+
+// checkStack checks that a reference points into a writable object. Since the
+// stack grows down, the reference may point to the end of the object.
+func (p *Program) checkStack(r Ref) error {
+	obj, err := p.object(r, true)
+	if err != nil {
+		return fmt.Errorf("invalid stack pointer %v: %v", r, err)
+	}
+	if obj.Flags&ObjW == 0 {
+		return fmt.Errorf("invalid stack pointer %v: object %d is not writable", r, r.Obj)
+	}
+	return nil
+}
+
+// SetEntry sets the program's entry point, after checking that it points into
+// an executable object.
+func (p *Program) SetEntry(r Ref) error {
+	if err := p.checkEntry(r); err != nil {
+		return err
+	}
+	p.EIP = r
+	return nil
+}
+
+// SetStack sets the program's initial stack pointer, after checking that it
+// points into a writable object. Since the stack grows down, the stack pointer
+// may point to the end of the object.
+func (p *Program) SetStack(r Ref) error {
+	if err := p.checkStack(r); err != nil {
+		return err
+	}
+	p.ESP = r
+	return nil
+}
+
+// CompareLayout compares the layout of two programs: the number of objects, the
+// entry point, the initial stack pointer, and the base address and size of each
+// object. It returns nil if they are the same, or an error describing the first
+// difference. Object data and fixups are not compared.
+func (p *Program) CompareLayout(q *Program) error {
+	if len(p.Objects) != len(q.Objects) {
+		return fmt.Errorf("object count differs: %d and %d", len(p.Objects), len(q.Objects))
+	}
+	if p.EIP != q.EIP {
+		return fmt.Errorf("EIP differs: %v and %v", p.EIP, q.EIP)
+	}
+	if p.ESP != q.ESP {
+		return fmt.Errorf("ESP differs: %v and %v", p.ESP, q.ESP)
+	}
+	for i, x := range p.Objects {
+		y := q.Objects[i]
+		if x.BaseAddress != y.BaseAddress {
+			return fmt.Errorf("object %d base address differs: 0x%x and 0x%x",
+				i+1, x.BaseAddress, y.BaseAddress)
+		}
+		if x.VirtualSize != y.VirtualSize {
+			return fmt.Errorf("object %d size differs: 0x%x and 0x%x",
+				i+1, x.VirtualSize, y.VirtualSize)
+		}
+	}
+	return nil
+}
+
+// Canonicalize puts the program into a canonical form, so that functionally
+// equivalent programs are identical and are written identically. Header fields
+// which the writer computes, such as table offsets and checksums, are zeroed,
+// along with reserved fields, the page tables read from a module, and the read
+// errors. Fixups are sorted and trailing zeroes are removed from object data.
+func (p *Program) Canonicalize() {
+	h := p.ProgramHeader
+	if h.CPUType == 0 {
+		// Written as the 80386.
+		h.CPUType = CPU80386
+	}
+	p.ProgramHeader = ProgramHeader{
+		CPUType:       h.CPUType,
+		ModuleVersion: h.ModuleVersion,
+		ModuleFlags:   h.ModuleFlags,
+		EIP:           h.EIP,
+		ESP:           h.ESP,
+		HeapSize:      h.HeapSize,
+	}
+	p.ReadErrors = nil
+	for _, obj := range p.Objects {
+		obj.ObjectHeader = ObjectHeader{
+			VirtualSize: obj.VirtualSize,
+			BaseAddress: obj.BaseAddress,
+			Flags:       obj.Flags,
+		}
+		obj.Pages = nil
+		sort.Slice(obj.Fixups, func(i, j int) bool {
+			x, y := obj.Fixups[i], obj.Fixups[j]
+			switch {
+			case x.Src != y.Src:
+				return x.Src < y.Src
+			case x.SrcType != y.SrcType:
+				return x.SrcType < y.SrcType
+			case x.Target.Obj != y.Target.Obj:
+				return x.Target.Obj < y.Target.Obj
+			case x.Target.Off != y.Target.Off:
+				return x.Target.Off < y.Target.Off
+			default:
+				return x.Add < y.Add
+			}
+		})
+		obj.Data = bytes.TrimRight(obj.Data, "\x00")
+		if len(obj.Data) == 0 {
+			obj.Data = nil
+		}
+	}
+}
+
+// String returns a one-line summary of the program. A program without a
+// signature is shown as LE, the format it is written in.
+func (p *Program) String() string {
+	sig := string(p.Signature[:])
+	if p.Signature == [2]byte{} {
+		sig = "LE"
+	}
+	var npage uint32
+	for _, obj := range p.Objects {
+		if len(obj.Pages) != 0 {
+			npage += uint32(len(obj.Pages))
+		} else {
+			npage += pagecount(uint32(len(obj.Data)))
+		}
+	}
+	return fmt.Sprintf("%s program: %d objects, EIP %v, ESP %v, %d pages",
+		sig, len(p.Objects), p.EIP, p.ESP, npage)
+}
+
+// A PageInfo describes a data page of a program.
+type PageInfo struct {
+	Object    int    // 1-based index of the object containing the page
+	Offset    uint32 // offset of the page within the object
+	Size      uint32 // number of bytes of the page stored in the file
+	HasFixups bool   // whether any fixups apply to the page
+}
+
+// Pages returns the data pages of the program, in file order. Objects which
+// were read from a module have the pages in their page table, other objects
+// have the pages that Write would create for them. Every page is full except
+// the last page in an LE module. In an LX module, each page has the size from
+// its page table entry.
+func (p *Program) Pages() []PageInfo {
+	var pages []PageInfo
+	for i, obj := range p.Objects {
+		count := uint32(len(obj.Pages))
+		if count == 0 {
+			count = pagecount(uint32(len(obj.Data)))
+			if n := fixupPages(obj.Fixups, PageBits); n > count {
+				count = n
+			}
+		}
+		// Pages read from a module may be larger than PageSize.
+		bits := uint(PageBits)
+		if len(obj.Pages) != 0 {
+			bits = p.pageBits()
+		}
+		fixups := make([]bool, count)
+		for _, f := range obj.Fixups {
+			first := f.Src >> bits
+			last := (f.Src + srcSize(f.SrcType) - 1) >> bits
+			if first < 0 {
+				first = 0
+			}
+			for pi := first; pi <= last && pi < int32(count); pi++ {
+				fixups[pi] = true
+			}
+		}
+		for j := uint32(0); j < count; j++ {
+			size := uint32(PageSize)
+			if p.IsLX() && len(obj.Pages) != 0 {
+				size = uint32(obj.Pages[j].DataSize)
+			}
+			pages = append(pages, PageInfo{
+				Object:    i + 1,
+				Offset:    j << bits,
+				Size:      size,
+				HasFixups: fixups[j],
+			})
+		}
+	}
+	if n := len(pages); n != 0 && !p.IsLX() {
+		last := &pages[n-1]
+		if p.LastPageSize != 0 {
+			last.Size = p.LastPageSize
+		} else if size := uint32(len(p.Objects[last.Object-1].Data)); size > last.Offset {
+			last.Size = size - last.Offset
+		} else {
+			// Write stores at least one byte in the last page.
+			last.Size = 1
+		}
+	}
+	return pages
 }
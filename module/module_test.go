@@ -3,6 +3,7 @@ package module_test
 import (
 	"bytes"
 	"encoding/binary"
+	"reflect"
 	"testing"
 
 	"moria.us/elf2dos/module"
@@ -20,3 +21,197 @@ func TestProgramHeader(t *testing.T) {
 		t.Errorf("binary.Write: got %d, expected %d", size, expectSize)
 	}
 }
+
+func TestRangeFixups(t *testing.T) {
+	p := module.Program{
+		Objects: []*module.Object{
+			{Fixups: []module.Fixup{
+				{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 2}},
+				{SrcType: module.SrcOffset32, Src: 0x1ffe, Target: module.Ref{Obj: 2, Off: 4}},
+			}},
+			{},
+			{Fixups: []module.Fixup{
+				{SrcType: module.SrcRelative32, Src: 0x20, Target: module.Ref{Obj: 1}},
+			}},
+		},
+	}
+	type fixup struct {
+		obj int
+		off uint32
+	}
+	var got []fixup
+	p.RangeFixups(func(srcObj int, srcOff uint32, f module.Fixup) bool {
+		got = append(got, fixup{srcObj, srcOff})
+		return true
+	})
+	expect := []fixup{{1, 0x10}, {1, 0x1ffe}, {3, 0x20}}
+	if len(got) != len(expect) {
+		t.Fatalf("RangeFixups: got %d fixups, expected %d", len(got), len(expect))
+	}
+	for i, f := range got {
+		if f != expect[i] {
+			t.Errorf("fixup %d: got %d:0x%x, expected %d:0x%x",
+				i, f.obj, f.off, expect[i].obj, expect[i].off)
+		}
+	}
+	var n int
+	p.RangeFixups(func(int, uint32, module.Fixup) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("RangeFixups: visited %d fixups after stopping, expected 2", n)
+	}
+}
+
+func TestProgramString(t *testing.T) {
+	const expect = "LE program: 3 objects, EIP 1:0x10, ESP 3:0x2000, 3 pages"
+	if s := testProgram().String(); s != expect {
+		t.Errorf("String: got %q, expected %q", s, expect)
+	}
+}
+
+func TestObjFlagString(t *testing.T) {
+	for _, c := range []struct {
+		flags  module.ObjFlag
+		expect string
+	}{
+		{0, "---"},
+		{module.ObjR | module.ObjX | module.Obj32Bit, "r-x 32-bit"},
+		{module.ObjR | module.ObjW | module.ObjPreload | 0x8000, "rw- preload +0x8000"},
+	} {
+		if s := c.flags.String(); s != c.expect {
+			t.Errorf("0x%x: got %q, expected %q", uint32(c.flags), s, c.expect)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	p := module.Program{
+		Objects: []*module.Object{
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x1800, BaseAddress: 0x10000},
+				Data:         make([]byte, 0x1800),
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 0xffe, Target: module.Ref{Obj: 2}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x100, BaseAddress: 0x20000},
+				Data:         []byte("Hello, world!\n"),
+			},
+		},
+	}
+	expect := []module.PageInfo{
+		{Object: 1, Offset: 0, Size: 0x1000, HasFixups: true},
+		{Object: 1, Offset: 0x1000, Size: 0x1000, HasFixups: true},
+		{Object: 2, Offset: 0, Size: 14},
+	}
+	check := func(name string, pages []module.PageInfo) {
+		if !reflect.DeepEqual(pages, expect) {
+			t.Errorf("%s: got %+v, expected %+v", name, pages, expect)
+		}
+	}
+	check("Pages", p.Pages())
+	r, err := openBytes(t, writeBytes(t, &p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	check("Pages after read", r.Pages())
+}
+
+func TestSetEntryStack(t *testing.T) {
+	p := testProgram()
+	if err := p.SetEntry(module.Ref{Obj: 1, Off: 0x20}); err != nil {
+		t.Error("SetEntry:", err)
+	}
+	if e := (module.Ref{Obj: 1, Off: 0x20}); p.EIP != e {
+		t.Errorf("EIP = %v, expected %v", p.EIP, e)
+	}
+	if err := p.SetStack(module.Ref{Obj: 2, Off: 0x100}); err != nil {
+		t.Error("SetStack:", err)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x100}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	for _, r := range []module.Ref{
+		{Obj: 0, Off: 0},
+		{Obj: 4, Off: 0},
+		{Obj: 1, Off: 0x1800},
+		{Obj: 1, Off: -1},
+		{Obj: 2, Off: 0},
+	} {
+		if err := p.SetEntry(r); err == nil {
+			t.Errorf("SetEntry(%v): expected error", r)
+		}
+	}
+	for _, r := range []module.Ref{
+		{Obj: 3, Off: 0x2001},
+		{Obj: 1, Off: 0x10},
+	} {
+		if err := p.SetStack(r); err == nil {
+			t.Errorf("SetStack(%v): expected error", r)
+		}
+	}
+	if e := (module.Ref{Obj: 1, Off: 0x20}); p.EIP != e {
+		t.Errorf("EIP = %v after errors, expected %v", p.EIP, e)
+	}
+	if e := (module.Ref{Obj: 2, Off: 0x100}); p.ESP != e {
+		t.Errorf("ESP = %v after errors, expected %v", p.ESP, e)
+	}
+}
+
+func TestCompareLayout(t *testing.T) {
+	p := testProgram()
+	r, err := openBytes(t, writeBytes(t, p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if err := p.CompareLayout(r); err != nil {
+		t.Errorf("Equal: %v", err)
+	}
+	for _, c := range []struct {
+		change func(p *module.Program)
+		expect string
+	}{
+		{func(p *module.Program) { p.Objects = p.Objects[:2] }, "object count differs: 3 and 2"},
+		{func(p *module.Program) { p.EIP.Off = 0x20 }, "EIP differs: 1:0x10 and 1:0x20"},
+		{func(p *module.Program) { p.ESP.Obj = 2 }, "ESP differs: 3:0x2000 and 2:0x2000"},
+		{func(p *module.Program) { p.Objects[1].VirtualSize = 0x200 }, "object 2 size differs: 0x100 and 0x200"},
+		{func(p *module.Program) { p.Objects[2].BaseAddress = 0 }, "object 3 base address differs: 0x30000 and 0x0"},
+	} {
+		q := testProgram()
+		c.change(q)
+		if err := p.CompareLayout(q); err == nil || err.Error() != c.expect {
+			t.Errorf("Equal: got %v, expected %q", err, c.expect)
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	p, err := openBytes(t, writeBytes(t, testProgram()))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	p.Objects[0].Reserved = 0x1234
+	// The same program, with fixups in a different order and data with
+	// extra zero padding.
+	q := testProgram()
+	f := q.Objects[0].Fixups
+	f[0], f[2] = f[2], f[0]
+	q.Objects[1].Data = append(q.Objects[1].Data, make([]byte, 0x80)...)
+	if reflect.DeepEqual(p, q) {
+		t.Fatal("programs are already identical")
+	}
+	p.Canonicalize()
+	q.Canonicalize()
+	if err := p.CompareLayout(q); err != nil {
+		t.Error("Equal:", err)
+	}
+	if !reflect.DeepEqual(p, q) {
+		t.Errorf("programs differ after Canonicalize:\n%+v\n%+v", p, q)
+	}
+	if !bytes.Equal(writeBytes(t, p), writeBytes(t, q)) {
+		t.Error("programs are written differently after Canonicalize")
+	}
+}
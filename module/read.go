@@ -9,18 +9,6 @@ import (
 	"os"
 )
 
-func readDataSection(fp *os.File, soffset, ssize uint32, doffset, dsize uint32) ([]byte, error) {
-	if doffset < soffset || soffset+ssize-doffset < dsize {
-		return nil, fmt.Errorf("range 0x%x:0x%x is outside section 0x%0x:0x%0x",
-			doffset, uint64(doffset)+uint64(dsize), soffset, soffset+ssize)
-	}
-	data := make([]byte, dsize)
-	if _, err := fp.ReadAt(data, int64(doffset)); err != nil {
-		return nil, err
-	}
-	return data, nil
-}
-
 func deserialize(raw []byte, data interface{}) error {
 	return binary.Read(bytes.NewReader(raw), binary.LittleEndian, data)
 }
@@ -31,17 +19,43 @@ type section struct {
 	size   uint32
 }
 
+// ReadOptions controls how a module is read.
+type ReadOptions struct {
+	// Lenient continues reading past recoverable errors, such as invalid
+	// fixups or truncated data, instead of failing. The errors are collected
+	// in the program's ReadErrors.
+	Lenient bool
+	// VerifyChecksums checks the loader section, fixup section, and per-page
+	// checksums, if they are present.
+	VerifyChecksums bool
+}
+
 type reader struct {
-	fp     *os.File
+	fp     io.ReaderAt
 	fsize  int64
+	base   int64 // offset of the LE/LX header, after the MZ stub if any
+	opts   ReadOptions
+	errs   []error
 	loader section
 	fixup  section
+	pages  []*ObjectPage // object page table, indexed by module page number - 1
+}
+
+// recoverable handles an error which the reader can recover from. In lenient
+// mode, the error is recorded and nil is returned so reading can continue.
+// Otherwise, the error is returned.
+func (r *reader) recoverable(err error) error {
+	if r.opts.Lenient {
+		r.errs = append(r.errs, err)
+		return nil
+	}
+	return err
 }
 
 func (r *reader) setSection(s *section, name string, offset, size uint32) error {
-	if int64(offset) > r.fsize || int64(size) > r.fsize-int64(offset) {
+	if r.base+int64(offset) > r.fsize || int64(size) > r.fsize-r.base-int64(offset) {
 		return fmt.Errorf("%s (offsets 0x%x:0x%x) extends beyond end of file (offset 0x%x)",
-			offset, int64(offset)+int64(size), r.fsize)
+			name, offset, int64(offset)+int64(size), r.fsize)
 	}
 	*s = section{
 		name:   name,
@@ -51,18 +65,48 @@ func (r *reader) setSection(s *section, name string, offset, size uint32) error
 	return nil
 }
 
+// read reads a range of data from the file, which must lie within the given
+// section. Offsets are relative to the LE/LX header.
 func (r *reader) read(s *section, doffset, dsize uint32) ([]byte, error) {
-	if int64(doffset) > r.fsize || int64(dsize) > r.fsize-int64(doffset) {
-		return nil, fmt.Errorf("range 0x%x:0x%x is outside file 0x0:0x%0x",
-			doffset, doffset+dsize, r.fsize)
+	if doffset < s.offset || uint64(doffset)+uint64(dsize) > uint64(s.offset)+uint64(s.size) {
+		return nil, fmt.Errorf("range 0x%x:0x%x is outside %s 0x%x:0x%x",
+			doffset, uint64(doffset)+uint64(dsize), s.name, s.offset, uint64(s.offset)+uint64(s.size))
+	}
+	if r.base+int64(doffset) > r.fsize || int64(dsize) > r.fsize-r.base-int64(doffset) {
+		return nil, fmt.Errorf("range 0x%x:0x%x is outside file 0x0:0x%x",
+			doffset, uint64(doffset)+uint64(dsize), r.fsize)
 	}
 	data := make([]byte, dsize)
-	if _, err := r.fp.ReadAt(data, int64(doffset)); err != nil {
-		return nil, err
+	if _, err := r.fp.ReadAt(data, r.base+int64(doffset)); err != nil {
+		return nil, fmt.Errorf("%s data at offset 0x%x: %v", s.name, doffset, err)
 	}
 	return data, nil
 }
 
+// readHeaderOffset finds the LE/LX header. If the file starts with an MZ
+// stub, the header is at the offset in e_lfanew, and otherwise it is at the
+// start of the file.
+func (r *reader) readHeaderOffset() error {
+	data := make([]byte, 0x40)
+	n, err := r.fp.ReadAt(data, 0)
+	if n < 2 || string(data[:2]) != "MZ" {
+		// Not a stub, the signature is checked with the rest of the header.
+		return nil
+	}
+	if n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("could not read MZ header: %v", err)
+	}
+	off := int64(binary.LittleEndian.Uint32(data[0x3c:]))
+	if off < int64(len(data)) || off > r.fsize {
+		return fmt.Errorf("MZ header has invalid e_lfanew 0x%x (file size 0x%x)", off, r.fsize)
+	}
+	r.base = off
+	return nil
+}
+
 func (r *reader) readProgramHeader() (h ProgramHeader, err error) {
 	// Read program header. (loader.asm:load_header)
 	// DOS/32A assembly note:
@@ -75,7 +119,7 @@ func (r *reader) readProgramHeader() (h ProgramHeader, err error) {
 	// _app_siz_fixrecstab = 0x30 FixupSectionSize
 	// _app_siz_lastpage   = 0x2c LastPageSize
 	data := make([]byte, 0xac)
-	if _, err := r.fp.ReadAt(data, 0); err != nil {
+	if _, err := r.fp.ReadAt(data, r.base); err != nil {
 		if err == io.EOF {
 			return h, io.ErrUnexpectedEOF
 		}
@@ -106,32 +150,67 @@ func (r *reader) readObjectTable(p *Program) error {
 }
 
 func (r *reader) readObjectPageTable(p *Program) error {
+	// LE entries are a 24-bit big-endian page number followed by the page
+	// type. LX entries are a 32-bit data offset, a 16-bit data size, and
+	// 16-bit flags, all little-endian.
+	var entrySize uint64 = 4
+	if p.IsLX() {
+		entrySize = 8
+	}
 	var count uint32
 	for i, obj := range p.Objects {
 		if obj.NumPageTableEntries != 0 && obj.PageTableIndex != 0 {
 			ofirst := uint64(obj.PageTableIndex - 1)
 			ocount := uint64(obj.NumPageTableEntries)
 			oend := ofirst + ocount
-			if oend*4 > uint64(^uint32(0)) {
-				return fmt.Errorf("object %d has invalid page table range", i+1)
+			if oend*entrySize > uint64(^uint32(0)) {
+				if err := r.recoverable(fmt.Errorf(
+					"object %d has invalid page table range", i+1)); err != nil {
+					return err
+				}
+				obj.NumPageTableEntries = 0
+				continue
 			}
 			if uint32(oend) > count {
 				count = uint32(oend)
 			}
 		}
 	}
-	data, err := r.read(&r.loader, p.ObjectPageTableOffset, count*4)
-	if err != nil {
-		return err
+	// Each entry takes space in the file, so a table with more entries than
+	// would fit is invalid. Check before allocating anything for it.
+	if uint64(count)*entrySize > uint64(r.fsize) {
+		return fmt.Errorf("page table has %d entries, more than fit in the file (size 0x%x)",
+			count, r.fsize)
 	}
-	hdrs := make([]ObjectPageHeader, count)
-	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, hdrs); err != nil {
+	data, err := r.read(&r.loader, p.ObjectPageTableOffset, count*uint32(entrySize))
+	if err != nil {
 		return err
 	}
 	table := make([]*ObjectPage, count)
-	for i, h := range hdrs {
-		table[i] = &ObjectPage{ObjectPageHeader: h}
+	if p.IsLX() {
+		for i := range table {
+			e := data[i*8:]
+			table[i] = &ObjectPage{
+				ObjectPageHeader: ObjectPageHeader{
+					// LX has no fixup page index, fixups are indexed by
+					// the module page number.
+					FixupPageIndex: uint16(i + 1),
+					Type:           PageType(binary.LittleEndian.Uint16(e[6:])),
+				},
+				DataOffset: binary.LittleEndian.Uint32(e),
+				DataSize:   binary.LittleEndian.Uint16(e[4:]),
+			}
+		}
+	} else {
+		hdrs := make([]ObjectPageHeader, count)
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, hdrs); err != nil {
+			return err
+		}
+		for i, h := range hdrs {
+			table[i] = &ObjectPage{ObjectPageHeader: h}
+		}
 	}
+	r.pages = table
 	for _, obj := range p.Objects {
 		if obj.NumPageTableEntries != 0 && obj.PageTableIndex != 0 {
 			obj.Pages = table[obj.PageTableIndex-1 : obj.PageTableIndex-1+obj.NumPageTableEntries]
@@ -172,63 +251,110 @@ func (r *reader) readFixupPageTable(p *Program) ([]uint32, error) {
 
 var errShortFixup = errors.New("unexpected end of table")
 
-func readFixup(data []byte) (n int, fix Fixup, err error) {
-	if len(data) < 7 {
-		return 0, Fixup{}, errShortFixup
+// readFixup reads a fixup record. A source list record is expanded into one
+// fixup for each source offset, without the source list flag.
+func readFixup(data []byte) (n int, fixes []Fixup, err error) {
+	if len(data) < 6 {
+		return 0, nil, errShortFixup
 	}
 	src := data[0]
 	flags := data[1]
-	srcoff := int16(binary.LittleEndian.Uint16(data[2:]))
-	if src&0x20 != 0 {
-		// Also unimplemented by DOS/32A
-		return 0, Fixup{}, fmt.Errorf("source list fixups unimplemented (srctype = 0x%02x)", src)
+	switch t := src & 0x0f; t {
+	case 0x00, 0x02, 0x03, 0x05, 0x06, 0x07, 0x08:
+	default:
+		return 0, nil, fmt.Errorf("unimplemented source type %d", t)
 	}
 	if flags&0x03 != 0 {
-		return 0, Fixup{}, fmt.Errorf("imported fixups unimplemented (flags = 0x%02x)", flags)
-	}
-	if flags&0x04 != 0 {
-		return 0, Fixup{}, fmt.Errorf("additive fixups unimplemented (flags = 0x%02x)", flags)
+		return 0, nil, fmt.Errorf("imported fixups unimplemented (flags = 0x%02x)", flags)
+	}
+	// The source offset is a signed 16-bit offset from the start of the page,
+	// for every source type. It is negative for a fixup which starts on the
+	// previous page. For a source list, it is replaced by an 8-bit count, and
+	// the list of source offsets follows the rest of the record.
+	var srcoff int16
+	var srccount int
+	if src&0x20 != 0 {
+		srccount = int(data[2])
+		data = data[3:]
+		n = 3
+	} else {
+		if len(data) < 7 {
+			return 0, nil, errShortFixup
+		}
+		srcoff = int16(binary.LittleEndian.Uint16(data[2:]))
+		data = data[4:]
+		n = 4
 	}
 	var objnum uint16
 	if flags&0x40 != 0 {
 		// 16-bit object number
-		objnum = binary.LittleEndian.Uint16(data[4:])
-		data = data[6:]
-		n = 6
+		if len(data) < 2 {
+			return 0, nil, errShortFixup
+		}
+		objnum = binary.LittleEndian.Uint16(data)
+		data = data[2:]
+		n += 2
 	} else {
-		objnum = uint16(data[4])
-		data = data[5:]
-		n = 5
-	}
-	if t := src & 0x0f; t > 8 {
-		return 0, Fixup{}, fmt.Errorf("unimplemented source type %d", t)
+		objnum = uint16(data[0])
+		data = data[1:]
+		n++
 	}
 	var target int32
 	if flags&0x10 != 0 {
 		if len(data) < 4 {
-			return 0, Fixup{}, errShortFixup
+			return 0, nil, errShortFixup
 		}
 		target = int32(binary.LittleEndian.Uint32(data))
 		data = data[4:]
 		n += 4
 	} else {
 		if len(data) < 2 {
-			return 0, Fixup{}, errShortFixup
+			return 0, nil, errShortFixup
 		}
 		target = int32(binary.LittleEndian.Uint16(data))
 		data = data[2:]
 		n += 2
 	}
-	fix = Fixup{
-		SrcType: SrcType(src),
+	var add int32
+	if flags&0x04 != 0 {
+		// Additive fixup, 32-bit value if flag 0x20 is set.
+		if flags&0x20 != 0 {
+			if len(data) < 4 {
+				return 0, nil, errShortFixup
+			}
+			add = int32(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+			n += 4
+		} else {
+			if len(data) < 2 {
+				return 0, nil, errShortFixup
+			}
+			add = int32(binary.LittleEndian.Uint16(data))
+			data = data[2:]
+			n += 2
+		}
+	}
+	fix := Fixup{
+		SrcType: SrcType(src &^ 0x20),
 		Src:     int32(srcoff),
 		Target: Ref{
 			Obj: int32(objnum),
 			Off: target,
 		},
-		Add: 0,
+		Add: add,
+	}
+	if src&0x20 == 0 {
+		return n, []Fixup{fix}, nil
+	}
+	if len(data) < 2*srccount {
+		return 0, nil, errShortFixup
 	}
-	return n, fix, nil
+	fixes = make([]Fixup, srccount)
+	for i := range fixes {
+		fixes[i] = fix
+		fixes[i].Src = int32(int16(binary.LittleEndian.Uint16(data[2*i:])))
+	}
+	return n + 2*srccount, fixes, nil
 }
 
 func (r *reader) readFixupRecords(p *Program, pageTable []uint32) error {
@@ -250,61 +376,293 @@ func (r *reader) readFixupRecords(p *Program, pageTable []uint32) error {
 		var fixups []Fixup
 		fdata := data[off0:off1]
 		for len(fdata) != 0 {
-			n, fix, err := readFixup(fdata)
+			n, fixes, err := readFixup(fdata)
 			if err != nil {
-				return fmt.Errorf("invalid fixup at file offset 0x%0x: %v",
-					p.FixupRecordOffset+off1-uint32(len(fdata)), err)
+				if err := r.recoverable(fmt.Errorf("invalid fixup at file offset 0x%0x: %v",
+					p.FixupRecordOffset+off1-uint32(len(fdata)), err)); err != nil {
+					return err
+				}
+				break
 			}
-			fixups = append(fixups, fix)
+			fixups = append(fixups, fixes...)
 			fdata = fdata[n:]
 		}
 		pageFixups[i] = fixups
 	}
+	bits := p.pageBits()
 	for _, obj := range p.Objects {
-		for _, p := range obj.Pages {
-			if p.FixupPageIndex != 0 {
-				p.Fixups = pageFixups[p.FixupPageIndex-1]
+		for i, p := range obj.Pages {
+			if p.FixupPageIndex == 0 {
+				continue
+			}
+			p.Fixups = pageFixups[p.FixupPageIndex-1]
+			base := int32(i << bits)
+			for _, f := range p.Fixups {
+				if f.Src < 0 {
+					// Copy of a fixup which starts on the previous page.
+					continue
+				}
+				f.Src += base
+				obj.Fixups = append(obj.Fixups, f)
 			}
 		}
 	}
 	return nil
 }
 
+// errPagesNoSize returns the error for an object which has pages, but no size
+// to hold their data.
+func errPagesNoSize(obj *Object) error {
+	return fmt.Errorf("object has %d pages but its virtual size is zero", obj.NumPageTableEntries)
+}
+
+// expandIterated expands the iteration records of an iterated page. Each
+// record is a 16-bit repeat count, a 16-bit data length, and the data, which
+// is repeated count times. A record with a zero count, or fewer than four
+// bytes left, ends the page. The result is at most size bytes.
+func expandIterated(src []byte, size int) ([]byte, error) {
+	var page []byte
+	var pos int
+	for len(src) >= 4 {
+		count := int(binary.LittleEndian.Uint16(src))
+		n := int(binary.LittleEndian.Uint16(src[2:]))
+		if count == 0 {
+			break
+		}
+		if len(src)-4 < n {
+			return nil, fmt.Errorf("iteration record at 0x%x has %d bytes of data, only %d remain",
+				pos, n, len(src)-4)
+		}
+		if len(page)+count*n > size {
+			return nil, fmt.Errorf("iterated data expands to more than 0x%x bytes", size)
+		}
+		for i := 0; i < count; i++ {
+			page = append(page, src[4:4+n]...)
+		}
+		src = src[4+n:]
+		pos += 4 + n
+	}
+	return page, nil
+}
+
+// checkPageType returns an error if a page has a type which the reader does
+// not know how to decode.
+func checkPageType(i int, p *ObjectPage) error {
+	if p.Type > PageZeroed {
+		return fmt.Errorf("page %d has unsupported page type %d", i, p.Type)
+	}
+	return nil
+}
+
+// readObjectData reads the data for an object starting at the given file
+// offset. Returns the number of bytes the object's pages occupy in the file,
+// even if an error occurs. If the data is truncated, the data which is present
+// is still read.
 func (r *reader) readObjectData(obj *Object, offset, lastPageSize uint32) (uint32, error) {
 	if obj.NumPageTableEntries == 0 {
 		return 0, nil
 	}
-	dataSize := ((obj.NumPageTableEntries - 1) << PageBits) + lastPageSize
+	pageSize := ((obj.NumPageTableEntries - 1) << PageBits) + lastPageSize
+	if obj.VirtualSize == 0 {
+		return pageSize, errPagesNoSize(obj)
+	}
+	for i, p := range obj.Pages {
+		if err := checkPageType(i, p); err != nil {
+			return pageSize, err
+		}
+	}
+	dataSize := pageSize
 	if obj.VirtualSize < dataSize {
 		dataSize = obj.VirtualSize
 	}
-	rem := r.fsize - int64(offset)
-	if int64(dataSize) > rem {
-		return 0, fmt.Errorf(
+	var err error
+	readSize := int64(dataSize)
+	if rem := r.fsize - int64(offset); readSize > rem {
+		err = fmt.Errorf(
 			"object data (offsets 0x%x:0x%x) extends past end of file (offset 0x%x)",
 			offset, int64(offset)+int64(dataSize), r.fsize)
+		readSize = rem
+		if readSize < 0 {
+			readSize = 0
+		}
 	}
 	data := make([]byte, dataSize)
-	if _, err := r.fp.ReadAt(data, int64(offset)); err != nil {
-		return 0, err
+	if _, err := r.fp.ReadAt(data[:readSize], int64(offset)); err != nil {
+		return pageSize, fmt.Errorf("page data at offset 0x%x: %v", offset, err)
+	}
+	// Iterated pages occupy the same space in the file as other pages, but
+	// hold iteration records instead of the page contents.
+	for i, p := range obj.Pages {
+		if p.Type != PageIterated {
+			continue
+		}
+		start := uint32(i) << PageBits
+		size := uint32(PageSize)
+		if i == len(obj.Pages)-1 {
+			size = lastPageSize
+		}
+		if int64(offset)+int64(start+size) > r.fsize {
+			return pageSize, fmt.Errorf("iterated page %d extends past end of file", i)
+		}
+		src := make([]byte, size)
+		if _, err := r.fp.ReadAt(src, int64(offset+start)); err != nil {
+			return pageSize, fmt.Errorf("iterated page %d: %v", i, err)
+		}
+		page, err := expandIterated(src, PageSize)
+		if err != nil {
+			return pageSize, fmt.Errorf("iterated page %d: %v", i, err)
+		}
+		if start < dataSize {
+			n := copy(data[start:], page)
+			clear(data[start+uint32(n) : min(start+PageSize, dataSize)])
+		}
+	}
+	obj.Data = data
+	return pageSize, err
+}
+
+// readObjectDataLX reads the data for an object in an LX module, where each
+// page's data is located by its page table entry. Zeroed and invalid pages are
+// filled with zeroes. Each page holds 1<<bits bytes of the object. If a page
+// cannot be read, the remaining pages are still read and the first error is
+// returned. Iterated pages are located from iterPages instead of dataPages, if
+// it is nonzero.
+func (r *reader) readObjectDataLX(obj *Object, dataPages, iterPages, shift uint32, bits uint) error {
+	if len(obj.Pages) != 0 && obj.VirtualSize == 0 {
+		return errPagesNoSize(obj)
+	}
+	var end uint32
+	for i, p := range obj.Pages {
+		if err := checkPageType(i, p); err != nil {
+			return err
+		}
+		switch p.Type {
+		case PageLegal, PageIterated:
+		default:
+			continue
+		}
+		if uint32(p.DataSize) > 1<<bits {
+			return fmt.Errorf("page %d data size 0x%x is larger than a page", i, p.DataSize)
+		}
+		e := uint32(i)<<bits + uint32(p.DataSize)
+		if p.Type == PageIterated {
+			// The expanded size is not known until the page is read.
+			e = uint32(i+1) << bits
+		}
+		if e > end {
+			end = e
+		}
+	}
+	if obj.VirtualSize < end {
+		end = obj.VirtualSize
+	}
+	data := make([]byte, end)
+	var rerr error
+	for i, p := range obj.Pages {
+		start := uint32(i) << bits
+		if (p.Type != PageLegal && p.Type != PageIterated) || start >= end {
+			continue
+		}
+		offset := int64(dataPages) + int64(p.DataOffset)<<shift
+		if p.Type == PageIterated && iterPages != 0 {
+			offset = int64(iterPages) + int64(p.DataOffset)<<shift
+		}
+		page := make([]byte, p.DataSize)
+		if offset+int64(len(page)) > r.fsize {
+			if rerr == nil {
+				rerr = fmt.Errorf(
+					"page %d data (offsets 0x%x:0x%x) extends past end of file (offset 0x%x)",
+					i, offset, offset+int64(len(page)), r.fsize)
+			}
+			continue
+		}
+		if _, err := r.fp.ReadAt(page, offset); err != nil {
+			return fmt.Errorf("page %d data at offset 0x%x: %v", i, offset, err)
+		}
+		if p.Type == PageIterated {
+			var err error
+			if page, err = expandIterated(page, 1<<bits); err != nil {
+				return fmt.Errorf("iterated page %d: %v", i, err)
+			}
+		}
+		copy(data[start:], page)
 	}
 	obj.Data = data
-	return dataSize, nil
+	return rerr
+}
+
+// readData reads the data for every object in the program.
+func (r *reader) readData(p *Program) error {
+	if p.IsLX() {
+		for i, obj := range p.Objects {
+			if err := r.readObjectDataLX(obj, p.DataPagesOffset, p.ObjectIterPageTableOffset, p.LastPageSize, p.pageBits()); err != nil {
+				if err := r.recoverable(fmt.Errorf("could not read object %d data: %v", i+1, err)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	var lastObject int
+	for i, obj := range p.Objects {
+		if obj.NumPageTableEntries != 0 {
+			lastObject = i
+		}
+	}
+	dataOffset := p.DataPagesOffset
+	for i, obj := range p.Objects {
+		var lastPageSize uint32 = PageSize
+		if i == lastObject {
+			lastPageSize = p.LastPageSize
+		}
+		n, err := r.readObjectData(obj, dataOffset, lastPageSize)
+		if err != nil {
+			if err := r.recoverable(fmt.Errorf("could not read object %d data: %v", i+1, err)); err != nil {
+				return err
+			}
+		}
+		dataOffset += n
+	}
+	return nil
 }
 
 func (r *reader) readProgram() (*Program, error) {
+	if err := r.readHeaderOffset(); err != nil {
+		return nil, err
+	}
 	h, err := r.readProgramHeader()
 	if err != nil {
 		return nil, fmt.Errorf("could not read program header: %v", err)
 	}
-	if !h.IsLE() {
-		return nil, fmt.Errorf("unknown program signature %q (expected LE)", h.Signature[:])
+	if !h.IsLE() && !h.IsLX() {
+		return nil, fmt.Errorf("unknown program signature %q (expected LE or LX)", h.Signature[:])
 	}
 	if h.PageSize != PageSize {
-		return nil, fmt.Errorf("unsupported page size: %d", h.PageSize)
+		// LX modules may have larger pages.
+		if _, ok := lxPageBits(h.PageSize); !ok || !h.IsLX() {
+			return nil, fmt.Errorf("unsupported page size: %d", h.PageSize)
+		}
 	}
-	if h.LastPageSize == 0 || h.LastPageSize > PageSize {
-		return nil, fmt.Errorf("invalid last page size: %d", h.LastPageSize)
+	if h.IsLX() {
+		// In LX modules, this field is the page offset shift.
+		if h.LastPageSize >= 32 {
+			return nil, fmt.Errorf("invalid page offset shift: %d", h.LastPageSize)
+		}
+	} else {
+		if h.LastPageSize == 0 && h.ModuleNumPages != 0 {
+			// Some writers follow the MZ convention, where zero means that
+			// the last page is full. Accept this if the file has data for a
+			// full last page.
+			full := int64(h.DataPagesOffset) + int64(h.ModuleNumPages)<<PageBits
+			if full <= r.fsize {
+				h.LastPageSize = PageSize
+			}
+		}
+		if (h.LastPageSize == 0 && h.ModuleNumPages != 0) || h.LastPageSize > PageSize {
+			// A module with no pages, like an empty program, has no last
+			// page.
+			return nil, fmt.Errorf("invalid last page size: %d", h.LastPageSize)
+		}
 	}
 	const maxObjects = 64
 	if h.NumObjects > 64 {
@@ -328,40 +686,147 @@ func (r *reader) readProgram() (*Program, error) {
 		return nil, fmt.Errorf("could not read object table: %v", err)
 	}
 	if err := r.readObjectPageTable(&p); err != nil {
-		return nil, fmt.Errorf("could not read object page table: %v", err)
+		if err := r.recoverable(fmt.Errorf("could not read object page table: %v", err)); err != nil {
+			return nil, err
+		}
 	}
 	fixupPageTable, err := r.readFixupPageTable(&p)
 	if err != nil {
-		return nil, fmt.Errorf("could not read fixup page table: %v", err)
+		if err := r.recoverable(fmt.Errorf("could not read fixup page table: %v", err)); err != nil {
+			return nil, err
+		}
 	}
 	if err := r.readFixupRecords(&p, fixupPageTable); err != nil {
-		return nil, fmt.Errorf("could not read fixup records: %v", err)
+		if err := r.recoverable(fmt.Errorf("could not read fixup records: %v", err)); err != nil {
+			return nil, err
+		}
 	}
-	var lastObject int
-	for i, obj := range p.Objects {
-		if obj.NumPageTableEntries != 0 {
-			lastObject = i
+	if err := r.readData(&p); err != nil {
+		return nil, err
+	}
+	if r.opts.VerifyChecksums {
+		if err := r.verifyChecksums(&p); err != nil {
+			return nil, err
 		}
 	}
-	dataOffset := h.DataPagesOffset
-	for i, obj := range p.Objects {
-		var lastPageSize uint32 = PageSize
-		if i == lastObject {
-			lastPageSize = h.LastPageSize
+	p.ReadErrors = r.errs
+	return &p, nil
+}
+
+// A PageChecksumError is a data page whose checksum does not match the
+// checksum in the per-page checksum table.
+type PageChecksumError struct {
+	ModulePage int    // 1-based index of the page in the module
+	Object     int    // 1-based index of the object containing the page, or 0
+	Page       int    // 1-based index of the page within the object
+	Stored     uint32 // checksum in the checksum table
+	Computed   uint32 // checksum of the page's data
+}
+
+func (e *PageChecksumError) Error() string {
+	msg := fmt.Sprintf("page %d checksum 0x%08x does not match computed checksum 0x%08x",
+		e.ModulePage, e.Stored, e.Computed)
+	if e.Object != 0 {
+		msg += fmt.Sprintf(" (object %d page %d)", e.Object, e.Page)
+	}
+	return msg
+}
+
+// pageObject returns the 1-based index of the object containing a 1-based
+// module page and the 1-based index of the page within the object. The object
+// is 0 if no object contains the page.
+func pageObject(p *Program, page uint32) (obj, objPage int) {
+	for i, o := range p.Objects {
+		if page >= o.PageTableIndex && page-o.PageTableIndex < o.NumPageTableEntries {
+			return i + 1, int(page-o.PageTableIndex) + 1
 		}
-		n, err := r.readObjectData(obj, dataOffset, lastPageSize)
+	}
+	return 0, 0
+}
+
+// verifyChecksums checks the section and per-page checksums which are present
+// in the module.
+func (r *reader) verifyChecksums(p *Program) error {
+	check := func(name string, stored uint32, data []byte) error {
+		if sum := checksum(data); sum != stored {
+			return r.recoverable(fmt.Errorf("%s checksum 0x%08x does not match computed checksum 0x%08x",
+				name, stored, sum))
+		}
+		return nil
+	}
+	for _, c := range []struct {
+		s   *section
+		sum uint32
+	}{{&r.loader, p.LoaderSectionChecksum}, {&r.fixup, p.FixupSectionChecksum}} {
+		if c.sum == 0 {
+			continue
+		}
+		data, err := r.read(c.s, c.s.offset, c.s.size)
 		if err != nil {
-			return nil, fmt.Errorf("could not read object %d data: %v", i+1, err)
+			return fmt.Errorf("could not read %s to verify checksum: %v", c.s.name, err)
+		}
+		if err := check(c.s.name, c.sum, data); err != nil {
+			return err
 		}
-		dataOffset += n
 	}
-	return &p, nil
+	if p.PerPageChecksumOffset == 0 || p.ModuleNumPages == 0 {
+		return nil
+	}
+	sums, err := r.read(&r.loader, p.PerPageChecksumOffset, p.ModuleNumPages*4)
+	if err != nil {
+		return r.recoverable(fmt.Errorf("could not read per-page checksums: %v", err))
+	}
+	for i := uint32(0); i < p.ModuleNumPages; i++ {
+		size := uint32(PageSize)
+		if i == p.ModuleNumPages-1 {
+			size = p.LastPageSize
+		}
+		offset := int64(p.DataPagesOffset) + int64(i)<<PageBits
+		if p.IsLX() {
+			if int(i) >= len(r.pages) {
+				break
+			}
+			pg := r.pages[i]
+			size = 0
+			if pg.Type == PageLegal || pg.Type == PageIterated {
+				size = uint32(pg.DataSize)
+			}
+			offset = int64(p.DataPagesOffset) + int64(pg.DataOffset)<<p.LastPageSize
+		}
+		if offset+int64(size) > r.fsize {
+			break
+		}
+		data := make([]byte, size)
+		if _, err := r.fp.ReadAt(data, offset); err != nil {
+			return fmt.Errorf("could not read page %d to verify checksum: %v", i+1, err)
+		}
+		stored := binary.LittleEndian.Uint32(sums[i*4:])
+		if sum := checksum(data); sum != stored {
+			obj, page := pageObject(p, i+1)
+			err := &PageChecksumError{
+				ModulePage: int(i + 1),
+				Object:     obj,
+				Page:       page,
+				Stored:     stored,
+				Computed:   sum,
+			}
+			if err := r.recoverable(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Open opens that named file with os.Open and reads the LE module structure.
 func Open(name string) (*Program, error) {
-	// We follow the same way that DOS/32A reads the executables, so we can be
-	// as compatible as possible.
+	return OpenWith(name, nil)
+}
+
+// OpenWith opens the named file with os.Open and reads the LE module
+// structure, using the given options. If opts is nil, the default options are
+// used.
+func OpenWith(name string, opts *ReadOptions) (*Program, error) {
 	fp, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -371,9 +836,27 @@ func Open(name string) (*Program, error) {
 	if err != nil {
 		return nil, err
 	}
+	return OpenReaderAtWith(fp, st.Size(), opts)
+}
+
+// OpenReaderAt reads the LE module structure from r, which must contain the
+// entire file. The size must be the size of the file, since the reader checks
+// that offsets in the headers lie within it.
+func OpenReaderAt(r io.ReaderAt, size int64) (*Program, error) {
+	return OpenReaderAtWith(r, size, nil)
+}
+
+// OpenReaderAtWith reads the LE module structure from r, like OpenReaderAt,
+// using the given options. If opts is nil, the default options are used.
+func OpenReaderAtWith(fp io.ReaderAt, size int64, opts *ReadOptions) (*Program, error) {
+	// We follow the same way that DOS/32A reads the executables, so we can be
+	// as compatible as possible.
 	r := reader{
 		fp:    fp,
-		fsize: st.Size(),
+		fsize: size,
+	}
+	if opts != nil {
+		r.opts = *opts
 	}
 	return r.readProgram()
 }
@@ -0,0 +1,622 @@
+package module_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"moria.us/elf2dos/internal/faulttest"
+	"moria.us/elf2dos/module"
+)
+
+// openBytes reads a module from the given data.
+func openBytes(t *testing.T, data []byte) (*module.Program, error) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.le")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return module.Open(name)
+}
+
+// writeBytes returns the program, written in LE format.
+func writeBytes(t *testing.T, p *module.Program) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal("Write:", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadIteratedPage(t *testing.T) {
+	data := writeBytes(t, testProgram())
+	le := binary.LittleEndian
+	// Mark the second page of the first object as iterated, and replace its
+	// contents with "abcd" repeated 0x100 times, followed by a record with a
+	// zero count, which ends the page.
+	h := data[le.Uint32(data[0x48:]):]
+	h[4+3] = byte(module.PageIterated)
+	page := data[le.Uint32(data[0x80:])+module.PageSize:][:module.PageSize]
+	for i := range page {
+		page[i] = 0xff
+	}
+	copy(page, []byte{0x00, 0x01, 4, 0, 'a', 'b', 'c', 'd', 0, 0})
+	p, err := openBytes(t, data)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	expect := testProgram().Objects[0].Data
+	copy(expect[module.PageSize:], bytes.Repeat([]byte("abcd"), 0x100))
+	clear(expect[module.PageSize+0x400:])
+	if d := p.Objects[0].Data; !bytes.Equal(d, expect) {
+		t.Errorf("data differs at page 1:\n%q", d[module.PageSize:module.PageSize+0x410])
+	}
+
+	// A record which expands past the end of the page.
+	copy(page, []byte{0x01, 0x04, 4, 0})
+	_, err = openBytes(t, data)
+	if err == nil || !strings.Contains(err.Error(),
+		"object 1 data: iterated page 1: iterated data expands to more than 0x1000 bytes") {
+		t.Errorf("Open: got error %v, expected iterated data too large", err)
+	}
+
+	// A page type which the reader does not know.
+	h[4+3] = 5
+	_, err = openBytes(t, data)
+	if err == nil || !strings.Contains(err.Error(), "object 1 data: page 1 has unsupported page type 5") {
+		t.Errorf("Open: got error %v, expected unsupported page type", err)
+	}
+}
+
+func TestReadFixupSourceOffset(t *testing.T) {
+	p := testProgram()
+	p.Objects[0].Fixups = []module.Fixup{
+		{SrcType: 0x00, Src: 0x10, Target: module.Ref{Obj: 2, Off: 1}},  // byte
+		{SrcType: 0x05, Src: 0x7ff, Target: module.Ref{Obj: 2, Off: 2}}, // word
+		{SrcType: 0x07, Src: 0xffd, Target: module.Ref{Obj: 2, Off: 3}}, // dword, crosses page
+		{SrcType: 0x08, Src: 0x1000, Target: module.Ref{Obj: 2, Off: 4}},
+	}
+	r, err := openBytes(t, writeBytes(t, p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	obj := r.Objects[0]
+	if !reflect.DeepEqual(obj.Fixups, p.Objects[0].Fixups) {
+		t.Errorf("object fixups:\ngot      %+v\nexpected %+v", obj.Fixups, p.Objects[0].Fixups)
+	}
+	// Page-relative offsets, including the negative offset on the second page
+	// for the fixup which crosses the page boundary.
+	var got [][]int32
+	for _, pg := range obj.Pages {
+		var offs []int32
+		for _, f := range pg.Fixups {
+			offs = append(offs, f.Src)
+		}
+		got = append(got, offs)
+	}
+	expect := [][]int32{{0x10, 0x7ff, 0xffd}, {-3, 0}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("page fixup offsets: got %v, expected %v", got, expect)
+	}
+
+	// Source types 1 and 4 are reserved.
+	for _, st := range []module.SrcType{1, 4, 9} {
+		p.Objects[0].Fixups = []module.Fixup{{SrcType: st, Src: 0x10, Target: module.Ref{Obj: 2}}}
+		_, err := openBytes(t, writeBytes(t, p))
+		if err == nil || !strings.Contains(err.Error(), "unimplemented source type") {
+			t.Errorf("source type %d: got error %v, expected unimplemented source type", st, err)
+		}
+	}
+}
+
+func TestReadFixupLargeObject(t *testing.T) {
+	p := testProgram()
+	p.Objects[0].Fixups = []module.Fixup{
+		{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 0x123, Off: 4}},
+		{SrcType: module.SrcOffset32, Src: 0x20, Target: module.Ref{Obj: 0x1ff, Off: 0x12345}, Add: -1},
+		{SrcType: module.SrcOffset32, Src: 0x30, Target: module.Ref{Obj: 0xff, Off: 8}},
+	}
+	r, err := openBytes(t, writeBytes(t, p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if !reflect.DeepEqual(r.Objects[0].Fixups, p.Objects[0].Fixups) {
+		t.Errorf("object fixups:\ngot      %+v\nexpected %+v", r.Objects[0].Fixups, p.Objects[0].Fixups)
+	}
+}
+
+func TestReadAdditiveFixup(t *testing.T) {
+	p := testProgram()
+	p.Objects[0].Fixups = []module.Fixup{
+		{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 2, Off: 4}, Add: 0x7fff},
+		{SrcType: module.SrcOffset32, Src: 0x20, Target: module.Ref{Obj: 2, Off: 4}, Add: 0x8000},
+		{SrcType: module.SrcRelative32, Src: 0x30, Target: module.Ref{Obj: 2, Off: 4}, Add: -8},
+	}
+	data := writeBytes(t, p)
+	// The first record uses a 16-bit additive value: flags 0x04.
+	if rec := data[binary.LittleEndian.Uint32(data[0x6c:]):]; rec[1] != 0x04 {
+		t.Errorf("first fixup record has flags 0x%02x, expected 0x04", rec[1])
+	}
+	r, err := openBytes(t, data)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if !reflect.DeepEqual(r.Objects[0].Fixups, p.Objects[0].Fixups) {
+		t.Errorf("object fixups:\ngot      %+v\nexpected %+v", r.Objects[0].Fixups, p.Objects[0].Fixups)
+	}
+}
+
+func TestReadEmptyProgram(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := new(module.Program).WriteWith(&buf, &module.WriteOptions{Strict: strict}); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		if strict {
+			for _, e := range checkConformance(buf.Bytes()) {
+				// An empty program has nowhere for EIP and ESP to point.
+				if !strings.HasPrefix(e, "EIP") && !strings.HasPrefix(e, "ESP") {
+					t.Error(e)
+				}
+			}
+		}
+		p, err := openBytes(t, buf.Bytes())
+		if err != nil {
+			t.Fatalf("strict=%t: Open: %v", strict, err)
+		}
+		if len(p.Objects) != 0 || p.NumObjects != 0 || p.ModuleNumPages != 0 {
+			t.Errorf("strict=%t: read %v, expected empty program", strict, p)
+		}
+	}
+}
+
+func TestReadFixupRecordsOutsideSection(t *testing.T) {
+	data := writeBytes(t, testProgram())
+	le := binary.LittleEndian
+	// Make the last page's fixups extend into the data pages.
+	npage := le.Uint32(data[0x14:])
+	last := data[le.Uint32(data[0x68:])+npage*4:]
+	le.PutUint32(last, le.Uint32(last)+0x100)
+	_, err := openBytes(t, data)
+	if err == nil {
+		t.Fatal("Open: expected error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "could not read fixup records: ") ||
+		!strings.Contains(msg, "is outside fixup section") {
+		t.Errorf("Open: unexpected error: %v", err)
+	}
+}
+
+func TestReadLenient(t *testing.T) {
+	p := testProgram()
+	// Invalid fixup in the second object, and truncated data.
+	p.Objects[1].Fixups = append(p.Objects[1].Fixups,
+		module.Fixup{SrcType: 4, Src: 0x50, Target: module.Ref{Obj: 1}})
+	data := writeBytes(t, p)
+	data = data[:len(data)-4]
+	if _, err := openBytes(t, data); err == nil {
+		t.Fatal("Open: expected error")
+	}
+	name := filepath.Join(t.TempDir(), "test.le")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := module.OpenWith(name, &module.ReadOptions{Lenient: true})
+	if err != nil {
+		t.Fatal("OpenWith:", err)
+	}
+	if len(r.ReadErrors) != 2 {
+		t.Fatalf("got errors %v, expected 2 errors", r.ReadErrors)
+	}
+	if msg := r.ReadErrors[0].Error(); !strings.Contains(msg, "unimplemented source type 4") {
+		t.Errorf("error 0: %s", msg)
+	}
+	if msg := r.ReadErrors[1].Error(); !strings.HasPrefix(msg, "could not read object 2 data") {
+		t.Errorf("error 1: %s", msg)
+	}
+	// Everything before the errors is still read.
+	if !reflect.DeepEqual(r.Objects[0].Fixups, p.Objects[0].Fixups) {
+		t.Errorf("object 1 fixups = %v, expected %v", r.Objects[0].Fixups, p.Objects[0].Fixups)
+	}
+	if f := r.Objects[1].Fixups; len(f) != 1 || f[0] != p.Objects[1].Fixups[0] {
+		t.Errorf("object 2 fixups = %v, expected %v", f, p.Objects[1].Fixups[:1])
+	}
+	if d := r.Objects[1].Data; !bytes.HasPrefix(d, p.Objects[1].Data[:10]) {
+		t.Errorf("object 2 data = %q", d)
+	}
+	s := dumpText(r, nil)
+	if !strings.Contains(s, "Object 3:") || !strings.Contains(s, "Errors:\n  invalid fixup") ||
+		!strings.Contains(s, "\n  could not read object 2 data") {
+		t.Errorf("DumpText does not show partial program:\n%s", s)
+	}
+}
+
+func TestReadChecksums(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testProgram().WriteWith(&buf, &module.WriteOptions{Strict: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	name := filepath.Join(t.TempDir(), "test.le")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true}); err != nil {
+		t.Fatal("OpenWith:", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true})
+	if err == nil || !strings.HasPrefix(err.Error(), "page 3 checksum") {
+		t.Errorf("OpenWith: got error %v, expected page 3 checksum mismatch", err)
+	}
+}
+
+func TestReadPageChecksumErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testProgram().WriteWith(&buf, &module.WriteOptions{Strict: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	// Corrupt the second page of the first object.
+	data[binary.LittleEndian.Uint32(data[0x80:])+0x1005] ^= 0xff
+	name := filepath.Join(t.TempDir(), "test.le")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p, err := module.OpenWith(name, &module.ReadOptions{Lenient: true, VerifyChecksums: true})
+	if err != nil {
+		t.Fatal("OpenWith:", err)
+	}
+	if len(p.ReadErrors) != 1 {
+		t.Fatalf("got errors %v, expected 1 error", p.ReadErrors)
+	}
+	var perr *module.PageChecksumError
+	if !errors.As(p.ReadErrors[0], &perr) {
+		t.Fatalf("got error %v, expected page checksum error", p.ReadErrors[0])
+	}
+	if perr.ModulePage != 2 || perr.Object != 1 || perr.Page != 2 {
+		t.Errorf("got module page %d, object %d page %d; expected module page 2, object 1 page 2",
+			perr.ModulePage, perr.Object, perr.Page)
+	}
+	if msg := perr.Error(); !strings.HasPrefix(msg, "page 2 checksum") ||
+		!strings.HasSuffix(msg, "(object 1 page 2)") {
+		t.Errorf("unexpected message: %s", msg)
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	p := testProgram()
+	data := writeBytes(t, p)
+	r, err := module.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal("OpenReaderAt:", err)
+	}
+	if err := p.CompareLayout(r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadTruncatedSection(t *testing.T) {
+	data := writeBytes(t, testProgram())
+	le := binary.LittleEndian
+	offset := le.Uint32(data[0x68:])
+	size := le.Uint32(data[0x30:])
+	data = data[:offset+4]
+	_, err := openBytes(t, data)
+	expect := fmt.Sprintf("fixup section (offsets 0x%x:0x%x) extends beyond end of file (offset 0x%x)",
+		offset, offset+size, len(data))
+	if err == nil || err.Error() != expect {
+		t.Errorf("Open: got error %v, expected %q", err, expect)
+	}
+}
+
+func TestReadFaults(t *testing.T) {
+	var buf bytes.Buffer
+	opts := module.WriteOptions{Strict: true, SectionChecksums: true}
+	if err := testProgram().WriteWith(&buf, &opts); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	size := int64(len(data))
+	le := binary.LittleEndian
+	for _, c := range []struct {
+		name   string
+		offset int64
+		expect string
+	}{
+		{"header", 0, "could not read program header"},
+		{"object table", int64(le.Uint32(data[0x40:])), "could not read object table"},
+		{"page table", int64(le.Uint32(data[0x48:])), "could not read object page table"},
+		{"fixup page table", int64(le.Uint32(data[0x68:])), "could not read fixup page table"},
+		{"fixup records", int64(le.Uint32(data[0x6c:])), "could not read fixup records"},
+		{"data", int64(le.Uint32(data[0x80:])), "could not read object 1 data"},
+	} {
+		_, err := module.OpenReaderAtWith(faulttest.At(bytes.NewReader(data), c.offset), size, nil)
+		if err == nil || !strings.HasPrefix(err.Error(), c.expect) ||
+			!strings.HasSuffix(err.Error(), faulttest.ErrInjected.Error()) {
+			t.Errorf("%s: got error %v, expected %q", c.name, err, c.expect)
+		}
+	}
+
+	// Every read fails after some number of bytes. The module can only be
+	// read once all of the reads succeed, and lenient reading must not panic.
+	var n int64
+	for ; n <= size; n++ {
+		if _, err := module.OpenReaderAtWith(faulttest.After(bytes.NewReader(data), n), size, nil); err == nil {
+			break
+		}
+		module.OpenReaderAtWith(faulttest.After(bytes.NewReader(data), n), size,
+			&module.ReadOptions{Lenient: true, VerifyChecksums: true})
+	}
+	if n > size {
+		t.Fatal("OpenReader: module could not be read")
+	}
+	// Verifying checksums reads the data again.
+	_, err := module.OpenReaderAtWith(faulttest.After(bytes.NewReader(data), n), size,
+		&module.ReadOptions{VerifyChecksums: true})
+	if err == nil || !strings.Contains(err.Error(), "to verify checksum") ||
+		!strings.HasSuffix(err.Error(), faulttest.ErrInjected.Error()) {
+		t.Errorf("checksums: got error %v, expected checksum read error", err)
+	}
+}
+
+// minimalLX returns a hand-assembled LX module with one object of two pages.
+// The first page has 8 bytes of data and one fixup, and the second page is
+// zeroed.
+func minimalLX() []byte {
+	const (
+		objectTable = 0xac
+		pageTable   = objectTable + 24
+		fixupPages  = pageTable + 2*8
+		fixupRecs   = fixupPages + 3*4
+		dataPages   = fixupRecs + 7
+	)
+	m := make([]byte, dataPages, dataPages+8)
+	le := binary.LittleEndian
+	copy(m, "LX")
+	le.PutUint16(m[0x08:], module.CPU80386)
+	le.PutUint16(m[0x0a:], 1) // OS/2
+	le.PutUint32(m[0x14:], 2) // number of pages
+	le.PutUint32(m[0x18:], 1) // EIP object
+	le.PutUint32(m[0x20:], 1) // ESP object
+	le.PutUint32(m[0x24:], 0x2000)
+	le.PutUint32(m[0x28:], module.PageSize)
+	le.PutUint32(m[0x30:], dataPages-fixupPages)   // fixup section size
+	le.PutUint32(m[0x38:], fixupPages-objectTable) // loader section size
+	le.PutUint32(m[0x40:], objectTable)
+	le.PutUint32(m[0x44:], 1) // number of objects
+	le.PutUint32(m[0x48:], pageTable)
+	le.PutUint32(m[0x68:], fixupPages)
+	le.PutUint32(m[0x6c:], fixupRecs)
+	le.PutUint32(m[0x80:], dataPages)
+
+	o := m[objectTable:]
+	le.PutUint32(o[0:], 0x2000)  // virtual size
+	le.PutUint32(o[4:], 0x10000) // base address
+	le.PutUint32(o[8:], uint32(module.ObjR|module.ObjW|module.ObjX|module.Obj32Bit))
+	le.PutUint32(o[12:], 1) // page table index
+	le.PutUint32(o[16:], 2) // page table entries
+
+	pt := m[pageTable:]
+	le.PutUint32(pt[0:], 0) // data offset
+	le.PutUint16(pt[4:], 8) // data size
+	le.PutUint16(pt[6:], uint16(module.PageLegal))
+	le.PutUint16(pt[8+6:], uint16(module.PageZeroed))
+
+	fp := m[fixupPages:]
+	le.PutUint32(fp[4:], 7)
+	le.PutUint32(fp[8:], 7)
+	// 32-bit offset at 1, to object 1 offset 0x10.
+	copy(m[fixupRecs:], []byte{0x07, 0x00, 0x01, 0x00, 0x01, 0x10, 0x00})
+
+	return append(m, 0xb8, 0, 0, 0, 0, 0xc3, 0x90, 0x90)
+}
+
+func TestReadMinimalLX(t *testing.T) {
+	p, err := openBytes(t, minimalLX())
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if !p.IsLX() {
+		t.Errorf("signature is %q, expected LX", p.Signature[:])
+	}
+	if len(p.Objects) != 1 {
+		t.Fatalf("got %d objects, expected 1", len(p.Objects))
+	}
+	obj := p.Objects[0]
+	if e := []byte{0xb8, 0, 0, 0, 0, 0xc3, 0x90, 0x90}; !bytes.Equal(obj.Data, e) {
+		t.Errorf("data = %x, expected %x", obj.Data, e)
+	}
+	if len(obj.Pages) != 2 {
+		t.Fatalf("got %d pages, expected 2", len(obj.Pages))
+	}
+	if pg := obj.Pages[0]; pg.Type != module.PageLegal || pg.DataSize != 8 {
+		t.Errorf("page 1 has type %d, size %d", pg.Type, pg.DataSize)
+	}
+	if pg := obj.Pages[1]; pg.Type != module.PageZeroed {
+		t.Errorf("page 2 has type %d, expected zeroed", pg.Type)
+	}
+	e := []module.Fixup{{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 1, Off: 0x10}}}
+	if !reflect.DeepEqual(obj.Fixups, e) {
+		t.Errorf("fixups = %+v, expected %+v", obj.Fixups, e)
+	}
+	if err := p.Check(); err != nil {
+		t.Error("Check:", err)
+	}
+}
+
+func TestReadLXLargePages(t *testing.T) {
+	data := make([]byte, 0x10020)
+	data[0x5] = 1
+	data[0x10005] = 2
+	p := &module.Program{
+		ProgramHeader: module.ProgramHeader{
+			EIP: module.Ref{Obj: 1, Off: 0},
+			ESP: module.Ref{Obj: 1, Off: 0x20000},
+		},
+		Objects: []*module.Object{{
+			ObjectHeader: module.ObjectHeader{
+				VirtualSize: 0x20000,
+				BaseAddress: 0x10000,
+				Flags:       module.ObjR | module.ObjW | module.ObjX | module.Obj32Bit,
+			},
+			Data: data,
+			Fixups: []module.Fixup{
+				{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 1, Off: 4}},
+				{SrcType: module.SrcOffset32, Src: 0x10010, Target: module.Ref{Obj: 1, Off: 8}},
+			},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{LX: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	// Rewrite the module, which has 17 pages of 4 KiB, to have 2 pages of 64
+	// KiB. Pages 1 to 15 are zeroed and have no fixups.
+	m := buf.Bytes()
+	le := binary.LittleEndian
+	le.PutUint32(m[0x14:], 2)       // number of pages
+	le.PutUint32(m[0x28:], 0x10000) // page size
+	obj := m[le.Uint32(m[0x40:]):]
+	le.PutUint32(obj[16:], 2) // page table entries
+	pages := m[le.Uint32(m[0x48:]):]
+	copy(pages[8:16], pages[16*8:17*8])
+	fixups := m[le.Uint32(m[0x68:]):]
+	le.PutUint32(fixups[8:], le.Uint32(fixups[17*4:]))
+	name := filepath.Join(t.TempDir(), "test.lx")
+	if err := os.WriteFile(name, m, 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := module.Open(name)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	o := r.Objects[0]
+	if len(o.Pages) != 2 || len(o.Data) != 0x10006 || o.Data[0x5] != 1 || o.Data[0x10005] != 2 {
+		t.Errorf("object has %d pages and %d bytes of data, expected 2 pages and data from both",
+			len(o.Pages), len(o.Data))
+	}
+	if !reflect.DeepEqual(o.Fixups, p.Objects[0].Fixups) {
+		t.Errorf("object fixups:\ngot      %+v\nexpected %+v", o.Fixups, p.Objects[0].Fixups)
+	}
+	if pg := r.Pages(); len(pg) != 2 || pg[1].Offset != 0x10000 || !pg[1].HasFixups {
+		t.Errorf("Pages: got %+v, expected second page at 0x10000 with fixups", pg)
+	}
+
+	// LE modules must have 4 KiB pages.
+	m = writeBytes(t, p)
+	le.PutUint32(m[0x28:], 0x10000)
+	if _, err := openBytes(t, m); err == nil || !strings.Contains(err.Error(), "unsupported page size") {
+		t.Errorf("Open LE: got error %v, expected unsupported page size", err)
+	}
+}
+
+func TestReadPagesWithoutSize(t *testing.T) {
+	for _, lx := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := testProgram().WriteWith(&buf, &module.WriteOptions{LX: lx}); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		data := buf.Bytes()
+		le := binary.LittleEndian
+		// Set the virtual size of the second object, which has one page, to zero.
+		le.PutUint32(data[le.Uint32(data[0x40:])+0x18:], 0)
+		_, err := openBytes(t, data)
+		const expect = "could not read object 2 data: object has 1 pages but its virtual size is zero"
+		if err == nil || err.Error() != expect {
+			t.Errorf("lx=%t: Open: got error %v, expected %q", lx, err, expect)
+		}
+	}
+}
+
+func TestReadHugePageTable(t *testing.T) {
+	data := writeBytes(t, testProgram())
+	le := binary.LittleEndian
+	// Give the first object a page table index near the 32-bit limit.
+	obj := data[le.Uint32(data[0x40:]):]
+	le.PutUint32(obj[12:], 0x3ffffff0)
+	_, err := openBytes(t, data)
+	if err == nil {
+		t.Fatal("Open: expected error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "could not read object page table: ") ||
+		!strings.Contains(msg, "more than fit in the file") {
+		t.Errorf("Open: unexpected error: %v", err)
+	}
+}
+
+func TestReadEmptyObjectBetween(t *testing.T) {
+	p := testProgram()
+	// Move the BSS object between the code and data objects.
+	p.Objects[1], p.Objects[2] = p.Objects[2], p.Objects[1]
+	p.ESP.Obj = 2
+	for i := range p.Objects[0].Fixups {
+		f := &p.Objects[0].Fixups[i]
+		f.Target.Obj = 5 - f.Target.Obj
+	}
+	for _, lx := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := p.WriteWith(&buf, &module.WriteOptions{LX: lx}); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		r, err := openBytes(t, buf.Bytes())
+		if err != nil {
+			t.Fatalf("lx=%t: Open: %v", lx, err)
+		}
+		for i, obj := range r.Objects {
+			data := p.Objects[i].Data
+			if !bytes.HasPrefix(obj.Data, data) ||
+				len(bytes.Trim(obj.Data[len(data):], "\x00")) != 0 {
+				t.Errorf("lx=%t: object %d data = %q..., expected %q...",
+					lx, i+1, truncate(obj.Data), truncate(data))
+			}
+		}
+	}
+}
+
+// truncate returns at most the first 16 bytes of data.
+func truncate(data []byte) []byte {
+	if len(data) > 16 {
+		return data[:16]
+	}
+	return data
+}
+
+func TestReadLastPageSizeZero(t *testing.T) {
+	p := testProgram()
+	// The data object ends exactly at the end of a page.
+	p.Objects[1].VirtualSize = 0x1000
+	p.Objects[1].Data = bytes.Repeat([]byte("data"), 0x400)
+	data := writeBytes(t, p)
+	le := binary.LittleEndian
+	if n := le.Uint32(data[0x2c:]); n != module.PageSize {
+		t.Fatalf("last page size = %d, expected %d", n, module.PageSize)
+	}
+	// Store the last page size using the MZ convention.
+	le.PutUint32(data[0x2c:], 0)
+	r, err := openBytes(t, data)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if r.LastPageSize != module.PageSize {
+		t.Errorf("last page size = %d, expected %d", r.LastPageSize, module.PageSize)
+	}
+	if !bytes.Equal(r.Objects[1].Data, p.Objects[1].Data) {
+		t.Error("object 2 data does not match")
+	}
+	// Without a full last page, the size is ambiguous.
+	if _, err := openBytes(t, data[:len(data)-1]); err == nil ||
+		err.Error() != "invalid last page size: 0" {
+		t.Errorf("Open: got error %v, expected invalid last page size", err)
+	}
+}
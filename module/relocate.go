@@ -0,0 +1,125 @@
+package module
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Relocate returns the memory image of the program with all fixups applied,
+// assuming that each object is loaded at its base address. The image starts at
+// the lowest base address of any object, which is also returned. Gaps between
+// objects are filled with zeroes.
+func (p *Program) Relocate() (image []byte, base uint32, err error) {
+	if len(p.Objects) == 0 {
+		return nil, 0, nil
+	}
+	base = ^uint32(0)
+	var end uint64
+	for _, obj := range p.Objects {
+		if obj.BaseAddress < base {
+			base = obj.BaseAddress
+		}
+		if e := uint64(obj.BaseAddress) + uint64(obj.VirtualSize); e > end {
+			end = e
+		}
+	}
+	if end > 1<<32 {
+		return nil, 0, fmt.Errorf("objects extend past end of address space")
+	}
+	image = make([]byte, end-uint64(base))
+	for i, obj := range p.Objects {
+		if uint32(len(obj.Data)) > obj.VirtualSize {
+			return nil, 0, fmt.Errorf("object %d data is larger than its size", i+1)
+		}
+		copy(image[obj.BaseAddress-base:], obj.Data)
+	}
+	for i, obj := range p.Objects {
+		for j, f := range obj.Fixups {
+			if err := p.applyFixup(image, base, obj, f); err != nil {
+				return nil, 0, fmt.Errorf("object %d fixup %d: %v", i+1, j, err)
+			}
+		}
+	}
+	return image, base, nil
+}
+
+// applyFixup applies a fixup in an object to the memory image.
+func (p *Program) applyFixup(image []byte, base uint32, obj *Object, f Fixup) error {
+	size := srcSize(f.SrcType)
+	if f.Src < 0 || uint32(f.Src)+uint32(size) > obj.VirtualSize {
+		return fmt.Errorf("source offset 0x%x is outside object", f.Src)
+	}
+	if f.Target.Obj < 1 || int(f.Target.Obj) > len(p.Objects) {
+		return fmt.Errorf("invalid target object %d", f.Target.Obj)
+	}
+	src := obj.BaseAddress + uint32(f.Src)
+	target := p.Objects[f.Target.Obj-1].BaseAddress + uint32(f.Target.Off) + uint32(f.Add)
+	d := image[src-base:]
+	switch t := f.SrcType & 0x0f; t {
+	case 0x00:
+		d[0] = byte(target)
+	case 0x05:
+		binary.LittleEndian.PutUint16(d, uint16(target))
+	case SrcOffset32:
+		binary.LittleEndian.PutUint32(d, target)
+	case SrcRelative32:
+		binary.LittleEndian.PutUint32(d, target-(src+4))
+	default:
+		return fmt.Errorf("source type %d cannot be applied to a flat image", t)
+	}
+	return nil
+}
+
+// MakeContiguous assigns new base addresses to the objects, in order, so each
+// object starts at the first multiple of align after the end of the previous
+// object. The first object keeps its base address. Fixup targets and the entry
+// point are relative to objects, so only the base addresses change, and the
+// program refers to the new addresses consistently when it is relocated.
+func (p *Program) MakeContiguous(align uint32) error {
+	if align == 0 {
+		align = 1
+	}
+	if len(p.Objects) == 0 {
+		return nil
+	}
+	addr := uint64(p.Objects[0].BaseAddress)
+	for i, obj := range p.Objects {
+		addr = (addr + uint64(align) - 1) / uint64(align) * uint64(align)
+		if addr+uint64(obj.VirtualSize) > 1<<32 {
+			return fmt.Errorf("object %d extends past end of address space", i+1)
+		}
+		obj.BaseAddress = uint32(addr)
+		addr += uint64(obj.VirtualSize)
+	}
+	return nil
+}
+
+// AddStack adds a writable object of exactly the given size to hold the stack,
+// and sets the initial stack pointer to the top of it. The object is placed at
+// the first page boundary after the highest object, so it is above every other
+// object in the address space.
+func (p *Program) AddStack(size uint32) error {
+	if size == 0 {
+		return errors.New("stack size is zero")
+	}
+	var end uint64
+	for _, obj := range p.Objects {
+		if e := uint64(obj.BaseAddress) + uint64(obj.VirtualSize); e > end {
+			end = e
+		}
+	}
+	base := (end + PageSize - 1) / PageSize * PageSize
+	if base+uint64(size) > 1<<32 {
+		return fmt.Errorf("stack of size 0x%x extends past end of address space", size)
+	}
+	p.Objects = append(p.Objects, &Object{
+		ObjectHeader: ObjectHeader{
+			VirtualSize: size,
+			BaseAddress: uint32(base),
+			Flags:       ObjR | ObjW | Obj32Bit,
+		},
+	})
+	p.ESP = Ref{Obj: int32(len(p.Objects)), Off: int32(size)}
+	return nil
+}
@@ -0,0 +1,134 @@
+package module_test
+
+import (
+	"bytes"
+	"testing"
+
+	"moria.us/elf2dos/module"
+)
+
+func TestRelocate(t *testing.T) {
+	p := &module.Program{
+		Objects: []*module.Object{
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x10, BaseAddress: 0x1000},
+				Data:         []byte{0xb8, 0, 0, 0, 0, 0xe8, 0, 0, 0, 0, 0xc3},
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}},
+					{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 2, Off: 8}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x10, BaseAddress: 0x1020},
+				Data:         []byte{1, 2, 3, 4},
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 8, Target: module.Ref{Obj: 1, Off: 0}, Add: 0x100},
+				},
+			},
+		},
+	}
+	image, base, err := p.Relocate()
+	if err != nil {
+		t.Fatal("Relocate:", err)
+	}
+	if base != 0x1000 {
+		t.Errorf("base = 0x%x, expected 0x1000", base)
+	}
+	expect := []byte{
+		// Object 1 at 0x1000
+		0xb8, 0x24, 0x10, 0, 0, // mov eax, 0x1024
+		0xe8, 0x1e, 0, 0, 0, // call 0x1028 (0x1028 - 0x100a)
+		0xc3, 0, 0, 0, 0, 0,
+		// Gap
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		// Object 2 at 0x1020
+		1, 2, 3, 4, 0, 0, 0, 0,
+		0x00, 0x11, 0, 0, // 0x1000 + 0x100
+		0, 0, 0, 0,
+	}
+	if !bytes.Equal(image, expect) {
+		t.Errorf("Relocate:\ngot      % x\nexpected % x", image, expect)
+	}
+}
+
+func TestMakeContiguous(t *testing.T) {
+	p := &module.Program{
+		Objects: []*module.Object{
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x1800, BaseAddress: 0x10000},
+				Data:         []byte{0xb8, 0, 0, 0, 0, 0xe8, 0, 0, 0, 0, 0xc3},
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 1, Target: module.Ref{Obj: 2, Off: 4}},
+					{SrcType: module.SrcRelative32, Src: 6, Target: module.Ref{Obj: 3, Off: 8}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x10, BaseAddress: 0x40000},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{VirtualSize: 0x100, BaseAddress: 0x80000},
+			},
+		},
+	}
+	if err := p.MakeContiguous(module.PageSize); err != nil {
+		t.Fatal("MakeContiguous:", err)
+	}
+	for i, e := range []uint32{0x10000, 0x12000, 0x13000} {
+		if b := p.Objects[i].BaseAddress; b != e {
+			t.Errorf("object %d base = 0x%x, expected 0x%x", i+1, b, e)
+		}
+	}
+	image, base, err := p.Relocate()
+	if err != nil {
+		t.Fatal("Relocate:", err)
+	}
+	if n := len(image); base != 0x10000 || n != 0x3100 {
+		t.Errorf("image at 0x%x size 0x%x, expected 0x10000 size 0x3100", base, n)
+	}
+	expect := []byte{
+		0xb8, 0x04, 0x20, 0x01, 0, // mov eax, 0x12004
+		0xe8, 0xfe, 0x2f, 0, 0, // call 0x13008 (0x13008 - 0x1000a)
+	}
+	if !bytes.HasPrefix(image, expect) {
+		t.Errorf("Relocate:\ngot      % x\nexpected % x", image[:len(expect)], expect)
+	}
+
+	p.Objects[2].VirtualSize = 0xffffe000
+	if err := p.MakeContiguous(module.PageSize); err == nil {
+		t.Error("MakeContiguous: expected error")
+	}
+}
+
+func TestAddStack(t *testing.T) {
+	p := testProgram()
+	const size = 0x1234
+	if err := p.AddStack(size); err != nil {
+		t.Fatal("AddStack:", err)
+	}
+	n := len(p.Objects)
+	stack := p.Objects[n-1]
+	for i, obj := range p.Objects[:n-1] {
+		if end := obj.BaseAddress + obj.VirtualSize; end > stack.BaseAddress {
+			t.Errorf("object %d ends at 0x%x, above stack base 0x%x", i+1, end, stack.BaseAddress)
+		}
+	}
+	if stack.BaseAddress%module.PageSize != 0 {
+		t.Errorf("stack base 0x%x is not page aligned", stack.BaseAddress)
+	}
+	if stack.VirtualSize != size {
+		t.Errorf("stack size 0x%x, expected 0x%x", stack.VirtualSize, size)
+	}
+	if e := (module.Ref{Obj: int32(n), Off: size}); p.ESP != e {
+		t.Errorf("ESP = %v, expected %v", p.ESP, e)
+	}
+	if err := p.Check(); err != nil {
+		t.Error("Check:", err)
+	}
+	r, err := openBytes(t, writeBytes(t, p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if err := p.CompareLayout(r); err != nil {
+		t.Error("written program differs:", err)
+	}
+}
@@ -0,0 +1,119 @@
+package module
+
+import "fmt"
+
+// Validate checks the structure of the program and returns every problem it
+// finds. This complements the checks done when reading a module, which stop at
+// the first problem unless reading in lenient mode.
+func (p *Program) Validate() []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	for i, obj := range p.Objects {
+		const wx = ObjW | ObjX
+		if obj.Flags&ObjR == 0 {
+			errorf("object %d is not readable", i+1)
+		}
+		if obj.Flags&wx == wx {
+			errorf("object %d is both writable and executable", i+1)
+		}
+		if uint64(obj.BaseAddress)+uint64(obj.VirtualSize) > 1<<32 {
+			errorf("object %d extends past end of address space", i+1)
+		}
+		if n := uint32(len(obj.Pages)); n > pagecount(obj.VirtualSize) {
+			errorf("object %d has %d pages, more than its size 0x%x needs",
+				i+1, n, obj.VirtualSize)
+		}
+		for j, f := range obj.Fixups {
+			if err := p.checkFixup(obj, f); err != nil {
+				errorf("object %d fixup %d: %v", i+1, j, err)
+			}
+		}
+		x := addrRange{obj.BaseAddress, obj.VirtualSize}
+		for j, other := range p.Objects[i+1:] {
+			if x.overlaps(addrRange{other.BaseAddress, other.VirtualSize}) {
+				errorf("object %d and object %d overlap", i+1, i+j+2)
+			}
+		}
+	}
+	if err := p.checkPageTable(); err != nil {
+		errs = append(errs, err)
+	}
+	if p.ModuleFlags&ModLibrary == 0 || p.EIP != (Ref{}) {
+		if err := p.checkEntry(p.EIP); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.checkStack(p.ESP); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Check checks that the program is consistent enough to write: each fixup is
+// within its object and targets an existing object, the entry point and stack
+// pointer are within existing objects, and the objects' page table entries do
+// not overlap. Unlike Validate, it does not check object permissions, which
+// the converter may have deliberately relaxed. It returns the first problem
+// found.
+func (p *Program) Check() error {
+	for i, obj := range p.Objects {
+		for j, f := range obj.Fixups {
+			if err := p.checkFixup(obj, f); err != nil {
+				return fmt.Errorf("object %d fixup %d: %v", i+1, j, err)
+			}
+		}
+	}
+	if p.ModuleFlags&ModLibrary == 0 || p.EIP != (Ref{}) {
+		if _, err := p.object(p.EIP, false); err != nil {
+			return fmt.Errorf("invalid entry point %v: %v", p.EIP, err)
+		}
+	}
+	if _, err := p.object(p.ESP, true); err != nil {
+		return fmt.Errorf("invalid stack pointer %v: %v", p.ESP, err)
+	}
+	return p.checkPageTable()
+}
+
+// checkFixup checks that a fixup in an object modifies bytes inside the object
+// and refers to an existing object.
+func (p *Program) checkFixup(obj *Object, f Fixup) error {
+	if f.Src < 0 || uint32(f.Src)+uint32(srcSize(f.SrcType)) > obj.VirtualSize {
+		return fmt.Errorf("source offset 0x%x is outside object", f.Src)
+	}
+	// The target offset may be outside the target object, for example when
+	// code refers to an array with a constant index.
+	if f.Target.Obj < 1 || int(f.Target.Obj) > len(p.Objects) {
+		return fmt.Errorf("invalid target object %d", f.Target.Obj)
+	}
+	return nil
+}
+
+// checkPageTable checks that no two objects use the same page table entries.
+func (p *Program) checkPageTable() error {
+	for i, x := range p.Objects {
+		if x.NumPageTableEntries == 0 {
+			continue
+		}
+		xr := addrRange{x.PageTableIndex, x.NumPageTableEntries}
+		for j, y := range p.Objects[i+1:] {
+			if y.NumPageTableEntries != 0 && xr.overlaps(addrRange{y.PageTableIndex, y.NumPageTableEntries}) {
+				return fmt.Errorf("object %d and object %d page table entries overlap", i+1, i+j+2)
+			}
+		}
+	}
+	return nil
+}
+
+// An addrRange is a range of addresses in the program.
+type addrRange struct {
+	addr uint32
+	size uint32
+}
+
+// overlaps returns true if the ranges contain any bytes in common.
+func (x addrRange) overlaps(y addrRange) bool {
+	return uint64(x.addr)+uint64(x.size) > uint64(y.addr) &&
+		uint64(y.addr)+uint64(y.size) > uint64(x.addr)
+}
@@ -0,0 +1,66 @@
+package module_test
+
+import (
+	"testing"
+
+	"moria.us/elf2dos/module"
+)
+
+func TestValidate(t *testing.T) {
+	if errs := testProgram().Validate(); len(errs) != 0 {
+		t.Errorf("Validate: unexpected errors %v", errs)
+	}
+	p := testProgram()
+	p.ESP = module.Ref{Obj: 1, Off: 0x100}
+	p.Objects[1].Flags |= module.ObjX
+	p.Objects[1].Fixups[0].Target = module.Ref{Obj: 4}
+	p.Objects[2].BaseAddress = 0x11000
+	expect := []string{
+		"object 1 and object 3 overlap",
+		"object 2 is both writable and executable",
+		"object 2 fixup 0: invalid target object 4",
+		"invalid stack pointer 1:0x100: object 1 is not writable",
+	}
+	errs := p.Validate()
+	if len(errs) != len(expect) {
+		t.Fatalf("Validate: got errors %v, expected %d errors", errs, len(expect))
+	}
+	for i, err := range errs {
+		if msg := err.Error(); msg != expect[i] {
+			t.Errorf("error %d: got %q, expected %q", i, msg, expect[i])
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := testProgram()
+	// Permissions are not checked.
+	p.Objects[0].Flags |= module.ObjW
+	p.ESP = module.Ref{Obj: 1, Off: 0x1800}
+	if err := p.Check(); err != nil {
+		t.Errorf("Check: unexpected error %v", err)
+	}
+	for _, c := range []struct {
+		change func(p *module.Program)
+		expect string
+	}{
+		{func(p *module.Program) { p.Objects[1].Fixups[0].Src = 0xfe },
+			"object 2 fixup 0: source offset 0xfe is outside object"},
+		{func(p *module.Program) { p.Objects[0].Fixups[2].Target.Obj = 0 },
+			"object 1 fixup 2: invalid target object 0"},
+		{func(p *module.Program) { p.EIP = module.Ref{Obj: 2, Off: 0x100} },
+			"invalid entry point 2:0x100: offset 0x100 is outside object 2 (size 0x100)"},
+		{func(p *module.Program) { p.ESP = module.Ref{Obj: 4} },
+			"invalid stack pointer 4:0x0: invalid object 4"},
+		{func(p *module.Program) {
+			p.Objects[0].PageTableIndex, p.Objects[0].NumPageTableEntries = 1, 2
+			p.Objects[1].PageTableIndex, p.Objects[1].NumPageTableEntries = 2, 1
+		}, "object 1 and object 2 page table entries overlap"},
+	} {
+		p := testProgram()
+		c.change(p)
+		if err := p.Check(); err == nil || err.Error() != c.expect {
+			t.Errorf("Check: got %v, expected %q", err, c.expect)
+		}
+	}
+}
@@ -1,43 +1,222 @@
 package module
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
 var zeropage [PageSize]byte
 
+// srcSize returns the number of bytes modified by a fixup with the given source
+// type.
+func srcSize(t SrcType) int32 {
+	switch t & 0x0f {
+	case 0x00:
+		return 1
+	case 0x02, 0x05:
+		return 2
+	case 0x06:
+		return 6
+	default:
+		return 4
+	}
+}
+
+// checksum returns the checksum of a block of data, which is the 32-bit sum of
+// its little-endian words. A trailing partial word is padded with zeroes. This
+// is the additive checksum used for the LE section and page checksums. A
+// checksum of zero means that the checksum is not present, and loaders do not
+// check it.
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for len(data) >= 4 {
+		sum += binary.LittleEndian.Uint32(data)
+		data = data[4:]
+	}
+	if len(data) != 0 {
+		var w [4]byte
+		copy(w[:], data)
+		sum += binary.LittleEndian.Uint32(w[:])
+	}
+	return sum
+}
+
+// checksumBlocks returns the checksum of the concatenation of the blocks,
+// without copying them.
+func checksumBlocks(blocks ...[]byte) uint32 {
+	var sum uint32
+	var w [4]byte
+	var n int
+	for _, b := range blocks {
+		for _, c := range b {
+			w[n] = c
+			n++
+			if n == 4 {
+				sum += binary.LittleEndian.Uint32(w[:])
+				n = 0
+			}
+		}
+	}
+	if n != 0 {
+		for ; n < 4; n++ {
+			w[n] = 0
+		}
+		sum += binary.LittleEndian.Uint32(w[:])
+	}
+	return sum
+}
+
+// WriteOptions controls how a program is written.
+type WriteOptions struct {
+	// Strict populates every header field and table that a conformant LE
+	// module requires, instead of leaving the optional ones zero. This
+	// includes per-page checksums, a resident name table, an entry table, and
+	// the module flags. It does not include the section checksums; see
+	// SectionChecksums.
+	Strict bool
+	// ModuleName is the name written to the resident name table in strict
+	// mode. If empty, "MODULE" is used.
+	ModuleName string
+	// LX writes an LX module instead of an LE module. Each page is stored
+	// with its own offset and size, and pages which contain only zeroes are
+	// not stored at all.
+	LX bool
+	// PreloadAll marks every object with pages as preloaded, and sets the
+	// number of preload pages to the total number of pages, for loaders which
+	// would otherwise load pages on demand.
+	PreloadAll bool
+	// SourceLists writes fixups on the same page with the same source type,
+	// target, and additive value as a single source list record, which makes
+	// the fixup section smaller when there are many references to the same
+	// target. Some loaders, including DOS/32A, do not support source lists.
+	SourceLists bool
+	// SectionChecksums writes the loader section and fixup section
+	// checksums, which are otherwise zero. Each checksum is the 32-bit sum of
+	// the section's little-endian words, not a CRC. This algorithm has not been
+	// verified against DOS/32A or any other loader, so a loader which checks
+	// these fields may reject the module; Strict does not enable them.
+	SectionChecksums bool
+	// Stub, if not nil, is a DOS MZ executable to write before the LE header,
+	// such as a DOS extender stub. It is padded to a multiple of 16 bytes, and
+	// its e_lfanew field at offset 0x3c is set to the offset of the LE header.
+	// Offsets in the LE header are relative to the LE header, except for the
+	// data pages offset, which is relative to the start of the file.
+	Stub []byte
+	// DOS4GW patches the stub so the module can be run as a bound DOS/4GW
+	// executable, where the stub is the DOS/4GW loader or a stub which runs
+	// it, like WSTUB. The stub must be given, and the module must be LE. See
+	// dos4gwStub for the changes made to the stub.
+	DOS4GW bool
+	// Compress stores pages which are smaller as iterated pages, where runs
+	// of repeated bytes are stored once with a repeat count, instead of
+	// verbatim. This requires LX, since LE pages all take a full page in the
+	// file.
+	Compress bool
+	// PageSize, if nonzero, is the size of the pages. Only LX modules may
+	// have pages larger than 4 KiB, and the size must be a power of two no
+	// larger than MaxWritePageSize.
+	PageSize uint32
+	// Map, if not nil, receives the file offset and size of each part of
+	// the module after it is written, one per line, such as the object
+	// table and the fixup records.
+	Map io.Writer
+}
+
+// MaxWritePageSize is the largest page size which can be written. An LX page
+// table entry stores the size of the page's data in 16 bits, so a full 64 KiB
+// page cannot be written.
+const MaxWritePageSize = 1 << 15
+
+// pageBits returns the number of bits in the page size to write. The options
+// may be nil.
+func (o *WriteOptions) pageBits() (uint, error) {
+	if o == nil || o.PageSize == 0 || o.PageSize == PageSize {
+		return PageBits, nil
+	}
+	if !o.LX {
+		return 0, fmt.Errorf("page size %d requires LX format", o.PageSize)
+	}
+	bits, ok := lxPageBits(o.PageSize)
+	if !ok || o.PageSize > MaxWritePageSize {
+		return 0, fmt.Errorf("invalid page size %d, must be a power of two from %d to %d",
+			o.PageSize, PageSize, MaxWritePageSize)
+	}
+	return bits, nil
+}
+
 // =================================================================================================
 
 type objdata struct {
+	count  uint32
 	object []byte
 	page   []byte
 }
 
-func (d *objdata) write(obj *Object, fixup []uint32, first, count uint32) {
+// write appends the object table entry for an object and the encoded page table
+// entries for its pages. If preload is true, an object with pages is marked as
+// preloaded.
+func (d *objdata) write(obj *Object, pages []byte, count uint32, preload bool) {
+	flags := obj.Flags
+	if preload && count != 0 {
+		flags |= ObjPreload
+	}
 	var od [4 * 6]byte
 	binary.LittleEndian.PutUint32(od[:], obj.VirtualSize)
 	binary.LittleEndian.PutUint32(od[4:], obj.BaseAddress)
-	binary.LittleEndian.PutUint32(od[8:], uint32(obj.Flags))
-	if len(fixup) != 0 {
-		binary.LittleEndian.PutUint32(od[12:], uint32(len(d.page)/4)+1)
-		binary.LittleEndian.PutUint32(od[16:], uint32(len(fixup)))
-		for _, idx := range fixup {
-			d.page = append(d.page, 0, byte(idx>>8), byte(idx&0xff), 0)
-		}
+	binary.LittleEndian.PutUint32(od[8:], uint32(flags))
+	if count != 0 {
+		binary.LittleEndian.PutUint32(od[12:], d.count+1)
+		binary.LittleEndian.PutUint32(od[16:], count)
+		d.page = append(d.page, pages...)
+		d.count += count
 	}
 	d.object = append(d.object, od[:]...)
 }
 
+// lePages returns LE page table entries for count pages, which are numbered
+// starting at first.
+func lePages(first, count uint32) []byte {
+	var d []byte
+	for i := uint32(0); i < count; i++ {
+		n := first + i
+		d = append(d, byte(n>>16), byte(n>>8), byte(n), 0)
+	}
+	return d
+}
+
 // =================================================================================================
 
 func appendFixup(f Fixup, data []byte) []byte {
-	var d [9]byte
+	return appendFixupList([]Fixup{f}, data)
+}
+
+// appendFixupList appends a fixup record for fixups which differ only in their
+// source offsets. If there is more than one fixup, a source list record is
+// written. The list must have between 1 and 255 fixups.
+func appendFixupList(fs []Fixup, data []byte) []byte {
+	f := fs[0]
+	var d [14]byte
 	d[0] = byte(f.SrcType)
 	var flags byte
-	binary.LittleEndian.PutUint16(d[2:], uint16(f.Src))
-	d[4] = byte(f.Target.Obj)
-	n := 5
+	n := 4
+	if len(fs) > 1 {
+		d[0] |= 0x20
+		d[2] = byte(len(fs))
+		n = 3
+	} else {
+		binary.LittleEndian.PutUint16(d[2:], uint16(f.Src))
+	}
+	if f.Target.Obj > 0xff {
+		flags |= 0x40
+		binary.LittleEndian.PutUint16(d[n:], uint16(f.Target.Obj))
+		n += 2
+	} else {
+		d[n] = byte(f.Target.Obj)
+		n++
+	}
 	if f.Target.Off > 0x7fff || f.Target.Off < 0 {
 		flags |= 0x10
 		binary.LittleEndian.PutUint32(d[n:], uint32(f.Target.Off))
@@ -46,94 +225,104 @@ func appendFixup(f Fixup, data []byte) []byte {
 		binary.LittleEndian.PutUint16(d[n:], uint16(f.Target.Off))
 		n += 2
 	}
+	if f.Add != 0 {
+		flags |= 0x04
+		if f.Add > 0x7fff || f.Add < 0 {
+			flags |= 0x20
+			binary.LittleEndian.PutUint32(d[n:], uint32(f.Add))
+			n += 4
+		} else {
+			binary.LittleEndian.PutUint16(d[n:], uint16(f.Add))
+			n += 2
+		}
+	}
 	d[1] = flags
-	return append(data, d[:n]...)
-}
-
-type fixupdata struct {
-	pages   []byte
-	records []byte
+	data = append(data, d[:n]...)
+	if len(fs) > 1 {
+		for _, f := range fs {
+			var so [2]byte
+			binary.LittleEndian.PutUint16(so[:], uint16(f.Src))
+			data = append(data, so[:]...)
+		}
+	}
+	return data
 }
 
-// write writes out fixup records. Returns fixup record indexes for each page in
-// the object, truncated to exclude trailing zeroes.
-func (d *fixupdata) write(size uint32, fixups []Fixup) []uint32 {
-	if size == 0 {
-		return nil
+// sourceLists groups fixups which differ only in their source offsets, so
+// they can be written as source list records. Groups are in the order of
+// their first fixup, and have at most 255 fixups.
+func sourceLists(fixups []Fixup) [][]Fixup {
+	type key struct {
+		t   SrcType
+		ref Ref
+		add int32
 	}
-	npage := int32(pagecount(size))
-
-	// Find the number of pages that include all fixups.
-	var maxOff int32 = -1
+	var groups [][]Fixup
+	index := make(map[key]int)
 	for _, f := range fixups {
-		off := f.Src + 3
-		if off > maxOff {
-			maxOff = off
+		k := key{f.SrcType, f.Target, f.Add}
+		i, ok := index[k]
+		if !ok || len(groups[i]) == 0xff {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
 		}
+		groups[i] = append(groups[i], f)
 	}
-	if maxOff < 0 {
-		return nil
-	}
-	if n := (maxOff >> PageBits) + 1; n > npage {
-		npage = n
-	}
+	return groups
+}
 
-	// Assign fixups to pages, bucket sort
-	idxs := make([]uint32, npage)
+// fixupPages returns the number of pages of 1<<bits bytes needed to contain
+// all of the given fixups.
+func fixupPages(fixups []Fixup, bits uint) uint32 {
+	var end int32
 	for _, f := range fixups {
-		var last int32 = -1
-		for off := int32(0); off < 3; off += 3 {
-			pi := (f.Src + off) >> PageBits
-			if pi > last && pi < npage {
-				idxs[pi]++
-			}
+		if e := f.Src + srcSize(f.SrcType); e > end {
+			end = e
 		}
 	}
-	idxs = idxs[:npage]
-	var total uint32
-	for i, n := range idxs {
-		idxs[i] = total
-		total += n
+	return pagecountBits(uint32(end), bits)
+}
+
+type fixupdata struct {
+	pages   []byte
+	records []byte
+}
+
+// write writes out the fixup records for an object with the given number of
+// pages of 1<<bits bytes, and adds an entry for each page to the fixup page
+// table. A fixup which
+// crosses a page boundary is written to both pages. If lists is true, fixups
+// on the same page which differ only in their source offsets are written as
+// source list records.
+func (d *fixupdata) write(npage uint32, fixups []Fixup, lists bool, bits uint) {
+	if len(d.pages) == 0 {
+		d.pages = make([]byte, 4)
 	}
-	assigned := make([]Fixup, total)
+	pfixups := make([][]Fixup, npage)
 	for _, f := range fixups {
-		var last int32 = -1
-		for off := int32(0); off < 4; off += 4 {
-			pi := (f.Src + off) >> PageBits
-			if pi > last && pi < npage {
-				idx := idxs[pi]
-				idxs[pi] = idx + 1
-				assigned[idx] = f
-			}
+		first := f.Src >> bits
+		last := (f.Src + srcSize(f.SrcType) - 1) >> bits
+		for pi := first; pi <= last && pi < int32(npage); pi++ {
+			pf := f
+			pf.Src -= pi << bits
+			pfixups[pi] = append(pfixups[pi], pf)
 		}
 	}
-
-	// Write out fixup data
-	pages := d.pages
-	records := d.records
-	if len(pages) == 0 {
-		pages = make([]byte, 4)
-	}
-	var pos uint32
-	for pi, idx := range idxs {
-		if pos == idx {
-			idxs[pi] = 0
-		}
-		idxs[pi] = uint32(len(pages) / 4)
-		pfixups := assigned[pos:idx]
-		pos = idx
-		base := int32(pi << PageBits)
-		for _, f := range pfixups {
-			f.Src -= base
-			records = appendFixup(f, records)
+	for _, fs := range pfixups {
+		if lists {
+			for _, g := range sourceLists(fs) {
+				d.records = appendFixupList(g, d.records)
+			}
+		} else {
+			for _, f := range fs {
+				d.records = appendFixup(f, d.records)
+			}
 		}
 		var roff [4]byte
-		binary.LittleEndian.PutUint32(roff[:], uint32(len(records)))
-		pages = append(pages, roff[:]...)
+		binary.LittleEndian.PutUint32(roff[:], uint32(len(d.records)))
+		d.pages = append(d.pages, roff[:]...)
 	}
-	d.pages = pages
-	d.records = records
-	return idxs
 }
 
 // =================================================================================================
@@ -144,25 +333,160 @@ type pagedata struct {
 	data   [][]byte
 }
 
-func (d *pagedata) write(data []byte) (first, count uint32) {
-	count = pagecount(uint32(len(data)))
-	if count != 0 {
-		first = d.count + 1
-		if d.offset != 0 {
-			d.data = append(d.data, zeropage[d.offset:])
+// write writes out the data for an object, padded with zeroes to the given
+// number of pages. Returns the 1-based number of the first page.
+func (d *pagedata) write(data []byte, count uint32) (first uint32) {
+	if count == 0 {
+		return 0
+	}
+	first = d.count + 1
+	if d.offset != 0 {
+		d.data = append(d.data, zeropage[d.offset:])
+	}
+	d.data = append(d.data, data)
+	size := uint32(len(data))
+	lastPage := (count - 1) << PageBits
+	for size < lastPage {
+		n := PageSize - size&(PageSize-1)
+		d.data = append(d.data, zeropage[:n])
+		size += n
+	}
+	if size == lastPage {
+		// The last page must contain at least one byte.
+		d.data = append(d.data, zeropage[:1])
+		size++
+	}
+	d.offset = size & (PageSize - 1)
+	d.count += count
+	return first
+}
+
+// pages calls fn with the data of each page, in order. The page is assembled
+// in a single buffer which is reused for every page, so fn must not retain it.
+// Every page is full except possibly the last.
+func (d *pagedata) pages(fn func(page []byte) error) error {
+	page := make([]byte, 0, PageSize)
+	for _, b := range d.data {
+		for len(b) != 0 {
+			n := copy(page[len(page):PageSize], b)
+			page = page[:len(page)+n]
+			b = b[n:]
+			if len(page) == PageSize {
+				if err := fn(page); err != nil {
+					return err
+				}
+				page = page[:0]
+			}
 		}
-		d.data = append(d.data, data)
-		d.offset = uint32(len(data)) & (PageSize - 1)
-		d.count += count
 	}
-	return
+	if len(page) != 0 {
+		return fn(page)
+	}
+	return nil
+}
+
+// checksums returns the checksum of each page of data.
+func (d *pagedata) checksums() []byte {
+	var sums []byte
+	d.pages(func(page []byte) error {
+		var s [4]byte
+		binary.LittleEndian.PutUint32(s[:], checksum(page))
+		sums = append(sums, s[:]...)
+		return nil
+	})
+	return sums
+}
+
+// =================================================================================================
+
+// lxpagedata is the page data for an LX module, where each page is stored
+// separately and trailing zeroes are not stored.
+type lxpagedata struct {
+	offset   uint32
+	data     [][]byte
+	sums     []byte
+	compress bool
+}
+
+// minRun is the shortest run of repeated bytes which is written as its own
+// iteration record. A record has 4 bytes of overhead, and splits the literal
+// data around it into another record.
+const minRun = 10
+
+// iterate returns a page encoded as iteration records, with runs of repeated
+// bytes stored once.
+func iterate(page []byte) []byte {
+	var d []byte
+	record := func(count int, data []byte) {
+		d = append(d, byte(count), byte(count>>8), byte(len(data)), byte(len(data)>>8))
+		d = append(d, data...)
+	}
+	var lit int // start of literal data not yet written
+	for i := 0; i < len(page); {
+		j := i + 1
+		for j < len(page) && page[j] == page[i] {
+			j++
+		}
+		if j-i >= minRun {
+			if lit < i {
+				record(1, page[lit:i])
+			}
+			record(j-i, page[i:i+1])
+			lit = j
+		}
+		i = j
+	}
+	if lit < len(page) {
+		record(1, page[lit:])
+	}
+	return d
+}
+
+// write writes out the data for an object with the given number of pages of
+// 1<<bits bytes. Returns the LX page table entries for the pages.
+func (d *lxpagedata) write(data []byte, count uint32, bits uint) []byte {
+	var pages []byte
+	for i := uint32(0); i < count; i++ {
+		var page []byte
+		if start := i << bits; start < uint32(len(data)) {
+			page = data[start:]
+			if len(page) > 1<<bits {
+				page = page[:1<<bits]
+			}
+		}
+		page = bytes.TrimRight(page, "\x00")
+		ptype := PageLegal
+		if d.compress && len(page) != 0 {
+			if it := iterate(page); len(it) < len(page) {
+				page = it
+				ptype = PageIterated
+			}
+		}
+		var e [8]byte
+		if len(page) == 0 {
+			binary.LittleEndian.PutUint16(e[6:], uint16(PageZeroed))
+		} else {
+			binary.LittleEndian.PutUint32(e[0:], d.offset)
+			binary.LittleEndian.PutUint16(e[4:], uint16(len(page)))
+			binary.LittleEndian.PutUint16(e[6:], uint16(ptype))
+			d.data = append(d.data, page)
+			d.offset += uint32(len(page))
+		}
+		var s [4]byte
+		binary.LittleEndian.PutUint32(s[:], checksum(page))
+		d.sums = append(d.sums, s[:]...)
+		pages = append(pages, e[:]...)
+	}
+	return pages
 }
 
 // =================================================================================================
 
 type datawriter struct {
-	pos  uint32
-	data [][]byte
+	pos      uint32
+	data     [][]byte
+	base     uint32 // file offset of pos 0
+	sections []mapEntry
 }
 
 func (w *datawriter) write(d []byte) {
@@ -170,58 +494,306 @@ func (w *datawriter) write(d []byte) {
 	w.data = append(w.data, d)
 }
 
+// section writes a block and records it as a named section.
+func (w *datawriter) section(name string, d []byte) {
+	w.sections = append(w.sections, mapEntry{name, w.base + w.pos, uint32(len(d))})
+	w.write(d)
+}
+
+// A mapEntry is the location of one part of a written module.
+type mapEntry struct {
+	name   string
+	offset uint32 // offset from the start of the file
+	size   uint32
+}
+
+// writeMap writes the location of each section, one per line.
+func writeMap(w io.Writer, sections []mapEntry) error {
+	if _, err := fmt.Fprintf(w, "%-18s  %-10s  %s\n", "Section", "Offset", "Size"); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		if _, err := fmt.Fprintf(w, "%-18s  0x%08x  0x%08x\n", s.name, s.offset, s.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // =================================================================================================
 
-func (p *Program) dumpBlocks() [][]byte {
+// residentNames returns a resident name table containing only the module name.
+func residentNames(name string) []byte {
+	if name == "" {
+		name = "MODULE"
+	}
+	if len(name) > 0xff {
+		name = name[:0xff]
+	}
+	d := []byte{byte(len(name))}
+	d = append(d, name...)
+	return append(d, 0, 0, 0) // ordinal 0, end of table
+}
+
+// mzStub returns a copy of an MZ stub, padded to a multiple of 16 bytes, with
+// e_lfanew pointing to the end of the stub.
+func mzStub(stub []byte) ([]byte, error) {
+	if len(stub) < 0x40 {
+		return nil, fmt.Errorf("MZ stub is %d bytes, which is too short to have e_lfanew", len(stub))
+	}
+	if stub[0] != 'M' || stub[1] != 'Z' {
+		return nil, fmt.Errorf("MZ stub has signature %q, expected \"MZ\"", stub[:2])
+	}
+	d := make([]byte, (len(stub)+15)&^15)
+	copy(d, stub)
+	binary.LittleEndian.PutUint32(d[0x3c:], uint32(len(d)))
+	return d, nil
+}
+
+// dos4gwStub returns a copy of an MZ stub, patched so DOS/4GW can find the LE
+// header after it. The changes are:
+//
+//   - The stub is padded to a multiple of 16 bytes, and e_lfanew at offset
+//     0x3c is set to the end of the stub, where the LE header is written, as
+//     for any stub.
+//   - e_lfarlc at offset 0x18, the offset of the MZ relocation table, is set
+//     to 0x40 if it is less than 0x40. Loaders only treat offset 0x3c as
+//     e_lfanew if the relocation table starts at or after 0x40, so a stub
+//     with relocations before 0x40 is rejected.
+//   - e_cblp at offset 0x02 and e_cp at offset 0x04, the size of the MZ
+//     image, are set to the size of the padded stub, so the LE header
+//     immediately follows the MZ image. DOS loads only the stub, and the LE
+//     module is not loaded into conventional memory.
+//
+// The data pages offset in the LE header is relative to the start of the
+// file, which is what DOS/4GW expects, and all other offsets are relative to
+// the LE header.
+func dos4gwStub(stub []byte) ([]byte, error) {
+	d, err := mzStub(stub)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint16(d[0x18:]) < 0x40 {
+		if n := le.Uint16(d[0x06:]); n != 0 {
+			return nil, fmt.Errorf("MZ stub has %d relocations at offset 0x%x, which overlaps e_lfanew",
+				n, le.Uint16(d[0x18:]))
+		}
+		le.PutUint16(d[0x18:], 0x40)
+	}
+	if hdr := int(le.Uint16(d[0x08:])) * 16; hdr > len(d) {
+		return nil, fmt.Errorf("MZ stub header is %d bytes, but the stub is only %d bytes", hdr, len(d))
+	}
+	le.PutUint16(d[0x02:], uint16(len(d)%512))
+	le.PutUint16(d[0x04:], uint16((len(d)+511)/512))
+	return d, nil
+}
+
+// A layout is a program laid out for writing. The headers and tables are
+// computed first, since their sizes determine the offsets in the header, and
+// the page data is written afterwards, one page at a time.
+type layout struct {
+	blocks   [][]byte // stub, headers, and tables, in file order
+	pages    *pagedata
+	lxpages  *lxpagedata
+	sections []mapEntry
+}
+
+// writeTo writes the laid out program to the writer.
+func (l *layout) writeTo(w io.Writer) error {
+	for _, d := range l.blocks {
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+	if err := l.pages.pages(func(page []byte) error {
+		_, err := w.Write(page)
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, d := range l.lxpages.data {
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layout lays out the program for writing. The stub, which may be nil, is
+// written first.
+func (p *Program) layout(opts *WriteOptions, stub []byte) *layout {
+	if opts == nil {
+		opts = new(WriteOptions)
+	}
+	bits, _ := opts.pageBits() // checked by WriteWith
 	var objdata objdata
 	var fixupdata fixupdata
 	var pagedata pagedata
+	lxpagedata := lxpagedata{compress: opts.Compress}
 	for _, obj := range p.Objects {
-		first, count := pagedata.write(obj.Data)
-		fixup := fixupdata.write(obj.VirtualSize, obj.Fixups)
-		objdata.write(obj, fixup, first, count)
+		count := pagecountBits(uint32(len(obj.Data)), bits)
+		if n := fixupPages(obj.Fixups, bits); n > count {
+			count = n
+		}
+		var pages []byte
+		if opts.LX {
+			pages = lxpagedata.write(obj.Data, count, bits)
+		} else {
+			pages = lePages(pagedata.write(obj.Data, count), count)
+		}
+		fixupdata.write(count, obj.Fixups, opts.SourceLists, bits)
+		objdata.write(obj, pages, count, opts.PreloadAll)
+	}
+	if len(fixupdata.pages) == 0 {
+		fixupdata.pages = make([]byte, 4)
+	}
+	// For LX, this field is the page offset shift instead, which is zero.
+	var lastPageSize uint32
+	if !opts.LX {
+		lastPageSize = pagedata.offset
+		if lastPageSize == 0 && pagedata.count != 0 {
+			lastPageSize = PageSize
+		}
+	}
+	flags := p.ModuleFlags
+	if opts.Strict {
+		// We never emit imported fixups.
+		flags |= ModNoExternalFixups
+	}
+	cpu := p.CPUType
+	if cpu == 0 {
+		cpu = CPU80386
 	}
 	var h [0xac]byte
 	le := binary.LittleEndian
 	h[0] = 'L'
 	h[1] = 'E'
-	le.PutUint16(h[0x08:], 2)                      // 386 or higher
-	le.PutUint32(h[0x14:], pagedata.count)         // number of pages
+	if opts.LX {
+		h[1] = 'X'
+	}
+	le.PutUint16(h[0x08:], cpu)                    // Minimum CPU type
+	le.PutUint32(h[0x0c:], p.ModuleVersion)        // Module version
+	le.PutUint32(h[0x10:], flags)                  // Module flags
+	le.PutUint32(h[0x14:], objdata.count)          // number of pages
 	le.PutUint32(h[0x18:], uint32(p.EIP.Obj))      // EIP object number
 	le.PutUint32(h[0x1c:], uint32(p.EIP.Off))      // EIP offset
 	le.PutUint32(h[0x20:], uint32(p.ESP.Obj))      // ESP object number
 	le.PutUint32(h[0x24:], uint32(p.ESP.Off))      // ESP address
-	le.PutUint32(h[0x28:], PageSize)               // Page size, 4 KiB
-	le.PutUint32(h[0x2c:], pagedata.offset)        // Bytes on last page
+	le.PutUint32(h[0x28:], 1<<bits)                // Page size
+	le.PutUint32(h[0x2c:], lastPageSize)           // Bytes on last page (LE)
 	le.PutUint32(h[0x44:], uint32(len(p.Objects))) // Number of objects
+	le.PutUint32(h[0xa8:], p.HeapSize)             // Heap size
 
 	var d datawriter
-	d.write(h[:])
+	if stub != nil {
+		d.section("MZ stub", stub)
+		d.base, d.pos = d.pos, 0
+	}
+	d.section("header", h[:])
 	start := d.pos
+	var loader [][]byte
 	le.PutUint32(h[0x40:], d.pos) // Object table offset
-	d.write(objdata.object)
+	d.section("object table", objdata.object)
 	le.PutUint32(h[0x48:], d.pos) // Page table offset
-	d.write(objdata.page)
+	d.section("page table", objdata.page)
+	loader = append(loader, objdata.object, objdata.page)
+	if opts.Strict {
+		le.PutUint32(h[0x50:], d.pos) // Resource table offset (empty)
+		le.PutUint32(h[0x58:], d.pos) // Resident name table offset
+		names := residentNames(opts.ModuleName)
+		d.section("resident names", names)
+		le.PutUint32(h[0x5c:], d.pos) // Entry table offset
+		entry := []byte{0}
+		d.section("entry table", entry)
+		le.PutUint32(h[0x7c:], d.pos) // Per-page checksum table offset
+		sums := pagedata.checksums()
+		if opts.LX {
+			sums = lxpagedata.sums
+		}
+		d.section("page checksums", sums)
+		loader = append(loader, names, entry, sums)
+	}
+	if opts.SectionChecksums {
+		le.PutUint32(h[0x3c:], checksumBlocks(loader...)) // Loader section checksum
+	}
 	le.PutUint32(h[0x38:], d.pos-start) // Loader section size
 	start = d.pos
 	le.PutUint32(h[0x68:], d.pos) // Fixup page table offset
-	d.write(fixupdata.pages)
+	d.section("fixup page table", fixupdata.pages)
 	le.PutUint32(h[0x6c:], d.pos) // Fixup record table offset
-	d.write(fixupdata.records)
-	le.PutUint32(h[0x30:], d.pos-start) // Fixup section size
-	le.PutUint32(h[0x80:], d.pos)       // Data page offset
-	for _, it := range pagedata.data {
-		d.write(it)
+	d.section("fixup records", fixupdata.records)
+	if opts.Strict {
+		le.PutUint32(h[0x70:], d.pos) // Import module table offset (empty)
+		le.PutUint32(h[0x78:], d.pos) // Import procedure table offset (empty)
+	}
+	if opts.SectionChecksums {
+		le.PutUint32(h[0x34:], checksumBlocks(fixupdata.pages, fixupdata.records)) // Fixup section checksum
+	}
+	le.PutUint32(h[0x30:], d.pos-start)             // Fixup section size
+	le.PutUint32(h[0x80:], uint32(len(stub))+d.pos) // Data page offset, from start of file
+	if opts.Compress {
+		// Iterated pages are stored with the other pages.
+		le.PutUint32(h[0x4c:], uint32(len(stub))+d.pos) // Iterated pages offset
+	}
+	if opts.PreloadAll {
+		le.PutUint32(h[0x84:], objdata.count) // Number of preload pages
+	}
+	var size uint32
+	for _, b := range pagedata.data {
+		size += uint32(len(b))
+	}
+	size += lxpagedata.offset
+	d.sections = append(d.sections, mapEntry{"data pages", d.base + d.pos, size})
+	return &layout{
+		blocks:   d.data,
+		pages:    &pagedata,
+		lxpages:  &lxpagedata,
+		sections: d.sections,
 	}
-	return d.data
 }
 
-// Write writes the program, in LE format.
+// Write writes the program using the default options, like WriteWith with nil
+// options. The output is an LE module with 4 KiB pages and no stub.
 func (p *Program) Write(w io.Writer) error {
-	for _, d := range p.dumpBlocks() {
-		if _, err := w.Write(d); err != nil {
+	return p.WriteWith(w, nil)
+}
+
+// WriteWith writes the program as an LE or LX module, using the given options.
+// If opts is nil, the default options are used. A program with no objects is
+// written as a well-formed module with no objects and no pages.
+func (p *Program) WriteWith(w io.Writer, opts *WriteOptions) error {
+	if opts != nil && opts.Compress && !opts.LX {
+		return errors.New("compressed pages require LX format")
+	}
+	if _, err := opts.pageBits(); err != nil {
+		return err
+	}
+	var stub []byte
+	switch {
+	case opts != nil && opts.DOS4GW:
+		if opts.Stub == nil {
+			return errors.New("DOS/4GW executables require a stub")
+		}
+		if opts.LX {
+			return errors.New("DOS/4GW executables require LE format")
+		}
+		var err error
+		if stub, err = dos4gwStub(opts.Stub); err != nil {
+			return err
+		}
+	case opts != nil && opts.Stub != nil:
+		var err error
+		if stub, err = mzStub(opts.Stub); err != nil {
 			return err
 		}
 	}
+	l := p.layout(opts, stub)
+	if err := l.writeTo(w); err != nil {
+		return err
+	}
+	if opts != nil && opts.Map != nil {
+		return writeMap(opts.Map, l.sections)
+	}
 	return nil
 }
@@ -0,0 +1,882 @@
+package module_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"moria.us/elf2dos/module"
+)
+
+// testProgram returns a small program with code, data, and BSS objects.
+func testProgram() *module.Program {
+	code := make([]byte, 0x1800)
+	for i := range code {
+		code[i] = byte(i * 7)
+	}
+	return &module.Program{
+		ProgramHeader: module.ProgramHeader{
+			EIP: module.Ref{Obj: 1, Off: 0x10},
+			ESP: module.Ref{Obj: 3, Off: 0x2000},
+		},
+		Objects: []*module.Object{
+			{
+				ObjectHeader: module.ObjectHeader{
+					VirtualSize: 0x1800,
+					BaseAddress: 0x10000,
+					Flags:       module.ObjR | module.ObjX | module.Obj32Bit,
+				},
+				Data: code,
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 0x20, Target: module.Ref{Obj: 2, Off: 0x10}},
+					{SrcType: module.SrcOffset32, Src: 0xffe, Target: module.Ref{Obj: 3, Off: 0x8000}},
+					{SrcType: module.SrcRelative32, Src: 0x1100, Target: module.Ref{Obj: 2, Off: 0}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{
+					VirtualSize: 0x100,
+					BaseAddress: 0x20000,
+					Flags:       module.ObjR | module.ObjW | module.Obj32Bit,
+				},
+				Data: []byte("Hello, world!\n"),
+				Fixups: []module.Fixup{
+					{SrcType: module.SrcOffset32, Src: 0x40, Target: module.Ref{Obj: 1, Off: 0x10}},
+				},
+			},
+			{
+				ObjectHeader: module.ObjectHeader{
+					VirtualSize: 0x2000,
+					BaseAddress: 0x30000,
+					Flags:       module.ObjR | module.ObjW | module.Obj32Bit,
+				},
+			},
+		},
+	}
+}
+
+// sum32 is the reference checksum, the 32-bit sum of little-endian words.
+func sum32(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var w [4]byte
+		copy(w[:], data[i:])
+		sum += binary.LittleEndian.Uint32(w[:])
+	}
+	return sum
+}
+
+// checkConformance checks that an LE module has every field and table that a
+// conformant module requires. Returns a list of problems.
+func checkConformance(data []byte) []string {
+	var errs []string
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+	var h module.ProgramHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return []string{err.Error()}
+	}
+	le := binary.LittleEndian
+	size := uint32(len(data))
+	if !h.IsLE() {
+		errorf("signature is %q", h.Signature[:])
+	}
+	if h.ByteOrder != 0 || h.WordOrder != 0 {
+		errorf("byte order %d, word order %d", h.ByteOrder, h.WordOrder)
+	}
+	if h.CPUType == 0 {
+		errorf("no CPU type")
+	}
+	if h.PageSize != module.PageSize {
+		errorf("page size is %d", h.PageSize)
+	}
+	if h.ModuleFlags&module.ModNoExternalFixups == 0 {
+		errorf("module flags 0x%08x do not indicate absence of external fixups", h.ModuleFlags)
+	}
+
+	// Loader section.
+	lstart, lend := h.ObjectTableOffset, h.ObjectTableOffset+h.LoaderSectionSize
+	if lend > size || lend < lstart {
+		return append(errs, "loader section is outside file")
+	}
+	if c := sum32(data[lstart:lend]); h.LoaderSectionChecksum != 0 && h.LoaderSectionChecksum != c {
+		errorf("loader section checksum is 0x%08x, expected 0x%08x", h.LoaderSectionChecksum, c)
+	}
+	inLoader := func(name string, off, n uint32) bool {
+		if off < lstart || off+n > lend {
+			errorf("%s (0x%x:0x%x) is outside loader section", name, off, off+n)
+			return false
+		}
+		return true
+	}
+	var pageCount uint32
+	seen := make(map[uint32]bool)
+	if inLoader("object table", h.ObjectTableOffset, h.NumObjects*0x18) {
+		for i := uint32(0); i < h.NumObjects; i++ {
+			o := data[h.ObjectTableOffset+i*0x18:]
+			index, count := le.Uint32(o[12:]), le.Uint32(o[16:])
+			if count == 0 {
+				continue
+			}
+			if index == 0 {
+				errorf("object %d has pages but no page table index", i+1)
+				continue
+			}
+			pageCount += count
+			if !inLoader("object page table", h.ObjectPageTableOffset+(index-1)*4, count*4) {
+				continue
+			}
+			for j := uint32(0); j < count; j++ {
+				e := data[h.ObjectPageTableOffset+(index+j-1)*4:]
+				n := uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2])
+				if n == 0 || n > h.ModuleNumPages || seen[n] {
+					errorf("object %d page %d has invalid number %d", i+1, j, n)
+				}
+				seen[n] = true
+				if e[3] != 0 {
+					errorf("object %d page %d has type %d", i+1, j, e[3])
+				}
+			}
+		}
+	}
+	if pageCount != h.ModuleNumPages {
+		errorf("objects have %d pages, header has %d", pageCount, h.ModuleNumPages)
+	}
+	if h.ResidentNameTableOffset == 0 {
+		errorf("no resident name table")
+	} else if inLoader("resident name table", h.ResidentNameTableOffset, 1) {
+		n := uint32(data[h.ResidentNameTableOffset])
+		if n == 0 {
+			errorf("resident name table has no module name")
+		} else if inLoader("resident name table", h.ResidentNameTableOffset, n+4) &&
+			data[h.ResidentNameTableOffset+n+3] != 0 {
+			errorf("resident name table is not terminated")
+		}
+	}
+	if h.EntryTableOffset == 0 {
+		errorf("no entry table")
+	} else if inLoader("entry table", h.EntryTableOffset, 1) && data[h.EntryTableOffset] != 0 {
+		errorf("entry table is not empty")
+	}
+	if h.PerPageChecksumOffset == 0 {
+		errorf("no per-page checksum table")
+	} else if inLoader("per-page checksum table", h.PerPageChecksumOffset, h.ModuleNumPages*4) {
+		for i := uint32(0); i < h.ModuleNumPages; i++ {
+			start := h.DataPagesOffset + i*module.PageSize
+			end := start + module.PageSize
+			if end > size {
+				end = size
+			}
+			if start > end {
+				errorf("page %d is outside file", i+1)
+				continue
+			}
+			c := le.Uint32(data[h.PerPageChecksumOffset+i*4:])
+			if e := sum32(data[start:end]); c != e {
+				errorf("page %d checksum is 0x%08x, expected 0x%08x", i+1, c, e)
+			}
+		}
+	}
+
+	// Fixup section.
+	fstart, fend := h.FixupPageTableOffset, h.FixupPageTableOffset+h.FixupSectionSize
+	if fstart != lend {
+		errorf("fixup section does not follow loader section")
+	}
+	if fend > size || fend < fstart {
+		return append(errs, "fixup section is outside file")
+	}
+	if c := sum32(data[fstart:fend]); h.FixupSectionChecksum != 0 && h.FixupSectionChecksum != c {
+		errorf("fixup section checksum is 0x%08x, expected 0x%08x", h.FixupSectionChecksum, c)
+	}
+	if h.FixupRecordOffset != fstart+(h.ModuleNumPages+1)*4 {
+		errorf("fixup page table has wrong size")
+	} else {
+		var last uint32
+		for i := uint32(0); i <= h.ModuleNumPages; i++ {
+			off := le.Uint32(data[fstart+i*4:])
+			if off < last {
+				errorf("fixup page table entry %d goes backwards", i)
+			}
+			last = off
+		}
+		if h.FixupRecordOffset+last != h.ImportModuleTableOffset {
+			errorf("fixup records do not end at import module table")
+		}
+	}
+	if h.ImportModuleTableOffset != h.ImportProcTableOffset || h.ImportProcTableOffset != fend {
+		errorf("import tables are not empty and at end of fixup section")
+	}
+
+	// Data pages.
+	if h.DataPagesOffset != fend {
+		errorf("data pages do not follow fixup section")
+	}
+	if h.ModuleNumPages != 0 {
+		if h.LastPageSize == 0 || h.LastPageSize > module.PageSize {
+			errorf("invalid last page size %d", h.LastPageSize)
+		} else if end := h.DataPagesOffset + (h.ModuleNumPages-1)*module.PageSize +
+			h.LastPageSize; end != size {
+			errorf("data pages end at 0x%x, file ends at 0x%x", end, size)
+		}
+	}
+	for _, r := range []struct {
+		name string
+		ref  module.Ref
+	}{{"EIP", h.EIP}, {"ESP", h.ESP}} {
+		if r.ref.Obj < 1 || uint32(r.ref.Obj) > h.NumObjects {
+			errorf("%s has invalid object %d", r.name, r.ref.Obj)
+		}
+	}
+	return errs
+}
+
+func TestWrite(t *testing.T) {
+	p := testProgram()
+	var w1, w2 bytes.Buffer
+	if err := p.Write(&w1); err != nil {
+		t.Fatal("Write:", err)
+	}
+	if err := p.WriteWith(&w2, &module.WriteOptions{}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	if !bytes.Equal(w1.Bytes(), w2.Bytes()) {
+		t.Error("Write output differs from WriteWith with default options")
+	}
+}
+
+func TestWriteStrict(t *testing.T) {
+	p := testProgram()
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{Strict: true, ModuleName: "TEST"}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	for _, e := range checkConformance(buf.Bytes()) {
+		t.Error(e)
+	}
+	// The section checksums are unverified, and only written on request.
+	data, le := buf.Bytes(), binary.LittleEndian
+	if sums := [2]uint32{le.Uint32(data[0x3c:]), le.Uint32(data[0x34:])}; sums != [2]uint32{} {
+		t.Errorf("strict output has section checksums 0x%08x, expected none", sums)
+	}
+	buf.Reset()
+	if err := p.WriteWith(&buf, &module.WriteOptions{Strict: true, SectionChecksums: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	for _, e := range checkConformance(buf.Bytes()) {
+		t.Error("with section checksums:", e)
+	}
+
+	// The default output should leave out the optional tables.
+	buf.Reset()
+	if err := p.Write(&buf); err != nil {
+		t.Fatal("Write:", err)
+	}
+	if errs := checkConformance(buf.Bytes()); len(errs) == 0 {
+		t.Error("default output passes strict conformance check")
+	}
+}
+
+func TestAdditiveFixup(t *testing.T) {
+	p := testProgram()
+	fix := module.Fixup{
+		SrcType: module.SrcOffset32,
+		Src:     0x80,
+		Target:  module.Ref{Obj: 3, Off: 0x12345},
+		Add:     0x1000,
+	}
+	p.Objects[1].Fixups = []module.Fixup{fix}
+	r, err := openBytes(t, writeBytes(t, p))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if f := r.Objects[1].Fixups; len(f) != 1 || f[0] != fix {
+		t.Fatalf("read fixups %+v, expected %+v", f, fix)
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	r.Objects[1].DumpText(w, "")
+	w.Flush()
+	if s := buf.String(); !strings.Contains(s, "07:-Aad +0x0080 03:00012345 +0x00001000") {
+		t.Errorf("DumpText does not show additive fixup:\n%s", s)
+	}
+}
+
+func TestWriteLX(t *testing.T) {
+	p := testProgram()
+	code := p.Objects[0].Data
+	for i := 0x1000; i < len(code); i++ {
+		code[i] = 0
+	}
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{Strict: true, LX: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	name := filepath.Join(t.TempDir(), "test.lx")
+	if err := os.WriteFile(name, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal("OpenWith:", err)
+	}
+	if !r.IsLX() {
+		t.Errorf("signature is %q, expected LX", r.Signature[:])
+	}
+	types := map[int][]module.PageType{
+		0: {module.PageLegal, module.PageZeroed},
+		1: {module.PageLegal},
+		2: nil,
+	}
+	for i, obj := range r.Objects {
+		var got []module.PageType
+		for _, pg := range obj.Pages {
+			got = append(got, pg.Type)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(types[i]) {
+			t.Errorf("object %d: page types %v, expected %v", i+1, got, types[i])
+		}
+		in := p.Objects[i]
+		if !bytes.Equal(bytes.TrimRight(obj.Data, "\x00"), bytes.TrimRight(in.Data, "\x00")) {
+			t.Errorf("object %d: data does not match", i+1)
+		}
+		if fmt.Sprint(obj.Fixups) != fmt.Sprint(in.Fixups) {
+			t.Errorf("object %d: fixups %v, expected %v", i+1, obj.Fixups, in.Fixups)
+		}
+	}
+}
+
+func TestWritePreloadAll(t *testing.T) {
+	for _, lx := range []bool{false, true} {
+		var buf bytes.Buffer
+		opts := module.WriteOptions{LX: lx, PreloadAll: true}
+		if err := testProgram().WriteWith(&buf, &opts); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		r, err := openBytes(t, buf.Bytes())
+		if err != nil {
+			t.Fatalf("lx=%t: Open: %v", lx, err)
+		}
+		if r.NumPreloadPages != 3 || r.NumPreloadPages != r.ModuleNumPages {
+			t.Errorf("lx=%t: %d preload pages, %d pages, expected 3",
+				lx, r.NumPreloadPages, r.ModuleNumPages)
+		}
+		for i, obj := range r.Objects {
+			// The BSS object has no pages to preload.
+			if preload, e := obj.Flags&module.ObjPreload != 0, i != 2; preload != e {
+				t.Errorf("lx=%t: object %d preload = %t, expected %t", lx, i+1, preload, e)
+			}
+		}
+	}
+	r, err := openBytes(t, writeBytes(t, testProgram()))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if r.NumPreloadPages != 0 || r.Objects[0].Flags&module.ObjPreload != 0 {
+		t.Error("default output has preload pages")
+	}
+}
+
+func TestWriteSourceLists(t *testing.T) {
+	p := testProgram()
+	var fixups []module.Fixup
+	// More references to one target than fit in a single source list.
+	for i := int32(0); i < 300; i++ {
+		fixups = append(fixups, module.Fixup{
+			SrcType: module.SrcOffset32, Src: 0x100 + i*4, Target: module.Ref{Obj: 2, Off: 0x10}})
+	}
+	fixups = append(fixups,
+		module.Fixup{SrcType: module.SrcRelative32, Src: 0x800, Target: module.Ref{Obj: 2, Off: 0x10}},
+		module.Fixup{SrcType: module.SrcOffset32, Src: 0xffe, Target: module.Ref{Obj: 3, Off: 0x8000}},
+		module.Fixup{SrcType: module.SrcOffset32, Src: 0x1100, Target: module.Ref{Obj: 2, Off: 0x10}, Add: 5},
+		module.Fixup{SrcType: module.SrcOffset32, Src: 0x1200, Target: module.Ref{Obj: 2, Off: 0x10}, Add: 5},
+	)
+	p.Objects[0].Fixups = fixups
+	var plain, lists bytes.Buffer
+	if err := p.WriteWith(&plain, nil); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	if err := p.WriteWith(&lists, &module.WriteOptions{SourceLists: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	le := binary.LittleEndian
+	size0 := le.Uint32(plain.Bytes()[0x30:])
+	size1 := le.Uint32(lists.Bytes()[0x30:])
+	if size1 >= size0/2 {
+		t.Errorf("fixup section size with source lists is %d, without is %d", size1, size0)
+	}
+	r, err := openBytes(t, lists.Bytes())
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	for i, obj := range r.Objects {
+		if !reflect.DeepEqual(obj.Fixups, p.Objects[i].Fixups) {
+			t.Errorf("object %d fixups:\ngot      %+v\nexpected %+v", i+1, obj.Fixups, p.Objects[i].Fixups)
+		}
+	}
+}
+
+func TestWriteHeapSize(t *testing.T) {
+	p := testProgram()
+	p.HeapSize = 0x10000
+	data := writeBytes(t, p)
+	if h := binary.LittleEndian.Uint32(data[0xa8:]); h != 0x10000 {
+		t.Errorf("heap size field = 0x%x, expected 0x10000", h)
+	}
+	r, err := openBytes(t, data)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if r.HeapSize != p.HeapSize {
+		t.Errorf("HeapSize = 0x%x, expected 0x%x", r.HeapSize, p.HeapSize)
+	}
+	if s := dumpText(r, nil); !strings.Contains(s, "Heap Size:                      0x00010000\n") {
+		t.Errorf("dump does not show heap size:\n%s", s)
+	}
+}
+
+func TestWriteStub(t *testing.T) {
+	stub := make([]byte, 0x43)
+	copy(stub, "MZ")
+	p := testProgram()
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{Stub: stub}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	off := le.Uint32(data[0x3c:])
+	if off != 0x50 {
+		t.Errorf("e_lfanew = 0x%x, expected 0x50", off)
+	}
+	if sig := string(data[off : off+2]); sig != "LE" {
+		t.Fatalf("signature at e_lfanew is %q, expected \"LE\"", sig)
+	}
+	// Without the stub, the module is the same, except for the data pages
+	// offset, which is relative to the start of the file.
+	plain := writeBytes(t, p)
+	le.PutUint32(plain[0x80:], le.Uint32(plain[0x80:])+off)
+	if !bytes.Equal(data[off:], plain) {
+		t.Error("module after stub differs from module without stub")
+	}
+	if d := data[le.Uint32(data[off+0x80:]):]; !bytes.HasPrefix(d, p.Objects[0].Data) {
+		t.Error("data pages offset does not point to the first object's data")
+	}
+
+	for _, stub := range [][]byte{make([]byte, 0x40), []byte("MZ")} {
+		if err := p.WriteWith(&buf, &module.WriteOptions{Stub: stub}); err == nil {
+			t.Errorf("WriteWith: expected error for stub %q", stub)
+		}
+	}
+}
+
+func TestWriteStubRead(t *testing.T) {
+	stub := make([]byte, 0x43)
+	copy(stub, "MZ")
+	p := testProgram()
+	for _, c := range []struct {
+		name string
+		opts module.WriteOptions
+	}{
+		{"LE", module.WriteOptions{Stub: stub}},
+		{"LE strict", module.WriteOptions{Stub: stub, Strict: true}},
+		{"LX strict", module.WriteOptions{Stub: stub, LX: true, Strict: true}},
+		{"DOS/4GW", module.WriteOptions{Stub: stub, DOS4GW: true}},
+	} {
+		var plain, stubbed bytes.Buffer
+		opts, popts := c.opts, c.opts
+		popts.Stub, popts.DOS4GW = nil, false
+		if err := p.WriteWith(&plain, &popts); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		if err := p.WriteWith(&stubbed, &opts); err != nil {
+			t.Fatal("WriteWith:", err)
+		}
+		ropts := module.ReadOptions{VerifyChecksums: true}
+		e, err := module.OpenReaderAtWith(bytes.NewReader(plain.Bytes()), int64(plain.Len()), &ropts)
+		if err != nil {
+			t.Fatal("OpenReaderAtWith:", err)
+		}
+		r, err := module.OpenReaderAtWith(bytes.NewReader(stubbed.Bytes()), int64(stubbed.Len()), &ropts)
+		if err != nil {
+			t.Errorf("%s: OpenReaderAtWith: %v", c.name, err)
+			continue
+		}
+		if err := r.CompareLayout(e); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		for i, obj := range e.Objects {
+			if !bytes.Equal(r.Objects[i].Data, obj.Data) {
+				t.Errorf("%s: object %d: data differs", c.name, i+1)
+			}
+			if !reflect.DeepEqual(r.Objects[i].Fixups, obj.Fixups) {
+				t.Errorf("%s: object %d: fixups = %v, expected %v", c.name, i+1, r.Objects[i].Fixups, obj.Fixups)
+			}
+		}
+	}
+
+	// e_lfanew must point inside the file, after the MZ header.
+	data := make([]byte, 0x80)
+	copy(data, "MZ")
+	for _, off := range []uint32{0, 0x3c, 0x81} {
+		binary.LittleEndian.PutUint32(data[0x3c:], off)
+		_, err := module.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		if err == nil || !strings.Contains(err.Error(), "invalid e_lfanew") {
+			t.Errorf("e_lfanew 0x%x: got error %v, expected invalid e_lfanew", off, err)
+		}
+	}
+}
+
+func TestWriteDOS4GW(t *testing.T) {
+	le := binary.LittleEndian
+	// The stub declares a 0x200 byte image, and its relocation table
+	// overlaps e_lfanew.
+	stub := make([]byte, 0x43)
+	copy(stub, "MZ")
+	le.PutUint16(stub[0x02:], 0)
+	le.PutUint16(stub[0x04:], 1)
+	le.PutUint16(stub[0x08:], 4)
+	le.PutUint16(stub[0x18:], 0x1c)
+	p := testProgram()
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{Stub: stub, DOS4GW: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	off := le.Uint32(data[0x3c:])
+	if off != 0x50 {
+		t.Errorf("e_lfanew = 0x%x, expected 0x50", off)
+	}
+	if sig := string(data[off : off+2]); sig != "LE" {
+		t.Fatalf("signature at e_lfanew is %q, expected \"LE\"", sig)
+	}
+	if r := le.Uint16(data[0x18:]); r != 0x40 {
+		t.Errorf("e_lfarlc = 0x%x, expected 0x40", r)
+	}
+	// The MZ image ends where the LE header starts.
+	size := uint32(le.Uint16(data[0x04:])) * 512
+	if n := le.Uint16(data[0x02:]); n != 0 {
+		size -= 512 - uint32(n)
+	}
+	if size != off {
+		t.Errorf("MZ image size = 0x%x, expected 0x%x", size, off)
+	}
+	if d := data[le.Uint32(data[off+0x80:]):]; !bytes.HasPrefix(d, p.Objects[0].Data) {
+		t.Error("data pages offset does not point to the first object's data")
+	}
+
+	le.PutUint16(stub[0x06:], 1)
+	for _, c := range []struct {
+		opts   module.WriteOptions
+		expect string
+	}{
+		{module.WriteOptions{DOS4GW: true}, "require a stub"},
+		{module.WriteOptions{DOS4GW: true, Stub: stub, LX: true}, "require LE format"},
+		{module.WriteOptions{DOS4GW: true, Stub: stub}, "overlaps e_lfanew"},
+	} {
+		err := p.WriteWith(&buf, &c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("WriteWith: got error %v, expected %q", err, c.expect)
+		}
+	}
+}
+
+func TestWriteSectionChecksums(t *testing.T) {
+	le := binary.LittleEndian
+	data := writeBytes(t, testProgram())
+	if le.Uint32(data[0x34:]) != 0 || le.Uint32(data[0x3c:]) != 0 {
+		t.Error("default output has section checksums")
+	}
+	var buf bytes.Buffer
+	if err := testProgram().WriteWith(&buf, &module.WriteOptions{SectionChecksums: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data = buf.Bytes()
+	if le.Uint32(data[0x34:]) == 0 || le.Uint32(data[0x3c:]) == 0 {
+		t.Error("section checksums are zero")
+	}
+	name := filepath.Join(t.TempDir(), "test.le")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true}); err != nil {
+		t.Fatal("OpenWith:", err)
+	}
+	// Change the target offset of the first fixup record.
+	data[le.Uint32(data[0x6c:])+5] ^= 0x01
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := module.OpenWith(name, &module.ReadOptions{VerifyChecksums: true})
+	if err == nil || !strings.HasPrefix(err.Error(), "fixup section checksum") {
+		t.Errorf("OpenWith: got error %v, expected fixup section checksum mismatch", err)
+	}
+}
+
+func TestWriteFixupSectionChecksum(t *testing.T) {
+	p := &module.Program{
+		Objects: []*module.Object{{
+			ObjectHeader: module.ObjectHeader{
+				VirtualSize: 0x100,
+				Flags:       module.ObjR | module.ObjX | module.Obj32Bit,
+			},
+			Data: make([]byte, 0x100),
+			Fixups: []module.Fixup{
+				{SrcType: module.SrcOffset32, Src: 0x10, Target: module.Ref{Obj: 1, Off: 0x20}},
+			},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{SectionChecksums: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	// The fixup section is the fixup page table, offsets 0 and 7, followed by
+	// the record 07 00 10 00 01 20 00. The checksum is the sum of the
+	// little-endian words, with the last word padded with zeroes:
+	// 0x00000000 + 0x00000007 + 0x00100007 + 0x00002001.
+	const expect = 0x0010200f
+	start, size := le.Uint32(data[0x68:]), le.Uint32(data[0x30:])
+	if size != 15 {
+		t.Fatalf("fixup section size is %d, expected 15: % x", size, data[start:start+size])
+	}
+	if sum := le.Uint32(data[0x34:]); sum != expect {
+		t.Errorf("fixup section checksum is 0x%08x, expected 0x%08x", sum, expect)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// hexDump formats data as lines of 16 bytes, with "*" in place of lines which
+// repeat the previous line, followed by the size of the data.
+func hexDump(data []byte) string {
+	var b strings.Builder
+	var prev []byte
+	repeat := false
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		if prev != nil && bytes.Equal(line, prev) {
+			if !repeat {
+				b.WriteString("*\n")
+				repeat = true
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "%08x  % x\n", off, line)
+		prev, repeat = line, false
+	}
+	fmt.Fprintf(&b, "%08x\n", len(data))
+	return b.String()
+}
+
+func TestWriteStreamed(t *testing.T) {
+	stub := make([]byte, 0x40)
+	copy(stub, "MZ")
+	// The golden files were first written by the original writer, which built
+	// the whole module in memory before writing it. Run with -update to
+	// rewrite them after an intended change to the output.
+	for _, c := range []struct {
+		name string
+		opts *module.WriteOptions
+	}{
+		{"default", nil},
+		{"lx", &module.WriteOptions{LX: true}},
+		{"strict", &module.WriteOptions{Strict: true}},
+		{"strict_lx", &module.WriteOptions{Strict: true, LX: true}},
+		{"stub", &module.WriteOptions{Stub: stub, SectionChecksums: true}},
+		{"lists", &module.WriteOptions{SourceLists: true, PreloadAll: true}},
+	} {
+		var buf bytes.Buffer
+		if err := testProgram().WriteWith(&buf, c.opts); err != nil {
+			t.Errorf("%s: WriteWith: %v", c.name, err)
+			continue
+		}
+		got := hexDump(buf.Bytes())
+		name := filepath.Join("testdata", "write_"+c.name+".hex")
+		if *update {
+			if err := os.WriteFile(name, []byte(got), 0666); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expect, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == string(expect) {
+			continue
+		}
+		glines := strings.Split(got, "\n")
+		elines := strings.Split(string(expect), "\n")
+		for i := 0; i < len(glines) && i < len(elines); i++ {
+			if glines[i] != elines[i] {
+				t.Errorf("%s: output differs from %s at line %d:\n got:    %s\n expect: %s",
+					c.name, name, i+1, glines[i], elines[i])
+				break
+			}
+		}
+	}
+}
+
+func TestWriteMap(t *testing.T) {
+	stub := make([]byte, 0x40)
+	copy(stub, "MZ")
+	var buf, m bytes.Buffer
+	if err := testProgram().WriteWith(&buf, &module.WriteOptions{Strict: true, Stub: stub, Map: &m}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	sections := make(map[string][2]uint32)
+	lines := strings.Split(strings.TrimSuffix(m.String(), "\n"), "\n")
+	for _, line := range lines[1:] {
+		f := strings.Fields(line)
+		var off, size uint32
+		if len(f) < 3 {
+			t.Fatalf("invalid line: %q", line)
+		}
+		if _, err := fmt.Sscanf(f[len(f)-2]+" "+f[len(f)-1], "0x%x 0x%x", &off, &size); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		sections[strings.Join(f[:len(f)-2], " ")] = [2]uint32{off, size}
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	hdr := le.Uint32(data[0x3c:])
+	h := data[hdr:]
+	for _, c := range []struct {
+		name   string
+		offset uint32
+	}{
+		{"MZ stub", 0},
+		{"header", hdr},
+		{"object table", hdr + le.Uint32(h[0x40:])},
+		{"page table", hdr + le.Uint32(h[0x48:])},
+		{"resident names", hdr + le.Uint32(h[0x58:])},
+		{"entry table", hdr + le.Uint32(h[0x5c:])},
+		{"page checksums", hdr + le.Uint32(h[0x7c:])},
+		{"fixup page table", hdr + le.Uint32(h[0x68:])},
+		{"fixup records", hdr + le.Uint32(h[0x6c:])},
+		{"data pages", le.Uint32(h[0x80:])},
+	} {
+		s, ok := sections[c.name]
+		if !ok {
+			t.Errorf("map has no %s:\n%s", c.name, m.String())
+		} else if s[0] != c.offset {
+			t.Errorf("%s: map has offset 0x%x, header has 0x%x", c.name, s[0], c.offset)
+		}
+	}
+	if s := sections["object table"]; s[1] != 3*24 {
+		t.Errorf("object table size 0x%x, expected 0x%x", s[1], 3*24)
+	}
+	fix := sections["fixup page table"][1] + sections["fixup records"][1]
+	if size := le.Uint32(h[0x30:]); fix != size {
+		t.Errorf("fixup section size 0x%x, map has 0x%x", size, fix)
+	}
+	if s := sections["data pages"]; s[0]+s[1] != uint32(len(data)) {
+		t.Errorf("data pages end at 0x%x, file size is 0x%x", s[0]+s[1], len(data))
+	}
+}
+
+func TestWriteCompress(t *testing.T) {
+	p := testProgram()
+	// A table of zeroes between two runs of repeated bytes.
+	data := make([]byte, 0x2000)
+	for i := 0; i < 0x40; i++ {
+		data[i] = byte(i)
+		data[0x1800+i] = 0x55
+	}
+	copy(data[0x1fc0:], "end")
+	p.Objects[2].Data = data
+	var plain, packed bytes.Buffer
+	if err := p.WriteWith(&plain, &module.WriteOptions{LX: true}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	if err := p.WriteWith(&packed, &module.WriteOptions{LX: true, Compress: true}); err != nil {
+		t.Fatal("WriteWith compressed:", err)
+	}
+	if packed.Len() >= plain.Len() {
+		t.Errorf("compressed module is 0x%x bytes, uncompressed is 0x%x", packed.Len(), plain.Len())
+	}
+	r, err := openBytes(t, packed.Bytes())
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	var iterated int
+	for _, obj := range r.Objects {
+		for _, pg := range obj.Pages {
+			if pg.Type == module.PageIterated {
+				iterated++
+			}
+		}
+	}
+	if iterated == 0 {
+		t.Error("no iterated pages")
+	}
+	for i, obj := range p.Objects {
+		d := r.Objects[i].Data
+		if e := bytes.TrimRight(obj.Data, "\x00"); !bytes.Equal(bytes.TrimRight(d, "\x00"), e) {
+			t.Errorf("object %d: data differs", i+1)
+		}
+		if !reflect.DeepEqual(r.Objects[i].Fixups, obj.Fixups) {
+			t.Errorf("object %d: fixups = %v, expected %v", i+1, r.Objects[i].Fixups, obj.Fixups)
+		}
+	}
+
+	if err := p.WriteWith(&packed, &module.WriteOptions{Compress: true}); err == nil {
+		t.Error("WriteWith: expected error for compressed LE")
+	}
+}
+
+func TestWritePageSize(t *testing.T) {
+	p, err := openBytes(t, writeBytes(t, testProgram()))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	var buf bytes.Buffer
+	if err := p.WriteWith(&buf, &module.WriteOptions{LX: true, PageSize: 0x4000}); err != nil {
+		t.Fatal("WriteWith:", err)
+	}
+	r, err := openBytes(t, buf.Bytes())
+	if err != nil {
+		t.Fatal("Open repaged:", err)
+	}
+	if r.PageSize != 0x4000 {
+		t.Errorf("page size 0x%x, expected 0x4000", r.PageSize)
+	}
+	// Each object fits in one 16 KiB page.
+	for i, obj := range r.Objects {
+		if n := len(obj.Pages); n > 1 {
+			t.Errorf("object %d has %d pages, expected at most 1", i+1, n)
+		}
+	}
+	for i, obj := range p.Objects {
+		d := r.Objects[i].Data
+		if !bytes.Equal(bytes.TrimRight(d, "\x00"), bytes.TrimRight(obj.Data, "\x00")) {
+			t.Errorf("object %d: data differs", i+1)
+		}
+		if !reflect.DeepEqual(r.Objects[i].Fixups, obj.Fixups) {
+			t.Errorf("object %d: fixups = %v, expected %v", i+1, r.Objects[i].Fixups, obj.Fixups)
+		}
+	}
+
+	for _, opts := range []module.WriteOptions{
+		{PageSize: 0x4000},
+		{LX: true, PageSize: 0x3000},
+		{LX: true, PageSize: 0x10000},
+	} {
+		if err := p.WriteWith(&buf, &opts); err == nil {
+			t.Errorf("WriteWith(%+v): expected error", opts)
+		}
+	}
+}